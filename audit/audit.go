@@ -0,0 +1,176 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Actions recorded in the audit log.
+const (
+	Provision   = "provision"
+	Bind        = "bind"
+	Unbind      = "unbind"
+	Deprovision = "deprovision"
+)
+
+// Outcomes of the recorded actions. Accepted is recorded when an action
+// goes on asynchronously, followed by another entry once it completes.
+const (
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	Accepted  = "accepted"
+)
+
+// maxEntrySize bounds the length of a line of the audit log.
+const maxEntrySize = 1024 * 1024
+
+// Entry records who asked the broker for an action on a service instance,
+// when, and its outcome.
+type Entry struct {
+	Time           time.Time `json:"time"`
+	RequestID      string    `json:"request_id,omitempty"`
+	Action         string    `json:"action"`
+	InstanceID     string    `json:"instance_id"`
+	BindingID      string    `json:"binding_id,omitempty"`
+	ServiceID      string    `json:"service_id,omitempty"`
+	PlanID         string    `json:"plan_id,omitempty"`
+	OrganizationID string    `json:"organization_guid,omitempty"`
+	SpaceID        string    `json:"space_guid,omitempty"`
+	// Platform and UserID identify the user behind the request, as sent by
+	// the platform in the originating identity.
+	Platform string `json:"platform,omitempty"`
+	UserID   string `json:"user_id,omitempty"`
+	Outcome  string `json:"outcome"`
+	// Status is the HTTP status code of the response, 0 for the entries
+	// recorded when an asynchronous action completes.
+	Status      int    `json:"status,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// Filter selects entries of the audit log. Empty fields match everything.
+type Filter struct {
+	InstanceID     string
+	UserID         string
+	OrganizationID string
+	// From and To bound the time of the entries, both included.
+	From time.Time
+	To   time.Time
+	// Limit is the maximum number of entries returned, 0 for no limit.
+	Limit int
+}
+
+// Matches reports whether an entry is selected by the filter.
+func (f Filter) Matches(e Entry) bool {
+	return (f.InstanceID == "" || e.InstanceID == f.InstanceID) &&
+		(f.UserID == "" || e.UserID == f.UserID) &&
+		(f.OrganizationID == "" || e.OrganizationID == f.OrganizationID) &&
+		(f.From.IsZero() || !e.Time.Before(f.From)) &&
+		(f.To.IsZero() || !e.Time.After(f.To))
+}
+
+// Log is an append-only file of JSON entries, one per line, only readable
+// by the broker user. Entries are never rewritten nor removed by the broker.
+type Log struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// Open opens the audit log at path, creating it if needed.
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Log{path: path, file: file}, nil
+}
+
+// Append writes an entry at the end of the log and flushes it to disk.
+func (l *Log) Append(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err = l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	return l.file.Sync()
+}
+
+// Query returns the entries selected by the filter, newest first.
+func (l *Log) Query(f Filter) ([]Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() // nolint: errcheck
+
+	entries := []Entry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxEntrySize)
+	for scanner.Scan() {
+		var e Entry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A line cut short by a crash is skipped
+			continue
+		}
+
+		if f.Matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	if f.Limit > 0 && len(entries) > f.Limit {
+		entries = entries[:f.Limit]
+	}
+
+	return entries, nil
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Close()
+}
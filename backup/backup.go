@@ -0,0 +1,519 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/database"
+	"github.com/cloudfoundry-community/cf-nosql-broker/security"
+	"github.com/cloudfoundry-community/cf-nosql-broker/state"
+)
+
+const (
+	archiveExtension  = ".archive"
+	metadataExtension = ".json"
+
+	// Triggers recorded with every backup.
+	TriggerScheduled = "scheduled"
+	TriggerManual    = "manual"
+
+	errorBackupRunning  = "a backup of this instance is already running"
+	errorBackupNotFound = "the backup does not exist"
+	errorNoMasterKey    = "the backups are encrypted but no master key is configured"
+)
+
+// Backup is the metadata kept next to every archive.
+type Backup struct {
+	ID             string    `json:"id"`
+	InstanceID     string    `json:"instance_id"`
+	ServiceID      string    `json:"service_id"`
+	PlanID         string    `json:"plan_id"`
+	OrganizationID string    `json:"organization_guid"`
+	SpaceID        string    `json:"space_guid"`
+	Format         string    `json:"format"`
+	Trigger        string    `json:"trigger"`
+	Size           int64     `json:"size"`
+	SHA256         string    `json:"sha256"`
+	StartedAt      time.Time `json:"started_at"`
+	CompletedAt    time.Time `json:"completed_at"`
+	// Location is where the archive is stored, such as a file or s3 URL.
+	Location   string      `json:"location"`
+	Encryption *Encryption `json:"encryption,omitempty"`
+	// Verification is the outcome of the latest verification restore.
+	Verification *Verification `json:"verification,omitempty"`
+	// OplogTimestamp is the newest operations log entry when the dump
+	// started, set for replica sets. Replaying the archived oplog after it
+	// brings a restore to any later point in time.
+	OplogTimestamp *database.Timestamp `json:"oplog_timestamp,omitempty"`
+	// Collections counts the documents of every collection right before
+	// the dump, for the verification restores. Backups taken before the
+	// counts were recorded have none.
+	Collections map[string]int64 `json:"collections"`
+}
+
+// Encryption describes the client-side encryption of an archive: the data
+// key encrypting it, wrapped by the master key with the given fingerprint.
+type Encryption struct {
+	MasterKeyID string `json:"master_key_id"`
+	WrappedKey  string `json:"wrapped_key"`
+}
+
+// Manager takes the backups of the instances and keeps them in a Storage,
+// one folder per instance holding the archives and their metadata.
+type Manager struct {
+	storage Storage
+	keys    *security.KeyRing
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+// NewManager returns a Manager keeping the archives in storage. When keys is
+// not nil every archive is encrypted with its own data key before it leaves
+// the broker.
+func NewManager(storage Storage, keys *security.KeyRing) *Manager {
+	return &Manager{storage: storage, keys: keys, running: map[string]bool{}}
+}
+
+// Create dumps an instance through its engine and stores the archive with
+// its checksum. Only one backup per instance runs at a time.
+func (m *Manager) Create(instance state.Instance, server database.Server,
+	engine database.Engine, trigger string) (Backup, error) {
+
+	if !m.start(instance.ID) {
+		return Backup{}, errors.New(errorBackupRunning)
+	}
+	defer m.finish(instance.ID)
+
+	id, err := newID()
+	if err != nil {
+		return Backup{}, err
+	}
+
+	backup := Backup{
+		ID:             id,
+		InstanceID:     instance.ID,
+		ServiceID:      instance.ServiceID,
+		PlanID:         instance.PlanID,
+		OrganizationID: instance.OrganizationID,
+		SpaceID:        instance.SpaceID,
+		Format:         engine.DumpFormat(server),
+		Trigger:        trigger,
+		StartedAt:      time.Now().UTC(),
+	}
+
+	// Operations are idempotent so replaying entries the dump already holds
+	// is harmless, while reading the position after the dump could skip some
+	if server.ReplicaSet {
+		_, last, err := engine.OplogRange(server)
+		if err != nil {
+			return Backup{}, err
+		}
+		backup.OplogTimestamp = &last
+	}
+
+	backup.Collections, err = engine.CollectionCounts(server)
+	if err != nil {
+		return Backup{}, err
+	}
+
+	// The metadata is only written once the archive is complete, so a
+	// failed dump never looks like a backup
+	key := archiveKey(backup)
+	stored, err := m.upload(key, func(w io.Writer) error {
+		return engine.Dump(server, w)
+	})
+	if err != nil {
+		return Backup{}, err
+	}
+
+	backup.Size = stored.size
+	backup.SHA256 = stored.checksum
+	backup.Encryption = stored.encryption
+
+	backup.Location = m.storage.Location(key)
+	backup.CompletedAt = time.Now().UTC()
+
+	if err = m.putJSON(metadataKey(backup), backup); err != nil {
+		m.storage.Delete(key) // nolint: errcheck
+		return Backup{}, err
+	}
+
+	return backup, nil
+}
+
+// List returns the backups of an instance, newest first.
+func (m *Manager) List(instanceID string) ([]Backup, error) {
+	keys, err := m.storage.List(instanceID + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []Backup{}
+	for _, key := range keys {
+		if path.Dir(key) != instanceID || path.Ext(key) != metadataExtension {
+			continue
+		}
+
+		var backup Backup
+		if err = m.getJSON(key, &backup); err != nil {
+			return nil, err
+		}
+		backups = append(backups, backup)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].StartedAt.After(backups[j].StartedAt)
+	})
+
+	return backups, nil
+}
+
+// Get returns the metadata of a backup.
+func (m *Manager) Get(backupID string) (Backup, error) {
+	keys, err := m.storage.List("")
+	if err != nil {
+		return Backup{}, err
+	}
+
+	for _, key := range keys {
+		if strings.Count(key, "/") == 1 &&
+			path.Base(key) == backupID+metadataExtension {
+			var backup Backup
+			err = m.getJSON(key, &backup)
+			return backup, err
+		}
+	}
+
+	return Backup{}, errors.New(errorBackupNotFound)
+}
+
+// Find returns the latest backup of an instance completed at or before the
+// given time.
+func (m *Manager) Find(instanceID string, at time.Time) (Backup, error) {
+	backups, err := m.List(instanceID)
+	if err != nil {
+		return Backup{}, err
+	}
+
+	for _, backup := range backups {
+		if !backup.CompletedAt.After(at) {
+			return backup, nil
+		}
+	}
+
+	return Backup{}, errors.New(errorBackupNotFound)
+}
+
+// Open returns the archive of a backup after checking it still matches the
+// checksum recorded when it was taken.
+func (m *Manager) Open(backup Backup) (io.ReadCloser, error) {
+	return m.openVerified(archiveKey(backup), backup.SHA256,
+		backup.Encryption, "backup "+backup.ID)
+}
+
+// RewrapKeys wraps the data keys of the archives encrypted under a previous
+// master key with the current one, and returns how many were updated. The
+// archives themselves are not rewritten.
+func (m *Manager) RewrapKeys() (int, error) {
+	if m.keys == nil {
+		return 0, errors.New(errorNoMasterKey)
+	}
+
+	keys, err := m.storage.List("")
+	if err != nil {
+		return 0, err
+	}
+
+	rewrapped := 0
+	for _, key := range keys {
+		if path.Ext(key) != metadataExtension {
+			continue
+		}
+
+		// Backups and oplog segments share the encryption metadata
+		var metadata struct {
+			Encryption *Encryption `json:"encryption"`
+		}
+		if err = m.getJSON(key, &metadata); err != nil {
+			return rewrapped, err
+		}
+
+		encryption := metadata.Encryption
+		if encryption == nil || encryption.MasterKeyID == m.keys.CurrentID() {
+			continue
+		}
+
+		var document map[string]interface{}
+		if err = m.getJSON(key, &document); err != nil {
+			return rewrapped, err
+		}
+
+		wrapped, masterID, err := m.keys.RewrapDataKey(
+			encryption.MasterKeyID, encryption.WrappedKey)
+		if err != nil {
+			return rewrapped, errors.New(key + ": " + err.Error())
+		}
+		document["encryption"] = Encryption{
+			MasterKeyID: masterID,
+			WrappedKey:  wrapped,
+		}
+
+		if err = m.putJSON(key, document); err != nil {
+			return rewrapped, err
+		}
+		rewrapped++
+	}
+
+	return rewrapped, nil
+}
+
+// uploaded describes an object written by upload.
+type uploaded struct {
+	size       int64
+	checksum   string
+	encryption *Encryption
+}
+
+// upload streams the output of write to the storage, encrypting it when a
+// master key is configured. The size and checksum are the ones of the
+// stored object.
+func (m *Manager) upload(key string, write func(io.Writer) error) (uploaded,
+	error) {
+
+	var result uploaded
+	var dataKey []byte
+	if m.keys != nil {
+		var err error
+		result.encryption = &Encryption{}
+		dataKey, result.encryption.WrappedKey, result.encryption.MasterKeyID,
+			err = m.keys.NewDataKey()
+		if err != nil {
+			return uploaded{}, err
+		}
+	}
+
+	reader, writer := io.Pipe()
+	hash := sha256.New()
+	counter := &countingWriter{}
+
+	written := make(chan error, 1)
+	go func() {
+		err := encryptTo(io.MultiWriter(hash, counter, writer), dataKey, write)
+		writer.CloseWithError(err) // nolint: errcheck
+		written <- err
+	}()
+
+	// A failed upload stops the writer at its next write
+	err := m.storage.Put(key, reader)
+	if err != nil {
+		reader.CloseWithError(err) // nolint: errcheck
+	}
+	if writeErr := <-written; writeErr != nil {
+		err = writeErr
+	}
+	if err != nil {
+		return uploaded{}, err
+	}
+
+	result.size = counter.size
+	result.checksum = hex.EncodeToString(hash.Sum(nil))
+	return result, nil
+}
+
+// encryptTo runs write on w, through an encryption stream when dataKey is
+// set.
+func encryptTo(w io.Writer, dataKey []byte, write func(io.Writer) error) error {
+	if dataKey == nil {
+		return write(w)
+	}
+
+	encrypter, err := security.NewEncryptWriter(w, dataKey)
+	if err != nil {
+		return err
+	}
+
+	err = write(encrypter)
+	if closeErr := encrypter.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// openVerified downloads an object to an anonymous temporary file and checks
+// it matches its recorded checksum before it is read, decrypting it when it
+// was encrypted.
+func (m *Manager) openVerified(key, checksum string, encryption *Encryption,
+	name string) (io.ReadCloser, error) {
+
+	object, err := m.storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close() // nolint: errcheck
+
+	file, err := ioutil.TempFile("", "cf-nosql-broker-")
+	if err != nil {
+		return nil, err
+	}
+	// The file stays readable until closed
+	os.Remove(file.Name()) // nolint: errcheck
+
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(file, hash), object); err != nil {
+		file.Close() // nolint: errcheck
+		return nil, err
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != checksum {
+		file.Close() // nolint: errcheck
+		return nil, errors.New("the archive of " + name +
+			" does not match its checksum")
+	}
+
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		file.Close() // nolint: errcheck
+		return nil, err
+	}
+
+	if encryption == nil {
+		return file, nil
+	}
+
+	if m.keys == nil {
+		file.Close() // nolint: errcheck
+		return nil, errors.New(errorNoMasterKey)
+	}
+
+	dataKey, err := m.keys.UnwrapDataKey(encryption.MasterKeyID,
+		encryption.WrappedKey)
+	if err != nil {
+		file.Close() // nolint: errcheck
+		return nil, err
+	}
+
+	plain, err := security.NewDecryptReader(file, dataKey)
+	if err != nil {
+		file.Close() // nolint: errcheck
+		return nil, err
+	}
+
+	return decryptedFile{Reader: plain, Closer: file}, nil
+}
+
+// decryptedFile reads the plain content of an encrypted file.
+type decryptedFile struct {
+	io.Reader
+	io.Closer
+}
+
+// putJSON stores a metadata object.
+func (m *Manager) putJSON(key string, value interface{}) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return m.storage.Put(key, bytes.NewReader(content))
+}
+
+// getJSON loads a metadata object.
+func (m *Manager) getJSON(key string, value interface{}) error {
+	object, err := m.storage.Get(key)
+	if err != nil {
+		return err
+	}
+	defer object.Close() // nolint: errcheck
+
+	if err = json.NewDecoder(object).Decode(value); err != nil {
+		return errors.New(key + ": " + err.Error())
+	}
+
+	return nil
+}
+
+// start marks a task on the instance, such as a backup, as running unless
+// one already is.
+func (m *Manager) start(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.running[key] {
+		return false
+	}
+
+	m.running[key] = true
+	return true
+}
+
+// finish releases the mark set by start.
+func (m *Manager) finish(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.running, key)
+}
+
+// archiveKey is the storage key of the archive of a backup.
+func archiveKey(backup Backup) string {
+	return backup.InstanceID + "/" + backup.ID + archiveExtension
+}
+
+// metadataKey is the storage key of the metadata of a backup.
+func metadataKey(backup Backup) string {
+	return backup.InstanceID + "/" + backup.ID + metadataExtension
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	size int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	return len(p), nil
+}
+
+// newID returns a random version 4 UUID.
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10],
+		b[10:]), nil
+}
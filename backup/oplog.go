@@ -0,0 +1,370 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package backup
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/database"
+	"github.com/cloudfoundry-community/cf-nosql-broker/state"
+)
+
+const (
+	oplogDir       = "oplog"
+	oplogExtension = ".bson.gz"
+	oplogTask      = "oplog:"
+
+	errorOplogRunning  = "the oplog of this instance is already being archived"
+	errorOplogNotBased = "the backup was not taken from a replica set"
+	errorOplogCoverage = "the archived oplog does not cover the requested time"
+)
+
+// OplogSegment is the metadata of an archived slice of the operations log of
+// an instance, holding the entries after From and up to To included.
+// Consecutive segments chain when one starts where the previous one ends.
+type OplogSegment struct {
+	InstanceID string             `json:"instance_id"`
+	From       database.Timestamp `json:"from"`
+	To         database.Timestamp `json:"to"`
+	Size       int64              `json:"size"`
+	SHA256     string             `json:"sha256"`
+	Location   string             `json:"location"`
+	Encryption *Encryption        `json:"encryption,omitempty"`
+	ArchivedAt time.Time          `json:"archived_at"`
+}
+
+// ArchiveOplog stores the entries appended to the operations log of an
+// instance since the last segment. When the oplog has already dropped some
+// of them the archive starts a new chain, and the restores can no longer
+// cross the gap. It returns false when there is nothing new to archive.
+func (m *Manager) ArchiveOplog(instance state.Instance, server database.Server,
+	engine database.Engine) (OplogSegment, bool, error) {
+
+	if !m.start(oplogTask + instance.ID) {
+		return OplogSegment{}, false, errors.New(errorOplogRunning)
+	}
+	defer m.finish(oplogTask + instance.ID)
+
+	segments, err := m.OplogSegments(instance.ID)
+	if err != nil {
+		return OplogSegment{}, false, err
+	}
+
+	first, last, err := engine.OplogRange(server)
+	if err != nil {
+		return OplogSegment{}, false, err
+	}
+
+	from := previous(first)
+	if len(segments) > 0 {
+		latest := segments[len(segments)-1]
+		if !latest.To.Before(last) {
+			return OplogSegment{}, false, nil
+		}
+		if !latest.To.Before(first) {
+			from = latest.To
+		}
+	}
+
+	segment := OplogSegment{
+		InstanceID: instance.ID,
+		From:       from,
+		To:         last,
+	}
+
+	key := segmentKey(segment, oplogExtension)
+	stored, err := m.upload(key, func(w io.Writer) error {
+		compressor := gzip.NewWriter(w)
+		err := engine.DumpOplog(server, from, last, compressor)
+		if closeErr := compressor.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	})
+	if err != nil {
+		return OplogSegment{}, false, err
+	}
+
+	segment.Size = stored.size
+	segment.SHA256 = stored.checksum
+	segment.Encryption = stored.encryption
+	segment.Location = m.storage.Location(key)
+	segment.ArchivedAt = time.Now().UTC()
+
+	err = m.putJSON(segmentKey(segment, metadataExtension), segment)
+	if err != nil {
+		m.storage.Delete(key) // nolint: errcheck
+		return OplogSegment{}, false, err
+	}
+
+	return segment, true, nil
+}
+
+// OplogSegments returns the archived oplog segments of an instance, oldest
+// first.
+func (m *Manager) OplogSegments(instanceID string) ([]OplogSegment, error) {
+	prefix := instanceID + "/" + oplogDir + "/"
+	keys, err := m.storage.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []OplogSegment{}
+	for _, key := range keys {
+		if path.Ext(key) != metadataExtension {
+			continue
+		}
+
+		var segment OplogSegment
+		if err = m.getJSON(key, &segment); err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].To.Before(segments[j].To)
+	})
+
+	return segments, nil
+}
+
+// OplogChain returns the segments replaying the operations that followed a
+// replica set backup, as far as they chain without a gap.
+func (m *Manager) OplogChain(backup Backup) ([]OplogSegment, error) {
+	if backup.OplogTimestamp == nil {
+		return nil, errors.New(errorOplogNotBased)
+	}
+
+	segments, err := m.OplogSegments(backup.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := []OplogSegment{}
+	position := *backup.OplogTimestamp
+	for _, segment := range segments {
+		if !position.Before(segment.To) {
+			continue
+		}
+		// The segment must start at or before the position reached so far
+		if position.Before(segment.From) {
+			break
+		}
+		chain = append(chain, segment)
+		position = segment.To
+	}
+
+	return chain, nil
+}
+
+// RecoveryWindow returns the earliest and latest points in time an instance
+// can be restored to, from its oldest replica set backup still followed by
+// an unbroken oplog chain up to the latest archived entry.
+func (m *Manager) RecoveryWindow(instanceID string) (time.Time, time.Time,
+	error) {
+
+	backups, err := m.List(instanceID)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	var earliest, latest time.Time
+	for _, backup := range backups {
+		if backup.OplogTimestamp == nil {
+			continue
+		}
+
+		chain, err := m.OplogChain(backup)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		if len(chain) == 0 {
+			continue
+		}
+
+		// The whole second of a point in time is replayed, see OpenOplog
+		end := chain[len(chain)-1].To.Time().Add(-time.Second)
+		if latest.IsZero() {
+			latest = end
+		}
+		if end.Equal(latest) {
+			earliest = backup.CompletedAt
+		}
+	}
+
+	if latest.IsZero() {
+		return time.Time{}, time.Time{}, errors.New(errorOplogCoverage)
+	}
+
+	return earliest, latest, nil
+}
+
+// CheckOplog checks, from the segment metadata only, that the archived oplog
+// following a backup reaches the given time. It returns the chain of
+// segments and the exclusive replay limit.
+func (m *Manager) CheckOplog(backup Backup, at time.Time) ([]OplogSegment,
+	database.Timestamp, error) {
+
+	chain, err := m.OplogChain(backup)
+	if err != nil {
+		return nil, database.Timestamp{}, err
+	}
+
+	// Every entry of the requested second is replayed. A primary writes a
+	// no-op entry every few seconds, so a later entry proves the archive
+	// holds all of them
+	limit := database.Timestamp{T: uint32(at.Unix()) + 1}
+	if len(chain) == 0 || chain[len(chain)-1].To.Before(limit) ||
+		at.Before(backup.CompletedAt) {
+		return nil, database.Timestamp{}, errors.New(errorOplogCoverage)
+	}
+
+	return chain, limit, nil
+}
+
+// OpenOplog returns the operations of a backup chain up to the given time as
+// a single BSON stream, after checking every segment against its checksum.
+// The second returned value is the exclusive replay limit.
+func (m *Manager) OpenOplog(backup Backup, at time.Time) (io.ReadCloser,
+	database.Timestamp, error) {
+
+	chain, limit, err := m.CheckOplog(backup, at)
+	if err != nil {
+		return nil, database.Timestamp{}, err
+	}
+
+	files := &multiFile{}
+	readers := []io.Reader{}
+	for _, segment := range chain {
+		file, err := m.openVerified(segmentKey(segment, oplogExtension),
+			segment.SHA256, segment.Encryption,
+			"oplog segment "+segment.To.String())
+		if err != nil {
+			files.Close() // nolint: errcheck
+			return nil, database.Timestamp{}, err
+		}
+		files.files = append(files.files, file)
+		readers = append(readers, file)
+
+		if !segment.To.Before(limit) {
+			break
+		}
+	}
+
+	// Concatenated gzip members decompress as the concatenation of their
+	// content
+	decompressor, err := gzip.NewReader(io.MultiReader(readers...))
+	if err != nil {
+		files.Close() // nolint: errcheck
+		return nil, database.Timestamp{}, err
+	}
+	files.Reader = decompressor
+
+	return files, limit, nil
+}
+
+// PruneOplog removes the segments no longer needed to restore an instance to
+// any point after cutoff: the ones preceding the backup a restore to cutoff
+// would start from.
+func (m *Manager) PruneOplog(instanceID string, cutoff time.Time) (int, error) {
+	segments, err := m.OplogSegments(instanceID)
+	if err != nil {
+		return 0, err
+	}
+
+	keepAfter := database.Timestamp{T: uint32(cutoff.Unix())}
+	backups, err := m.List(instanceID)
+	if err != nil {
+		return 0, err
+	}
+	for _, backup := range backups {
+		if backup.OplogTimestamp == nil {
+			continue
+		}
+		// Backups are listed newest first, the last one seen is the
+		// oldest base still needed
+		if backup.OplogTimestamp.Before(keepAfter) {
+			keepAfter = *backup.OplogTimestamp
+			if !backup.CompletedAt.After(cutoff) {
+				break
+			}
+		}
+	}
+
+	removed := 0
+	for _, segment := range segments {
+		if keepAfter.Before(segment.To) {
+			break
+		}
+
+		// The metadata goes first so a failure never leaves a segment
+		// without its archive
+		err = m.storage.Delete(segmentKey(segment, metadataExtension))
+		if err != nil {
+			return removed, err
+		}
+		err = m.storage.Delete(segmentKey(segment, oplogExtension))
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// segmentKey returns the storage key of the archive or the metadata of a
+// segment. The keys sort in oplog order.
+func segmentKey(segment OplogSegment, extension string) string {
+	return segment.InstanceID + "/" + oplogDir + "/" +
+		fmt.Sprintf("%010d-%010d", segment.To.T, segment.To.I) + extension
+}
+
+// previous returns the timestamp right before ts, so a segment starting
+// there includes ts.
+func previous(ts database.Timestamp) database.Timestamp {
+	if ts.I > 0 {
+		return database.Timestamp{T: ts.T, I: ts.I - 1}
+	}
+
+	return database.Timestamp{T: ts.T - 1, I: math.MaxUint32}
+}
+
+// multiFile reads a stream built over several files and closes all of them.
+type multiFile struct {
+	io.Reader
+	files []io.Closer
+}
+
+func (f *multiFile) Close() error {
+	var err error
+	for _, file := range f.files {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,163 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package backup
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const errorNoCollections = "the restore produced no collections"
+
+// Retention selects the backups kept for an instance: the newest backup of
+// each of the last Daily days and of each of the last Weekly weeks that have
+// one. A zero Retention keeps every backup.
+type Retention struct {
+	Daily  int
+	Weekly int
+}
+
+// Verification is the outcome of restoring a backup into a throwaway
+// database.
+type Verification struct {
+	Time   time.Time `json:"time"`
+	Passed bool      `json:"passed"`
+	// Collections counts the documents of every restored collection.
+	Collections map[string]int64 `json:"collections,omitempty"`
+	Error       string           `json:"error,omitempty"`
+}
+
+// CheckRestored compares the collections restored from a backup with the
+// ones counted when it was taken. Every collection must be restored, and one
+// holding documents must not come back empty. The counts may otherwise
+// differ, the database being written while it is dumped. A backup without
+// counts only fails when nothing was restored.
+func (b Backup) CheckRestored(restored map[string]int64) error {
+	if b.Collections == nil {
+		if len(restored) == 0 {
+			return errors.New(errorNoCollections)
+		}
+		return nil
+	}
+
+	names := make([]string, 0, len(b.Collections))
+	for name := range b.Collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		count, ok := restored[name]
+		if !ok {
+			return errors.New("the collection " + name + " was not restored")
+		}
+		if count == 0 && b.Collections[name] > 0 {
+			return errors.New("the collection " + name + " was restored " +
+				"empty instead of " + strconv.FormatInt(b.Collections[name], 10) +
+				" documents")
+		}
+	}
+
+	return nil
+}
+
+// Expired returns the backups not selected by the retention, given the
+// backups of an instance newest first as returned by List.
+func (r Retention) Expired(backups []Backup) []Backup {
+	if r.Daily <= 0 && r.Weekly <= 0 {
+		return nil
+	}
+
+	days := map[string]bool{}
+	weeks := map[string]bool{}
+	expired := []Backup{}
+
+	for _, backup := range backups {
+		completed := backup.CompletedAt.UTC()
+		day := completed.Format("2006-01-02")
+		year, number := completed.ISOWeek()
+		week := strconv.Itoa(year) + "-" + strconv.Itoa(number)
+
+		keep := false
+		if !days[day] && len(days) < r.Daily {
+			days[day] = true
+			keep = true
+		}
+		if !weeks[week] && len(weeks) < r.Weekly {
+			weeks[week] = true
+			keep = true
+		}
+
+		if !keep {
+			expired = append(expired, backup)
+		}
+	}
+
+	return expired
+}
+
+// ApplyRetention deletes the backups of an instance the retention no longer
+// selects and returns them.
+func (m *Manager) ApplyRetention(instanceID string,
+	retention Retention) ([]Backup, error) {
+
+	backups, err := m.List(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := []Backup{}
+	for _, backup := range retention.Expired(backups) {
+		if err = m.Delete(backup); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, backup)
+	}
+
+	return deleted, nil
+}
+
+// Delete removes a backup. The metadata goes first so a failure never leaves
+// a backup without its archive.
+func (m *Manager) Delete(backup Backup) error {
+	if err := m.storage.Delete(metadataKey(backup)); err != nil {
+		return err
+	}
+
+	return m.storage.Delete(archiveKey(backup))
+}
+
+// RecordVerification stores the outcome of a verification restore in the
+// metadata of a backup.
+func (m *Manager) RecordVerification(backup Backup,
+	verification Verification) (Backup, error) {
+
+	// The metadata is read again in case the data key was re-wrapped
+	var current Backup
+	if err := m.getJSON(metadataKey(backup), &current); err != nil {
+		return Backup{}, err
+	}
+
+	current.Verification = &verification
+	if err := m.putJSON(metadataKey(current), current); err != nil {
+		return Backup{}, err
+	}
+
+	return current, nil
+}
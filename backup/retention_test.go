@@ -0,0 +1,168 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package backup
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// backupsAt returns backups completed at the given times, named after them.
+func backupsAt(t *testing.T, times ...string) []Backup {
+	backups := []Backup{}
+	for _, value := range times {
+		completed, err := time.Parse("2006-01-02 15:04", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backups = append(backups, Backup{ID: value, CompletedAt: completed})
+	}
+	return backups
+}
+
+func TestRetentionExpired(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention Retention
+		backups   []string
+		expired   []string
+	}{
+		{
+			name:      "zero retention",
+			retention: Retention{},
+			backups:   []string{"2021-01-05 02:00", "2021-01-04 02:00"},
+		},
+		{
+			name:      "newest of each day",
+			retention: Retention{Daily: 2},
+			backups: []string{"2021-01-05 10:00", "2021-01-05 02:00",
+				"2021-01-04 02:00", "2021-01-03 02:00"},
+			expired: []string{"2021-01-05 02:00", "2021-01-03 02:00"},
+		},
+		{
+			name:      "days without backup are not counted",
+			retention: Retention{Daily: 2},
+			backups:   []string{"2021-01-10 02:00", "2021-01-01 02:00"},
+			expired:   []string{},
+		},
+		{
+			// 2020-12-28 to 2021-01-03 is week 53 of 2020
+			name:      "ISO week across the new year",
+			retention: Retention{Weekly: 2},
+			backups: []string{"2021-01-04 02:00", "2021-01-03 02:00",
+				"2020-12-28 02:00", "2020-12-27 02:00"},
+			expired: []string{"2020-12-28 02:00", "2020-12-27 02:00"},
+		},
+		{
+			name:      "ISO week starting on Monday",
+			retention: Retention{Weekly: 1},
+			backups:   []string{"2021-01-11 00:00", "2021-01-10 23:59"},
+			expired:   []string{"2021-01-10 23:59"},
+		},
+		{
+			// The daily backups also claim their week
+			name:      "daily and weekly overlap",
+			retention: Retention{Daily: 2, Weekly: 2},
+			backups: []string{"2021-01-05 02:00", "2021-01-04 02:00",
+				"2021-01-03 02:00", "2021-01-02 02:00"},
+			expired: []string{"2021-01-02 02:00"},
+		},
+		{
+			name:      "weekly reaches past the daily",
+			retention: Retention{Daily: 1, Weekly: 3},
+			backups: []string{"2021-01-20 02:00", "2021-01-19 02:00",
+				"2021-01-12 02:00", "2021-01-05 02:00", "2020-12-29 02:00"},
+			expired: []string{"2021-01-19 02:00", "2020-12-29 02:00"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expired := test.retention.Expired(backupsAt(t, test.backups...))
+
+			var ids []string
+			if expired != nil {
+				ids = []string{}
+			}
+			for _, backup := range expired {
+				ids = append(ids, backup.ID)
+			}
+
+			if !reflect.DeepEqual(ids, test.expired) {
+				t.Errorf("expired %v, want %v", ids, test.expired)
+			}
+		})
+	}
+}
+
+func TestBackupCheckRestored(t *testing.T) {
+	tests := []struct {
+		name     string
+		counted  map[string]int64
+		restored map[string]int64
+		passed   bool
+	}{
+		{
+			name:     "same collections",
+			counted:  map[string]int64{"app.users": 10, "app.empty": 0},
+			restored: map[string]int64{"app.users": 10, "app.empty": 0},
+			passed:   true,
+		},
+		{
+			name:     "written during the dump",
+			counted:  map[string]int64{"app.users": 10},
+			restored: map[string]int64{"app.users": 12, "app.new": 1},
+			passed:   true,
+		},
+		{
+			name:     "missing collection",
+			counted:  map[string]int64{"app.users": 10, "app.orders": 3},
+			restored: map[string]int64{"app.users": 10},
+		},
+		{
+			name:     "emptied collection",
+			counted:  map[string]int64{"app.users": 10},
+			restored: map[string]int64{"app.users": 0},
+		},
+		{
+			name:     "empty database",
+			counted:  map[string]int64{},
+			restored: map[string]int64{},
+			passed:   true,
+		},
+		{
+			name:     "without counts",
+			restored: map[string]int64{"app.users": 10},
+			passed:   true,
+		},
+		{
+			name:     "without counts nor restored collections",
+			restored: map[string]int64{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Backup{Collections: test.counted}.CheckRestored(
+				test.restored)
+			if (err == nil) != test.passed {
+				t.Errorf("error %v, want passed %t", err, test.passed)
+			}
+		})
+	}
+}
@@ -0,0 +1,665 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package backup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5" // nolint: gas
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MinPartSize is the smallest multipart upload part accepted by S3.
+	MinPartSize = 5 * 1024 * 1024
+	// DefaultPartSize is the part size used when none is configured.
+	DefaultPartSize = 16 * 1024 * 1024
+
+	s3RequestTimeout = 10 * time.Minute
+	s3Service        = "s3"
+	s3Algorithm      = "AWS4-HMAC-SHA256"
+	s3DateFormat     = "20060102T150405Z"
+
+	// Server-side encryption modes.
+	SSEAES256 = "AES256"
+	SSEKMS    = "aws:kms"
+
+	// lifecycleRuleID names the rule of the broker in the lifecycle
+	// configuration, legacyRuleID the expiring rule it used to install.
+	lifecycleRuleID = "cf-nosql-broker-incomplete-uploads"
+	legacyRuleID    = "cf-nosql-broker-retention"
+
+	errorSSEMode  = "the server-side encryption must be AES256 or aws:kms"
+	errorPartSize = "the part size must be at least 5 MiB"
+)
+
+// S3Config locates a bucket of an S3 compatible object storage, such as
+// AWS S3 or MinIO.
+type S3Config struct {
+	// Endpoint is the base URL of the service, such as
+	// https://s3.eu-west-1.amazonaws.com or http://localhost:9000.
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// Prefix is prepended to every key, to share a bucket.
+	Prefix string
+	// PathStyle addresses the bucket in the path instead of the hostname,
+	// as MinIO expects.
+	PathStyle bool
+	// ServerSideEncryption asks the storage to encrypt the objects, with
+	// SSEAES256 or SSEKMS. KMSKeyID selects the key of SSEKMS.
+	ServerSideEncryption string
+	KMSKeyID             string
+	// PartSize is the size of the multipart upload parts.
+	PartSize int
+	// IncompleteUploadDays aborts the multipart uploads left incomplete,
+	// such as by a restart, after this many days through a bucket lifecycle
+	// rule. 0 leaves the lifecycle configuration alone.
+	IncompleteUploadDays int
+}
+
+// S3Storage keeps the backups in an S3 bucket, signing its requests with
+// signature version 4.
+type S3Storage struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3Storage validates the configuration and, when IncompleteUploadDays is
+// set, installs the lifecycle rule aborting the incomplete uploads.
+func NewS3Storage(config S3Config) (*S3Storage, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoint.Scheme == "" || endpoint.Host == "" || config.Bucket == "" ||
+		config.Region == "" {
+		return nil, errors.New("[s3] the endpoint, region and bucket are " +
+			"required")
+	}
+
+	switch config.ServerSideEncryption {
+	case "", SSEAES256, SSEKMS:
+	default:
+		return nil, errors.New("[s3] " + errorSSEMode)
+	}
+
+	if config.PartSize == 0 {
+		config.PartSize = DefaultPartSize
+	}
+	if config.PartSize < MinPartSize {
+		return nil, errors.New("[s3] " + errorPartSize)
+	}
+
+	if config.Prefix != "" {
+		config.Prefix = strings.Trim(config.Prefix, "/") + "/"
+	}
+
+	storage := &S3Storage{
+		config:   config,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: s3RequestTimeout},
+	}
+
+	if config.IncompleteUploadDays > 0 {
+		if err = storage.configureLifecycle(); err != nil {
+			return nil, err
+		}
+	}
+
+	return storage, nil
+}
+
+// Put uploads the object in a single request when it fits in one part and
+// through a multipart upload otherwise.
+func (s *S3Storage) Put(key string, r io.Reader) error {
+	part := make([]byte, s.config.PartSize)
+	n, err := io.ReadFull(r, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err = s.do("PUT", key, nil, s.encryptionHeaders(), part[:n])
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	uploadID, err := s.createMultipartUpload(key)
+	if err != nil {
+		return err
+	}
+
+	parts := []s3Part{}
+	for number := 1; n > 0; number++ {
+		query := url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {uploadID},
+		}
+
+		var header http.Header
+		header, err = s.do("PUT", key, query, nil, part[:n])
+		if err != nil {
+			break
+		}
+		parts = append(parts, s3Part{Number: number, ETag: header.Get("ETag")})
+
+		n, err = io.ReadFull(r, part)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = s.completeMultipartUpload(key, uploadID, parts)
+	}
+	if err != nil {
+		// The parts already uploaded are billed until the upload is aborted
+		s.do("DELETE", key, url.Values{"uploadId": {uploadID}}, nil, nil) // nolint: errcheck
+	}
+
+	return err
+}
+
+// Get downloads an object.
+func (s *S3Storage) Get(key string) (io.ReadCloser, error) {
+	request, err := s.request("GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, errors.New("[s3] GET error: " + err.Error())
+	}
+
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close() // nolint: errcheck
+		return nil, s3Error("GET", response)
+	}
+
+	return response.Body, nil
+}
+
+// Delete removes an object.
+func (s *S3Storage) Delete(key string) error {
+	_, err := s.do("DELETE", key, nil, nil, nil)
+	return err
+}
+
+// List pages through ListObjectsV2.
+func (s *S3Storage) List(prefix string) ([]string, error) {
+	keys := []string{}
+	token := ""
+
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.config.Prefix + prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		request, err := s.request("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err = s.send(request, &result); err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(object.Key, s.config.Prefix))
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Location returns the s3 URL of an object.
+func (s *S3Storage) Location(key string) string {
+	return "s3://" + s.config.Bucket + "/" + s.config.Prefix + key
+}
+
+// s3Part is a completed part of a multipart upload.
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+// createMultipartUpload starts a multipart upload and returns its ID.
+func (s *S3Storage) createMultipartUpload(key string) (string, error) {
+	request, err := s.request("POST", key, url.Values{"uploads": {""}},
+		s.encryptionHeaders(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err = s.send(request, &result); err != nil {
+		return "", err
+	}
+
+	return result.UploadID, nil
+}
+
+// completeMultipartUpload assembles the uploaded parts into the object.
+func (s *S3Storage) completeMultipartUpload(key, uploadID string,
+	parts []s3Part) error {
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	request, err := s.request("POST", key, url.Values{"uploadId": {uploadID}},
+		nil, body)
+	if err != nil {
+		return err
+	}
+
+	// The request may fail after a 200 status, reported in the body
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if err = s.send(request, &result); err != nil {
+		return err
+	}
+
+	if result.XMLName.Local == "Error" {
+		return errors.New("[s3] POST error: " + result.Code + ": " +
+			result.Message)
+	}
+
+	return nil
+}
+
+// lifecycleRule is the rule the broker keeps in the lifecycle configuration
+// of the bucket. It only aborts the incomplete multipart uploads: the broker
+// prunes the archives itself, and expiring them by age would break the oplog
+// chains of the point-in-time restores.
+type lifecycleRule struct {
+	XMLName xml.Name `xml:"Rule"`
+	ID      string   `xml:"ID"`
+	Prefix  string   `xml:"Filter>Prefix"`
+	Status  string   `xml:"Status"`
+	Abort   struct {
+		DaysAfterInitiation int `xml:"DaysAfterInitiation"`
+	} `xml:"AbortIncompleteMultipartUpload"`
+}
+
+// storedRule is a rule of the lifecycle configuration of the bucket, kept as
+// it was read.
+type storedRule struct {
+	XMLName xml.Name `xml:"Rule"`
+	Content string   `xml:",innerxml"`
+}
+
+// configureLifecycle merges the broker rule into the lifecycle configuration
+// of the bucket, leaving the other rules alone.
+func (s *S3Storage) configureLifecycle() error {
+	rules, err := s.lifecycleRules()
+	if err != nil {
+		return err
+	}
+
+	broker := lifecycleRule{
+		ID:     lifecycleRuleID,
+		Prefix: s.config.Prefix,
+		Status: "Enabled",
+	}
+	broker.Abort.DaysAfterInitiation = s.config.IncompleteUploadDays
+
+	merged := []interface{}{broker}
+	for _, rule := range rules {
+		var decoded struct {
+			ID string `xml:"ID"`
+		}
+		content := "<Rule>" + rule.Content + "</Rule>"
+		if err = xml.Unmarshal([]byte(content), &decoded); err != nil {
+			return errors.New("[s3] GET error: " + err.Error())
+		}
+
+		// Replace the rules of the broker, including the expiring rule of
+		// the former versions
+		if decoded.ID == lifecycleRuleID || decoded.ID == legacyRuleID {
+			continue
+		}
+		merged = append(merged, rule)
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name      `xml:"LifecycleConfiguration"`
+		Rules   []interface{} `xml:"Rule"`
+	}{Rules: merged})
+	if err != nil {
+		return err
+	}
+
+	// S3 requires the checksum of the lifecycle configuration
+	checksum := md5.Sum(body) // nolint: gas
+	header := http.Header{}
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(checksum[:]))
+
+	request, err := s.request("PUT", "", url.Values{"lifecycle": {""}}, header,
+		body)
+	if err != nil {
+		return err
+	}
+
+	return s.send(request, nil)
+}
+
+// lifecycleRules reads the rules of the lifecycle configuration of the
+// bucket, none when it has no configuration.
+func (s *S3Storage) lifecycleRules() ([]storedRule, error) {
+	request, err := s.request("GET", "", url.Values{"lifecycle": {""}}, nil,
+		nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, errors.New("[s3] GET error: " + err.Error())
+	}
+	defer response.Body.Close() // nolint: errcheck
+
+	// The storage answers 404 NoSuchLifecycleConfiguration to a bucket
+	// without rules
+	if response.StatusCode == http.StatusNotFound {
+		io.Copy(ioutil.Discard, response.Body) // nolint: errcheck
+		return nil, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, s3Error("GET", response)
+	}
+
+	var configuration struct {
+		Rules []storedRule `xml:"Rule"`
+	}
+	if err = xml.NewDecoder(response.Body).Decode(&configuration); err != nil {
+		return nil, errors.New("[s3] GET error: " + err.Error())
+	}
+
+	return configuration.Rules, nil
+}
+
+// encryptionHeaders returns the server-side encryption headers set when an
+// object is created.
+func (s *S3Storage) encryptionHeaders() http.Header {
+	header := http.Header{}
+	if s.config.ServerSideEncryption == "" {
+		return header
+	}
+
+	header.Set("X-Amz-Server-Side-Encryption", s.config.ServerSideEncryption)
+	if s.config.ServerSideEncryption == SSEKMS && s.config.KMSKeyID != "" {
+		header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+			s.config.KMSKeyID)
+	}
+
+	return header
+}
+
+// do sends a request whose response body is not needed and returns the
+// response headers.
+func (s *S3Storage) do(method, key string, query url.Values,
+	header http.Header, body []byte) (http.Header, error) {
+
+	request, err := s.request(method, key, query, header, body)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, errors.New("[s3] " + method + " error: " + err.Error())
+	}
+	defer response.Body.Close() // nolint: errcheck
+
+	if response.StatusCode/100 != 2 {
+		return nil, s3Error(method, response)
+	}
+
+	io.Copy(ioutil.Discard, response.Body) // nolint: errcheck
+	return response.Header, nil
+}
+
+// send sends a request and decodes its XML response into result, when not
+// nil.
+func (s *S3Storage) send(request *http.Request, result interface{}) error {
+	response, err := s.client.Do(request)
+	if err != nil {
+		return errors.New("[s3] " + request.Method + " error: " + err.Error())
+	}
+	defer response.Body.Close() // nolint: errcheck
+
+	if response.StatusCode/100 != 2 {
+		return s3Error(request.Method, response)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	if err = xml.NewDecoder(response.Body).Decode(result); err != nil {
+		return errors.New("[s3] " + request.Method + " error: " + err.Error())
+	}
+
+	return nil
+}
+
+// request builds a signed request on an object, or on the bucket when key is
+// empty.
+func (s *S3Storage) request(method, key string, query url.Values,
+	header http.Header, body []byte) (*http.Request, error) {
+
+	target := *s.endpoint
+	path := ""
+	if s.config.PathStyle {
+		path = "/" + s.config.Bucket
+	} else {
+		target.Host = s.config.Bucket + "." + target.Host
+	}
+	if key != "" {
+		path += "/" + s.config.Prefix + key
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	target.Path = s.endpoint.Path + path
+	target.RawPath = uriEncode(target.Path, false)
+	target.RawQuery = canonicalQuery(query)
+
+	request, err := http.NewRequest(method, target.String(),
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range header {
+		request.Header[name] = values
+	}
+
+	signV4(request, body, s.config.Region, s.config.AccessKeyID,
+		s.config.SecretAccessKey, time.Now().UTC())
+
+	return request, nil
+}
+
+// s3Error reads the error document returned by the storage.
+func s3Error(method string, response *http.Response) error {
+	var document struct {
+		Code    string
+		Message string
+	}
+
+	content, _ := ioutil.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if xml.Unmarshal(content, &document) != nil || document.Code == "" {
+		return errors.New("[s3] " + method + " error: " + response.Status)
+	}
+
+	return errors.New("[s3] " + method + " error: " + document.Code + ": " +
+		document.Message)
+}
+
+// signV4 adds the signature version 4 headers to a request.
+func signV4(request *http.Request, body []byte, region, accessKeyID,
+	secretAccessKey string, now time.Time) {
+
+	payloadHash := sha256.Sum256(body)
+	request.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	request.Header.Set("X-Amz-Date", now.Format(s3DateFormat))
+
+	// The host, content and amz headers are signed
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-md5" || lower == "content-type" ||
+			strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	date := now.Format("20060102")
+	scope := date + "/" + region + "/" + s3Service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := s3Algorithm + "\n" + now.Format(s3DateFormat) + "\n" +
+		scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", s3Algorithm+" Credential="+
+		accessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
+
+// canonicalQuery encodes the query parameters sorted by name, as signed.
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := []string{}
+	for _, name := range names {
+		values := append([]string{}, query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, uriEncode(name, true)+"="+
+				uriEncode(value, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything but the unreserved characters, and
+// the slashes unless encodeSlash is set.
+func uriEncode(value string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	var encoded strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			encoded.WriteByte(c)
+		default:
+			encoded.WriteByte('%')
+			encoded.WriteByte(hexDigits[c>>4])
+			encoded.WriteByte(hexDigits[c&15])
+		}
+	}
+
+	return encoded.String()
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data)) // nolint: errcheck
+	return mac.Sum(nil)
+}
@@ -0,0 +1,271 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package backup
+
+import (
+	"bytes"
+	"crypto/md5" // nolint: gas
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// foreignRule is a lifecycle rule installed by someone else, with elements
+// the broker does not know about.
+const foreignRule = `<Rule><ID>archive-logs</ID><Filter><And>` +
+	`<Prefix>logs/</Prefix><Tag><Key>kind</Key><Value>audit</Value></Tag>` +
+	`</And></Filter><Status>Enabled</Status><Transition><Days>30</Days>` +
+	`<StorageClass>GLACIER</StorageClass></Transition></Rule>`
+
+// newLifecycleServer starts a fake bucket answering the lifecycle requests
+// with the given configuration, an empty one for a 404, and returns the
+// configuration written back.
+func newLifecycleServer(t *testing.T, existing string) (S3Config, *[]byte) {
+	written := []byte(nil)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := r.URL.Query()["lifecycle"]; !ok ||
+				r.URL.Path != "/bucket" {
+				t.Errorf("unexpected request %s %s", r.Method, r.URL)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if !strings.HasPrefix(r.Header.Get("Authorization"), s3Algorithm) {
+				t.Errorf("%s %s is not signed", r.Method, r.URL)
+			}
+
+			switch r.Method {
+			case "GET":
+				if existing == "" {
+					w.WriteHeader(http.StatusNotFound)
+					w.Write([]byte("<Error><Code>NoSuchLifecycleConfiguration" + // nolint: errcheck
+						"</Code></Error>"))
+					return
+				}
+				w.Write([]byte(existing)) // nolint: errcheck
+			case "PUT":
+				body, _ := ioutil.ReadAll(r.Body)
+				checksum := md5.Sum(body) // nolint: gas
+				if r.Header.Get("Content-MD5") !=
+					base64.StdEncoding.EncodeToString(checksum[:]) {
+					t.Error("the Content-MD5 header does not match the body")
+				}
+				written = body
+			default:
+				t.Errorf("unexpected method %s", r.Method)
+			}
+		}))
+	t.Cleanup(server.Close)
+
+	return S3Config{
+		Endpoint:             server.URL,
+		Region:               "us-east-1",
+		Bucket:               "bucket",
+		AccessKeyID:          "access",
+		SecretAccessKey:      "secret",
+		Prefix:               "brokers/one",
+		PathStyle:            true,
+		IncompleteUploadDays: 2,
+	}, &written
+}
+
+// writtenRules decodes the IDs and the content of the rules written back.
+func writtenRules(t *testing.T, body []byte) map[string]string {
+	var configuration struct {
+		XMLName xml.Name `xml:"LifecycleConfiguration"`
+		Rules   []struct {
+			ID      string `xml:"ID"`
+			Content string `xml:",innerxml"`
+		} `xml:"Rule"`
+	}
+	if err := xml.Unmarshal(body, &configuration); err != nil {
+		t.Fatalf("invalid lifecycle configuration %q: %v", body, err)
+	}
+
+	rules := map[string]string{}
+	for _, rule := range configuration.Rules {
+		rules[rule.ID] = rule.Content
+	}
+	return rules
+}
+
+func TestConfigureLifecycle(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		foreign  bool
+	}{
+		{name: "without configuration"},
+		{
+			name: "merged",
+			existing: `<?xml version="1.0" encoding="UTF-8"?>` +
+				`<LifecycleConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/">` +
+				foreignRule +
+				`<Rule><ID>cf-nosql-broker-retention</ID><Filter><Prefix>brokers/one/` +
+				`</Prefix></Filter><Status>Enabled</Status><Expiration><Days>7</Days>` +
+				`</Expiration></Rule>` +
+				`<Rule><ID>cf-nosql-broker-incomplete-uploads</ID><Filter><Prefix>` +
+				`</Prefix></Filter><Status>Enabled</Status>` +
+				`<AbortIncompleteMultipartUpload><DaysAfterInitiation>9` +
+				`</DaysAfterInitiation></AbortIncompleteMultipartUpload></Rule>` +
+				`</LifecycleConfiguration>`,
+			foreign: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, written := newLifecycleServer(t, test.existing)
+			if _, err := NewS3Storage(config); err != nil {
+				t.Fatal(err)
+			}
+
+			rules := writtenRules(t, *written)
+			if _, ok := rules[legacyRuleID]; ok {
+				t.Error("the expiring rule of the broker was kept")
+			}
+
+			broker, ok := rules[lifecycleRuleID]
+			if !ok {
+				t.Fatalf("the broker rule is missing from %s", *written)
+			}
+			want := "<Prefix>brokers/one/</Prefix>"
+			if !strings.Contains(broker, want) ||
+				!strings.Contains(broker, "<DaysAfterInitiation>2<") {
+				t.Errorf("broker rule %s, want the prefix and 2 days", broker)
+			}
+			if strings.Contains(broker, "Expiration") {
+				t.Errorf("broker rule %s expires the archives", broker)
+			}
+
+			foreign, ok := rules["archive-logs"]
+			if ok != test.foreign {
+				t.Fatalf("foreign rule kept: %t, want %t", ok, test.foreign)
+			}
+			if ok && "<Rule>"+foreign+"</Rule>" != foreignRule {
+				t.Errorf("foreign rule %s, want %s", foreign, foreignRule)
+			}
+			if ok && len(rules) != 2 || !ok && len(rules) != 1 {
+				t.Errorf("%d rules written in %s", len(rules), *written)
+			}
+		})
+	}
+}
+
+func TestConfigureLifecycleUnset(t *testing.T) {
+	config, written := newLifecycleServer(t, "")
+	config.IncompleteUploadDays = 0
+
+	if _, err := NewS3Storage(config); err != nil {
+		t.Fatal(err)
+	}
+	if *written != nil {
+		t.Errorf("the lifecycle configuration was written: %s", *written)
+	}
+}
+
+// TestS3StorageMinIO runs the storage against a real bucket, such as a local
+// MinIO, when CF_NOSQL_BROKER_TEST_S3_ENDPOINT, _BUCKET, _ACCESS_KEY_ID and
+// _SECRET_ACCESS_KEY are set. The bucket must exist.
+func TestS3StorageMinIO(t *testing.T) {
+	endpoint := os.Getenv("CF_NOSQL_BROKER_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("CF_NOSQL_BROKER_TEST_S3_ENDPOINT is not set")
+	}
+
+	config := S3Config{
+		Endpoint:             endpoint,
+		Region:               "us-east-1",
+		Bucket:               os.Getenv("CF_NOSQL_BROKER_TEST_S3_BUCKET"),
+		AccessKeyID:          os.Getenv("CF_NOSQL_BROKER_TEST_S3_ACCESS_KEY_ID"),
+		SecretAccessKey:      os.Getenv("CF_NOSQL_BROKER_TEST_S3_SECRET_ACCESS_KEY"),
+		Prefix:               "test-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+		PathStyle:            true,
+		PartSize:             MinPartSize,
+		IncompleteUploadDays: 1,
+	}
+
+	// Installing the rule twice keeps a single copy of it
+	storage, err := NewS3Storage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.configureLifecycle(); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := storage.lifecycleRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, rule := range rules {
+		if strings.Contains(rule.Content, lifecycleRuleID) {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("%d broker rules in the bucket, want 1", count)
+	}
+
+	objects := map[string][]byte{
+		"instance/small.archive": []byte("small archive"),
+		// Spans three parts of a multipart upload
+		"instance/large.archive": bytes.Repeat([]byte("0123456789abcdef"),
+			(2*MinPartSize+1024)/16),
+	}
+	for key, content := range objects {
+		if err = storage.Put(key, bytes.NewReader(content)); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+		defer storage.Delete(key) // nolint: errcheck
+	}
+
+	keys, err := storage.List("instance/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "instance/large.archive,instance/small.archive" {
+		t.Errorf("listed %v", keys)
+	}
+
+	for key, content := range objects {
+		file, err := storage.Get(key)
+		if err != nil {
+			t.Fatalf("get %s: %v", key, err)
+		}
+		read, err := ioutil.ReadAll(file)
+		file.Close() // nolint: errcheck
+		if err != nil || !bytes.Equal(read, content) {
+			t.Errorf("get %s: read %d bytes, want %d: %v", key, len(read),
+				len(content), err)
+		}
+	}
+
+	if err = storage.Delete("instance/small.archive"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err = storage.List("instance/"); err != nil || len(keys) != 1 {
+		t.Errorf("listed %v after the delete: %v", keys, err)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package backup
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const errorScheduleFields = "a schedule needs 5 fields: " +
+	"minute hour day-of-month month day-of-week"
+
+// Schedule is a parsed cron expression with the standard five fields.
+type Schedule struct {
+	minutes     fieldSet
+	hours       fieldSet
+	daysOfMonth fieldSet
+	months      fieldSet
+	daysOfWeek  fieldSet
+	// A restricted day of month and day of week match if either does, as
+	// in cron.
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+type fieldSet map[int]bool
+
+// ParseSchedule parses a cron expression such as "30 2 * * *". Each field
+// accepts *, values, ranges (1-5), lists (1,3) and steps (*/15 or 0-30/10).
+// The day of week goes from 0 to 7, both Sunday.
+func ParseSchedule(expression string) (*Schedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, errors.New(errorScheduleFields)
+	}
+
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := make([]fieldSet, 5)
+	for i, field := range fields {
+		set, err := parseField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, errors.New("schedule field " + strconv.Itoa(i+1) +
+				" \"" + field + "\": " + err.Error())
+		}
+		sets[i] = set
+	}
+
+	// Sunday is either 0 or 7, as in cron
+	if sets[4][7] {
+		delete(sets[4], 7)
+		sets[4][0] = true
+	}
+
+	return &Schedule{
+		minutes:       sets[0],
+		hours:         sets[1],
+		daysOfMonth:   sets[2],
+		months:        sets[3],
+		daysOfWeek:    sets[4],
+		anyDayOfMonth: fields[2] == "*",
+		anyDayOfWeek:  fields[4] == "*",
+	}, nil
+}
+
+// Matches reports whether the schedule fires at the minute of t.
+func (s *Schedule) Matches(t time.Time) bool {
+	if !s.minutes[t.Minute()] || !s.hours[t.Hour()] || !s.months[int(t.Month())] {
+		return false
+	}
+
+	dayOfMonth := s.daysOfMonth[t.Day()]
+	dayOfWeek := s.daysOfWeek[int(t.Weekday())]
+
+	switch {
+	case s.anyDayOfMonth && s.anyDayOfWeek:
+		return true
+	case s.anyDayOfMonth:
+		return dayOfWeek
+	case s.anyDayOfWeek:
+		return dayOfMonth
+	default:
+		return dayOfMonth || dayOfWeek
+	}
+}
+
+// parseField expands a single cron field into the set of values it matches.
+func parseField(field string, min, max int) (fieldSet, error) {
+	set := fieldSet{}
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return nil, errors.New("invalid step")
+			}
+			part = part[:i]
+		}
+
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			var err error
+			low, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, errors.New("invalid value")
+			}
+
+			high = low
+			if len(bounds) == 2 {
+				high, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, errors.New("invalid value")
+				}
+			} else if step > 1 {
+				high = max
+			}
+		}
+
+		if low < min || high > max || low > high {
+			return nil, errors.New("value out of range " + strconv.Itoa(min) +
+				"-" + strconv.Itoa(max))
+		}
+
+		for value := low; value <= high; value += step {
+			set[value] = true
+		}
+	}
+
+	return set, nil
+}
@@ -0,0 +1,89 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package backup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, expression := range []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-b * * * *",
+	} {
+		if _, err := ParseSchedule(expression); err == nil {
+			t.Errorf("%q parsed without error", expression)
+		}
+	}
+}
+
+func TestScheduleMatches(t *testing.T) {
+	tests := []struct {
+		expression string
+		time       string
+		matches    bool
+	}{
+		{"30 2 * * *", "2021-01-03 02:30", true},
+		{"30 2 * * *", "2021-01-03 02:31", false},
+		{"*/15 * * * *", "2021-01-03 10:45", true},
+		{"*/15 * * * *", "2021-01-03 10:50", false},
+		{"0-30/10 * * * *", "2021-01-03 10:20", true},
+		{"0-30/10 * * * *", "2021-01-03 10:40", false},
+		{"10/20 * * * *", "2021-01-03 10:50", true},
+		{"0 0 * 2 *", "2021-02-01 00:00", true},
+		{"0 0 * 2 *", "2021-01-01 00:00", false},
+		// 2021-01-03 is a Sunday, 0 or 7
+		{"0 0 * * 0", "2021-01-03 00:00", true},
+		{"0 0 * * 7", "2021-01-03 00:00", true},
+		{"0 0 * * 7", "2021-01-04 00:00", false},
+		{"0 0 * * 5-7", "2021-01-02 00:00", true},
+		{"0 0 * * 5-7", "2020-12-31 00:00", false},
+		{"0 0 * * 1,7", "2021-01-03 00:00", true},
+		// A restricted day of month and day of week match if either does
+		{"0 0 1 * 1", "2021-01-01 00:00", true},
+		{"0 0 1 * 1", "2021-01-04 00:00", true},
+		{"0 0 1 * 1", "2021-01-05 00:00", false},
+		{"0 0 1 * *", "2021-01-04 00:00", false},
+	}
+
+	for _, test := range tests {
+		schedule, err := ParseSchedule(test.expression)
+		if err != nil {
+			t.Fatalf("%q: %v", test.expression, err)
+		}
+
+		at, err := time.Parse("2006-01-02 15:04", test.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if schedule.Matches(at) != test.matches {
+			t.Errorf("%q at %s: matches %t, want %t", test.expression,
+				test.time, !test.matches, test.matches)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package backup
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Storage keeps the archives and the metadata of the backups. Keys are
+// slash separated paths such as <instance>/<backup>.archive.
+type Storage interface {
+	// Put stores everything read from r under key, replacing any previous
+	// object. A failed Put leaves no partial object behind.
+	Put(key string, r io.Reader) error
+	// Get opens the object stored under key.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key.
+	Delete(key string) error
+	// List returns the keys starting with prefix, sorted.
+	List(prefix string) ([]string, error)
+	// Location describes where the object stored under key lives, recorded
+	// in the backup catalog.
+	Location(key string) string
+}
+
+// FileStorage keeps the backups in a local directory.
+type FileStorage struct {
+	dir string
+}
+
+// NewFileStorage returns a Storage writing under dir.
+func NewFileStorage(dir string) (*FileStorage, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &FileStorage{dir: dir}, nil
+}
+
+// Put writes the object under a temporary name and renames it once complete.
+func (s *FileStorage) Put(key string, r io.Reader) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name()) // nolint: errcheck
+	}
+
+	return err
+}
+
+// Get opens the file of an object.
+func (s *FileStorage) Get(key string) (io.ReadCloser, error) {
+	return os.Open(s.path(key))
+}
+
+// Delete removes the file of an object.
+func (s *FileStorage) Delete(key string) error {
+	return os.Remove(s.path(key))
+}
+
+// List walks the directory for the files matching prefix.
+func (s *FileStorage) List(prefix string) ([]string, error) {
+	keys := []string{}
+
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo,
+		err error) error {
+		if err != nil || info.IsDir() || strings.Contains(info.Name(), ".tmp") {
+			return err
+		}
+
+		key, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+
+		key = filepath.ToSlash(key)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Location returns the file URL of an object.
+func (s *FileStorage) Location(key string) string {
+	return "file://" + filepath.ToSlash(s.path(key))
+}
+
+// path maps a key inside the storage directory.
+func (s *FileStorage) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(filepath.Clean("/"+key)))
+}
@@ -0,0 +1,147 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/model"
+)
+
+const clientTimeout = 10 * time.Minute
+
+// adminClient calls the administration API of a running broker.
+type adminClient struct {
+	url                string
+	userName           string
+	password           string
+	caFile             string
+	insecureSkipVerify bool
+}
+
+// adminFlags registers the flags locating the administration API, which
+// default to the configuration of the broker.
+func adminFlags(flags *flag.FlagSet) *adminClient {
+	client := &adminClient{}
+
+	credentials := settings.Auth.Admin
+	if credentials.UserName == "" {
+		credentials = settings.Auth.Viewer
+	}
+
+	flags.StringVar(&client.url, "url", settings.Listen.URL,
+		"address of the broker")
+	flags.StringVar(&client.userName, "username", credentials.UserName,
+		"administration API user")
+	flags.StringVar(&client.password, "password", credentials.Password,
+		"administration API password")
+	flags.StringVar(&client.caFile, "ca-cert", "",
+		"PEM file of the authority signing the broker certificate")
+	flags.BoolVar(&client.insecureSkipVerify, "skip-ssl-validation", false,
+		"do not verify the broker certificate")
+
+	return client
+}
+
+// call sends a request to the administration API and decodes the JSON
+// response into result, when not nil. Error responses are returned with
+// their description.
+func (c *adminClient) call(method, path string, body,
+	result interface{}) error {
+
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequest(method,
+		strings.TrimSuffix(c.url, "/")+"/admin/v1"+path,
+		bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.SetBasicAuth(c.userName, c.password)
+	request.Header.Set("Content-Type", "application/json")
+
+	httpClient, err := c.httpClient()
+	if err != nil {
+		return err
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close() // nolint: errcheck
+
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode >= 300 {
+		var failure model.ErrorResponse
+		if json.Unmarshal(content, &failure) == nil &&
+			failure.Description != "" {
+			return errors.New(failure.Description)
+		}
+
+		return errors.New(method + " " + path + ": " + response.Status)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.Unmarshal(content, result)
+}
+
+// httpClient returns a client trusting the configured authority.
+func (c *adminClient) httpClient() (*http.Client, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: c.insecureSkipVerify, // nolint: gas
+	}
+
+	if c.caFile != "" {
+		pem, err := ioutil.ReadFile(c.caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New(c.caFile + ": no PEM certificate found")
+		}
+	}
+
+	return &http.Client{
+		Timeout:   clientTimeout,
+		Transport: &http.Transport{TLSClientConfig: config},
+	}, nil
+}
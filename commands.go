@@ -0,0 +1,585 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/backup"
+	"github.com/cloudfoundry-community/cf-nosql-broker/config"
+	server "github.com/cloudfoundry-community/cf-nosql-broker/endpoint"
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+	"github.com/cloudfoundry-community/cf-nosql-broker/security"
+	"github.com/cloudfoundry-community/cf-nosql-broker/state"
+)
+
+const errorUsage = "invalid arguments, see the usage above"
+
+// command is an operator subcommand of the broker binary.
+type command struct {
+	args        string
+	description string
+	run         func(flags *flag.FlagSet, args []string) error
+}
+
+// commands are the subcommands besides serve, by name.
+var commands = map[string]command{
+	"instances list": {"[-local]",
+		"List the service instances", listInstances},
+	"instances show": {"[-local] INSTANCE_ID",
+		"Show a service instance, its container and bindings", showInstance},
+	"instances delete": {"INSTANCE_ID",
+		"Force delete a stuck service instance", deleteInstance},
+	"bindings list": {"[-local] [-instance INSTANCE_ID]",
+		"List the service bindings", listBindings},
+	"backup create": {"INSTANCE_ID",
+		"Back up a service instance", createBackup},
+	"backup list": {"INSTANCE_ID",
+		"List the backups of a service instance", listBackups},
+	"backup restore": {"-backup BACKUP_ID | " +
+		"-timestamp TIME [-source INSTANCE_ID] INSTANCE_ID",
+		"Restore a backup into a service instance", restoreBackup},
+	"reconcile": {"[-resolve CONTAINER_NAME]",
+		"Compare the broker state with the containers", reconcile},
+	"check-certs": {"[-cert FILE] [-key FILE]",
+		"Check the broker key pair meets the cryptographic requirements",
+		checkCerts},
+	"catalog validate": {"",
+		"Validate the service catalog", validateCatalog},
+	"config print": {"[-config FILE] [serve flags]",
+		"Print the effective configuration, secrets masked", printConfig},
+}
+
+// settings is the configuration of the broker, read from the file named by
+// $CF_NOSQL_BROKER_CONFIG and the environment, which the commands take
+// their defaults from.
+var settings *config.Config
+
+// runCommand runs the subcommand named by the first arguments.
+func runCommand(args []string) error {
+	name := args[0]
+	if _, ok := commands[name]; !ok && len(args) > 1 {
+		name = args[0] + " " + args[1]
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		return errors.New("unknown command: " + strings.Join(args, " "))
+	}
+
+	var err error
+	if settings, err = config.Load(os.Getenv(config.EnvFile)); err != nil {
+		return err
+	}
+
+	// The output of the commands is for humans, the info entries are left
+	// out unless another level is asked for
+	level, err := logging.ParseLevel(settings.Logging.Level)
+	if err != nil {
+		return errors.New("logging.level: " + err.Error())
+	}
+	if level == logging.LevelInfo {
+		level = logging.LevelWarning
+	}
+	if err = logging.Configure(os.Stderr, settings.Logging.Format,
+		level); err != nil {
+		return errors.New("logging.format: " + err.Error())
+	}
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		printRow(os.Stderr, "Usage: "+os.Args[0]+" "+name+" "+cmd.args+"\n")
+		printRow(os.Stderr, cmd.description+".\n")
+		flags.PrintDefaults()
+	}
+
+	return cmd.run(flags, args[len(strings.Fields(name)):])
+}
+
+// usage lists the commands.
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	printRow(os.Stderr, "Usage: "+os.Args[0]+" [COMMAND]\n")
+	printRow(os.Stderr, "  serve\n        Start the service broker (default)")
+	for _, name := range names {
+		printRow(os.Stderr, "  "+name+" "+commands[name].args+"\n        "+
+			commands[name].description)
+	}
+}
+
+// parse parses the flags of a command and checks the number of remaining
+// arguments.
+func parse(flags *flag.FlagSet, args []string, count int) ([]string, error) {
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if flags.NArg() != count {
+		flags.Usage()
+		return nil, errors.New(errorUsage)
+	}
+
+	return flags.Args(), nil
+}
+
+// localFlags registers the flags reading the state store directly instead
+// of calling the administration API.
+func localFlags(flags *flag.FlagSet) (*bool, *string) {
+	return flags.Bool("local", false,
+			"read the state store instead of calling the broker"),
+		flags.String("state-dir", settings.State.Dir,
+			"directory of the state store")
+}
+
+// instanceSummary is the part of an instance listed by the commands.
+type instanceSummary struct {
+	ID             string `json:"id"`
+	PlanID         string `json:"plan_id"`
+	Plan           string `json:"plan"`
+	OrganizationID string `json:"organization_guid"`
+	SpaceID        string `json:"space_guid"`
+	HostPort       string `json:"host_port"`
+	Stopped        bool   `json:"stopped"`
+	State          string `json:"state"`
+	Health         string `json:"health"`
+}
+
+// bindingSummary is the part of a binding listed by the commands.
+type bindingSummary struct {
+	ID           string `json:"id"`
+	InstanceID   string `json:"instance_id"`
+	DatabaseName string `json:"database_name"`
+	UserName     string `json:"username"`
+	State        string `json:"state"`
+}
+
+func listInstances(flags *flag.FlagSet, args []string) error {
+	local, stateDir := localFlags(flags)
+	client := adminFlags(flags)
+	if _, err := parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	instances := []instanceSummary{}
+	if *local {
+		store, err := state.Open(*stateDir)
+		if err != nil {
+			return err
+		}
+
+		for _, instance := range store.Instances() {
+			instances = append(instances, instanceSummary{
+				ID:             instance.ID,
+				PlanID:         instance.PlanID,
+				OrganizationID: instance.OrganizationID,
+				SpaceID:        instance.SpaceID,
+				HostPort:       instance.HostPort,
+				Stopped:        instance.Stopped,
+				State:          instance.State,
+			})
+		}
+	} else if err := client.call("GET", "/instances", nil,
+		&instances); err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	printRow(out, "ID", "PLAN", "ORGANIZATION", "SPACE", "PORT", "STATUS")
+	for _, instance := range instances {
+		plan := instance.Plan
+		if plan == "" {
+			plan = instance.PlanID
+		}
+
+		printRow(out, instance.ID, plan, instance.OrganizationID,
+			instance.SpaceID, instance.HostPort, instanceStatus(instance))
+	}
+
+	return out.Flush()
+}
+
+// instanceStatus summarizes the state and health of an instance.
+func instanceStatus(instance instanceSummary) string {
+	switch {
+	case instance.State != "":
+		return instance.State
+	case instance.Stopped:
+		return "stopped"
+	case instance.Health != "":
+		return instance.Health
+	default:
+		return "-"
+	}
+}
+
+func showInstance(flags *flag.FlagSet, args []string) error {
+	local, stateDir := localFlags(flags)
+	client := adminFlags(flags)
+	args, err := parse(flags, args, 1)
+	if err != nil {
+		return err
+	}
+
+	if !*local {
+		var details json.RawMessage
+		if err = client.call("GET", "/instances/"+args[0], nil,
+			&details); err != nil {
+			return err
+		}
+
+		return printJSON(details)
+	}
+
+	store, err := state.Open(*stateDir)
+	if err != nil {
+		return err
+	}
+
+	instance, ok := store.Instance(args[0])
+	if !ok {
+		return errors.New("the service instance does not exist")
+	}
+
+	// The sealed credentials are of no use to the operators
+	instance.AdminPassword = ""
+	bindings := store.Bindings(instance.ID)
+	for i := range bindings {
+		bindings[i].Password = ""
+	}
+
+	return printJSON(struct {
+		state.Instance
+		BindingList  []state.Binding     `json:"binding_list"`
+		Operations   []state.Operation   `json:"operations"`
+		HealthEvents []state.HealthEvent `json:"health_events"`
+	}{instance, bindings, store.Operations(instance.ID),
+		store.HealthEvents(instance.ID)})
+}
+
+func deleteInstance(flags *flag.FlagSet, args []string) error {
+	client := adminFlags(flags)
+	args, err := parse(flags, args, 1)
+	if err != nil {
+		return err
+	}
+
+	if err = client.call("DELETE", "/instances/"+args[0], nil,
+		nil); err != nil {
+		return err
+	}
+
+	fmt.Println("Service instance " + args[0] + " deleted.")
+	return nil
+}
+
+func listBindings(flags *flag.FlagSet, args []string) error {
+	local, stateDir := localFlags(flags)
+	client := adminFlags(flags)
+	instanceID := flags.String("instance", "",
+		"only list the bindings of this instance")
+	if _, err := parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	bindings := []bindingSummary{}
+	if *local {
+		store, err := state.Open(*stateDir)
+		if err != nil {
+			return err
+		}
+
+		for _, instance := range store.Instances() {
+			if *instanceID != "" && instance.ID != *instanceID {
+				continue
+			}
+
+			for _, binding := range store.Bindings(instance.ID) {
+				bindings = append(bindings, bindingSummary{
+					ID:           binding.ID,
+					InstanceID:   binding.InstanceID,
+					DatabaseName: binding.DatabaseName,
+					UserName:     binding.UserName,
+					State:        binding.State,
+				})
+			}
+		}
+	} else if err := client.call("GET", "/bindings?instance_id="+
+		*instanceID, nil, &bindings); err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	printRow(out, "ID", "INSTANCE", "DATABASE", "USERNAME", "STATE")
+	for _, binding := range bindings {
+		if binding.State == "" {
+			binding.State = state.OperationSucceeded
+		}
+
+		printRow(out, binding.ID, binding.InstanceID, binding.DatabaseName,
+			binding.UserName, binding.State)
+	}
+
+	return out.Flush()
+}
+
+func createBackup(flags *flag.FlagSet, args []string) error {
+	client := adminFlags(flags)
+	args, err := parse(flags, args, 1)
+	if err != nil {
+		return err
+	}
+
+	var taken backup.Backup
+	if err = client.call("POST", "/instances/"+args[0]+"/backups", nil,
+		&taken); err != nil {
+		return err
+	}
+
+	fmt.Println("Backup " + taken.ID + " created, " +
+		strconv.FormatInt(taken.Size, 10) + " bytes.")
+	return nil
+}
+
+func listBackups(flags *flag.FlagSet, args []string) error {
+	client := adminFlags(flags)
+	args, err := parse(flags, args, 1)
+	if err != nil {
+		return err
+	}
+
+	var backups []backup.Backup
+	if err = client.call("GET", "/instances/"+args[0]+"/backups", nil,
+		&backups); err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	printRow(out, "ID", "COMPLETED", "TRIGGER", "SIZE", "VERIFIED")
+	for _, taken := range backups {
+		verified := "-"
+		if taken.Verification != nil {
+			verified = strconv.FormatBool(taken.Verification.Passed)
+		}
+
+		printRow(out, taken.ID, taken.CompletedAt.Format(time.RFC3339),
+			taken.Trigger, strconv.FormatInt(taken.Size, 10), verified)
+	}
+
+	return out.Flush()
+}
+
+func restoreBackup(flags *flag.FlagSet, args []string) error {
+	client := adminFlags(flags)
+	backupID := flags.String("backup", "", "ID of the backup to restore")
+	sourceID := flags.String("source", "",
+		"instance whose backups are restored with -timestamp, defaults to "+
+			"the restored instance")
+	timestamp := flags.String("timestamp", "",
+		"RFC 3339 time to restore the source instance to")
+	args, err := parse(flags, args, 1)
+	if err != nil {
+		return err
+	}
+
+	if (*backupID == "") == (*timestamp == "") {
+		flags.Usage()
+		return errors.New("either -backup or -timestamp is required")
+	}
+
+	source := map[string]string{}
+	if *backupID != "" {
+		source["backup_id"] = *backupID
+	} else {
+		source["timestamp"] = *timestamp
+		if *sourceID != "" {
+			source["instance_id"] = *sourceID
+		}
+	}
+
+	var applied map[string]string
+	if err = client.call("POST", "/instances/"+args[0]+"/restore", source,
+		&applied); err != nil {
+		return err
+	}
+
+	fmt.Println("Backup " + applied["backup_id"] + " restored into " +
+		args[0] + ".")
+	return nil
+}
+
+func reconcile(flags *flag.FlagSet, args []string) error {
+	client := adminFlags(flags)
+	resolve := flags.String("resolve", "",
+		"container whose drift is resolved, by removing the container or "+
+			"forgetting the record")
+	if _, err := parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	if *resolve != "" {
+		if err := client.call("DELETE", "/drift/"+*resolve, nil,
+			nil); err != nil {
+			return err
+		}
+
+		fmt.Println("Drift of " + *resolve + " resolved.")
+		return nil
+	}
+
+	var found []struct {
+		Kind          string `json:"kind"`
+		InstanceID    string `json:"instance_id"`
+		ContainerName string `json:"container_name"`
+		Description   string `json:"description"`
+	}
+	if err := client.call("GET", "/drift", nil, &found); err != nil {
+		return err
+	}
+
+	if len(found) == 0 {
+		fmt.Println("The broker state matches the containers.")
+		return nil
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	printRow(out, "CONTAINER", "INSTANCE", "KIND", "DESCRIPTION")
+	for _, d := range found {
+		printRow(out, d.ContainerName, d.InstanceID, d.Kind, d.Description)
+	}
+
+	return out.Flush()
+}
+
+func checkCerts(flags *flag.FlagSet, args []string) error {
+	certFile := flags.String("cert", settings.TLS.CertFile,
+		"PEM certificate file, defaults to the configured one")
+	keyFile := flags.String("key", settings.TLS.KeyFile,
+		"PEM private key file, defaults to the configured one")
+	if _, err := parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	if *certFile == "" || *keyFile == "" {
+		flags.Usage()
+		return errors.New("the certificate and key files are required")
+	}
+
+	cert, err := security.GetCertificateChain(*certFile, *keyFile)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	remaining := time.Until(leaf.NotAfter)
+	if remaining <= 0 {
+		return errors.New("the certificate expired on " +
+			leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	fmt.Printf("%s meets the cryptographic requirements.\n", *certFile)
+	fmt.Printf("Subject: %s\nKey: %s\nSignature: %s\nExpires: %s (%d days)\n",
+		leaf.Subject, leaf.PublicKeyAlgorithm, leaf.SignatureAlgorithm,
+		leaf.NotAfter.Format(time.RFC3339), int(remaining.Hours()/24))
+	return nil
+}
+
+func validateCatalog(flags *flag.FlagSet, args []string) error {
+	if _, err := parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	problems := append(server.ConfigurePlans(settings.Plans),
+		server.ValidateCatalog()...)
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, problem) // nolint: errcheck
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strconv.Itoa(len(problems)) +
+			" problems found in the catalog")
+	}
+
+	fmt.Println("The catalog is valid.")
+	return nil
+}
+
+func printConfig(flags *flag.FlagSet, args []string) error {
+	configFlags := config.RegisterFlags(flags)
+	if _, err := parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+
+	content, err := cfg.Masked().YAML()
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(content))
+
+	problems := cfg.Validate()
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, problem) // nolint: errcheck
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strconv.Itoa(len(problems)) +
+			" problems found in the configuration")
+	}
+
+	return nil
+}
+
+// printRow writes the tab separated columns of a table row.
+func printRow(out io.Writer, columns ...string) {
+	fmt.Fprintln(out, strings.Join(columns, "\t")) // nolint: errcheck
+}
+
+// printJSON writes a value to the standard output as indented JSON.
+func printJSON(value interface{}) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(content))
+	return nil
+}
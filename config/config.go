@@ -0,0 +1,350 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+// Package config loads the broker configuration from a YAML file, overlaid
+// by the CF_NOSQL_BROKER_* environment variables and then by the flags of
+// the command line.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// EnvFile is the environment variable naming the configuration file.
+const EnvFile = "CF_NOSQL_BROKER_CONFIG"
+
+// masked replaces the secrets printed by Masked.
+const masked = "********"
+
+// Config is the configuration of the broker.
+type Config struct {
+	Listen    Listen          `yaml:"listen"`
+	TLS       TLS             `yaml:"tls"`
+	Auth      Auth            `yaml:"auth"`
+	Runtime   Runtime         `yaml:"runtime"`
+	State     State           `yaml:"state"`
+	Authority Authority       `yaml:"authority"`
+	Backups   Backups         `yaml:"backups"`
+	Plans     map[string]Plan `yaml:"plans,omitempty"`
+	Logging   Logging         `yaml:"logging"`
+}
+
+// Listen configures the HTTPS listener of the broker.
+type Listen struct {
+	Port int `yaml:"port"`
+	// URL is the external address of the broker, used in the dashboard
+	// links. It defaults to the runtime hostname and the listen port.
+	URL string `yaml:"url"`
+	// ShutdownTimeout bounds the wait for the requests being served and the
+	// background tasks on SIGTERM.
+	ShutdownTimeout Duration `yaml:"shutdown_timeout"`
+}
+
+// TLS configures the key pair and the cipher suites of the listener.
+type TLS struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// CipherSuites are the names of the accepted suites, as spelled by the
+	// crypto/tls package, empty for the broker defaults.
+	CipherSuites []string `yaml:"cipher_suites,omitempty"`
+	// ReloadInterval is how often the key pair files are checked for a new
+	// version, 0 to only reload them on SIGHUP.
+	ReloadInterval Duration `yaml:"reload_interval"`
+}
+
+// Credentials are a user name and its password.
+type Credentials struct {
+	UserName string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// Auth configures the credentials of the service broker API, of the
+// administration API, of the metrics endpoint and of the dashboard.
+type Auth struct {
+	// Broker authenticates the platform on the service broker API, left
+	// open when empty.
+	Broker Credentials `yaml:"broker"`
+	// Admin has the operator role, Viewer the read-only one.
+	Admin   Credentials `yaml:"admin"`
+	Viewer  Credentials `yaml:"viewer"`
+	Metrics Credentials `yaml:"metrics"`
+	SSO     SSO         `yaml:"sso"`
+	// DashboardTTL is how long a dashboard link remains valid.
+	DashboardTTL Duration `yaml:"dashboard_ttl"`
+}
+
+// SSO configures the dashboard single sign-on through the platform UAA,
+// enabled when the client credentials are set.
+type SSO struct {
+	ClientID           string `yaml:"client_id"`
+	ClientSecret       string `yaml:"client_secret"`
+	CloudControllerURL string `yaml:"cloud_controller_url"`
+	SkipSSLValidation  bool   `yaml:"skip_ssl_validation"`
+}
+
+// Runtime configures the containers running the databases.
+type Runtime struct {
+	// Image is the Docker image of the MongoDB containers.
+	Image string `yaml:"image"`
+	// Hostname is the address applications use to reach the databases. It
+	// defaults to the host name of the machine.
+	Hostname string `yaml:"hostname"`
+	// Ports is the pool of host ports published by the containers.
+	Ports PortRange `yaml:"ports"`
+	// ReconcileInterval is how often the broker state is compared with the
+	// containers after startup, 0 to disable.
+	ReconcileInterval Duration `yaml:"reconcile_interval"`
+	// HealthInterval is how often the instances are probed, 0 to disable.
+	HealthInterval Duration `yaml:"health_interval"`
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	First int `yaml:"first"`
+	Last  int `yaml:"last"`
+}
+
+// State locates the files of the broker.
+type State struct {
+	// Dir keeps the instances, the secret key and the authority.
+	Dir string `yaml:"dir"`
+	// AuditLog defaults to audit.log in Dir.
+	AuditLog string `yaml:"audit_log"`
+}
+
+// Authority configures the certificate authority signing the server
+// certificates of the TLS enabled instances.
+type Authority struct {
+	KeyType  string   `yaml:"key_type"`
+	Validity Duration `yaml:"validity"`
+}
+
+// Backups configures where the backups are stored and how they are
+// encrypted.
+type Backups struct {
+	// Storage is local or s3.
+	Storage string `yaml:"storage"`
+	// Dir keeps the local backups, defaulting to backups in the state
+	// directory.
+	Dir string `yaml:"dir"`
+	// MasterKey wraps the data keys of the archives, base64 encoded. The
+	// previous keys are kept to read the archives not re-wrapped yet.
+	MasterKey          string   `yaml:"master_key"`
+	PreviousMasterKeys []string `yaml:"previous_master_keys,omitempty"`
+	// VerifyInterval is how often a recent backup is restored to verify
+	// it, 0 to disable.
+	VerifyInterval Duration `yaml:"verify_interval"`
+	S3             S3       `yaml:"s3"`
+}
+
+// S3 configures the backup storage in an S3 compatible bucket.
+type S3 struct {
+	Endpoint        string `yaml:"endpoint"`
+	Region          string `yaml:"region"`
+	Bucket          string `yaml:"bucket"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	Prefix          string `yaml:"prefix"`
+	PathStyle       bool   `yaml:"path_style"`
+	SSE             string `yaml:"sse"`
+	KMSKeyID        string `yaml:"sse_kms_key_id"`
+	// PartSize is the size of the multipart upload parts, 0 for the
+	// default.
+	PartSize int `yaml:"part_size"`
+	// IncompleteUploadDays aborts the incomplete multipart uploads through
+	// a bucket lifecycle rule, 0 for none.
+	IncompleteUploadDays int `yaml:"incomplete_upload_days"`
+}
+
+// Plan overrides the options of a catalog plan, by name. The options left
+// out keep the catalog defaults.
+type Plan struct {
+	// BackupSchedule is a cron expression, empty to disable the backups.
+	BackupSchedule *string   `yaml:"backup_schedule,omitempty"`
+	DailyBackups   *int      `yaml:"daily_backups,omitempty"`
+	WeeklyBackups  *int      `yaml:"weekly_backups,omitempty"`
+	OplogRetention *Duration `yaml:"oplog_retention,omitempty"`
+}
+
+// Logging configures the log entries.
+type Logging struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+// Duration is a time.Duration written like "30s" or "720h".
+type Duration time.Duration
+
+// MarshalYAML writes the duration as a string.
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// UnmarshalYAML parses a duration string.
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+// Default returns the configuration used when nothing is set.
+func Default() *Config {
+	return &Config{
+		Listen: Listen{
+			Port:            8080,
+			ShutdownTimeout: Duration(time.Minute),
+		},
+		TLS: TLS{
+			ReloadInterval: Duration(time.Minute),
+		},
+		Auth: Auth{
+			DashboardTTL: Duration(30 * 24 * time.Hour),
+		},
+		Runtime: Runtime{
+			Image:             "mongo",
+			Ports:             PortRange{First: 59000, Last: 59999},
+			ReconcileInterval: Duration(5 * time.Minute),
+			HealthInterval:    Duration(30 * time.Second),
+		},
+		State: State{Dir: "state"},
+		Authority: Authority{
+			KeyType:  "rsa",
+			Validity: Duration(30 * 24 * time.Hour),
+		},
+		Backups: Backups{
+			Storage:        "local",
+			VerifyInterval: Duration(24 * time.Hour),
+		},
+		Logging: Logging{Level: "info", Format: "json"},
+	}
+}
+
+// Load reads the configuration file, if path is not empty, over the
+// defaults and overlays the environment variables.
+func Load(path string) (*Config, error) {
+	c, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, c.complete()
+}
+
+// load reads the configuration file and the environment, leaving the
+// defaults derived from other settings unset.
+func load(path string) (*Config, error) {
+	c := Default()
+
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		// Unknown keys are most likely typos, better reported than ignored
+		if err = yaml.UnmarshalStrict(content, c); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	if err := c.overlayEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// complete sets the defaults derived from other settings.
+func (c *Config) complete() error {
+	if c.Runtime.Hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		c.Runtime.Hostname = hostname
+	}
+
+	if c.Listen.URL == "" {
+		c.Listen.URL = "https://" + net.JoinHostPort(c.Runtime.Hostname,
+			strconv.Itoa(c.Listen.Port))
+	}
+	c.Listen.URL = strings.TrimSuffix(c.Listen.URL, "/")
+
+	if c.State.AuditLog == "" {
+		c.State.AuditLog = filepath.Join(c.State.Dir, "audit.log")
+	}
+
+	if c.Backups.Dir == "" {
+		c.Backups.Dir = filepath.Join(c.State.Dir, "backups")
+	}
+
+	if c.Backups.S3.Region == "" {
+		c.Backups.S3.Region = "us-east-1"
+	}
+
+	return nil
+}
+
+// Masked returns a copy of the configuration whose secrets are replaced,
+// for display.
+func (c *Config) Masked() *Config {
+	copied := *c
+
+	mask := func(secret *string) {
+		if *secret != "" {
+			*secret = masked
+		}
+	}
+
+	mask(&copied.Auth.Broker.Password)
+	mask(&copied.Auth.Admin.Password)
+	mask(&copied.Auth.Viewer.Password)
+	mask(&copied.Auth.Metrics.Password)
+	mask(&copied.Auth.SSO.ClientSecret)
+	mask(&copied.Backups.MasterKey)
+	mask(&copied.Backups.S3.SecretAccessKey)
+
+	copied.Backups.PreviousMasterKeys = nil
+	for range c.Backups.PreviousMasterKeys {
+		copied.Backups.PreviousMasterKeys = append(
+			copied.Backups.PreviousMasterKeys, masked)
+	}
+
+	return &copied
+}
+
+// YAML encodes the configuration in the format of the configuration file.
+func (c *Config) YAML() ([]byte, error) {
+	return yaml.Marshal(c)
+}
@@ -0,0 +1,207 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setting binds an environment variable or a flag to a field of the
+// configuration.
+type setting struct {
+	name  string
+	field func(c *Config) interface{}
+}
+
+// envSettings are the environment variables overlaid on the file.
+// nolint: lll
+var envSettings = []setting{
+	{"CF_NOSQL_BROKER_PORT", func(c *Config) interface{} { return &c.Listen.Port }},
+	{"CF_NOSQL_BROKER_URL", func(c *Config) interface{} { return &c.Listen.URL }},
+	{"CF_NOSQL_BROKER_SHUTDOWN_TIMEOUT", func(c *Config) interface{} { return &c.Listen.ShutdownTimeout }},
+	{"CF_NOSQL_BROKER_CERT", func(c *Config) interface{} { return &c.TLS.CertFile }},
+	{"CF_NOSQL_BROKER_KEY", func(c *Config) interface{} { return &c.TLS.KeyFile }},
+	{"CF_NOSQL_BROKER_CIPHER_SUITES", func(c *Config) interface{} { return &c.TLS.CipherSuites }},
+	{"CF_NOSQL_BROKER_CERT_RELOAD_INTERVAL", func(c *Config) interface{} { return &c.TLS.ReloadInterval }},
+	{"CF_NOSQL_BROKER_USERNAME", func(c *Config) interface{} { return &c.Auth.Broker.UserName }},
+	{"CF_NOSQL_BROKER_PASSWORD", func(c *Config) interface{} { return &c.Auth.Broker.Password }},
+	{"CF_NOSQL_BROKER_ADMIN_USERNAME", func(c *Config) interface{} { return &c.Auth.Admin.UserName }},
+	{"CF_NOSQL_BROKER_ADMIN_PASSWORD", func(c *Config) interface{} { return &c.Auth.Admin.Password }},
+	{"CF_NOSQL_BROKER_VIEWER_USERNAME", func(c *Config) interface{} { return &c.Auth.Viewer.UserName }},
+	{"CF_NOSQL_BROKER_VIEWER_PASSWORD", func(c *Config) interface{} { return &c.Auth.Viewer.Password }},
+	{"CF_NOSQL_BROKER_METRICS_USERNAME", func(c *Config) interface{} { return &c.Auth.Metrics.UserName }},
+	{"CF_NOSQL_BROKER_METRICS_PASSWORD", func(c *Config) interface{} { return &c.Auth.Metrics.Password }},
+	{"CF_NOSQL_BROKER_SSO_CLIENT_ID", func(c *Config) interface{} { return &c.Auth.SSO.ClientID }},
+	{"CF_NOSQL_BROKER_SSO_CLIENT_SECRET", func(c *Config) interface{} { return &c.Auth.SSO.ClientSecret }},
+	{"CF_NOSQL_BROKER_CC_URL", func(c *Config) interface{} { return &c.Auth.SSO.CloudControllerURL }},
+	{"CF_NOSQL_BROKER_SSO_SKIP_SSL_VALIDATION", func(c *Config) interface{} { return &c.Auth.SSO.SkipSSLValidation }},
+	{"CF_NOSQL_BROKER_DASHBOARD_TTL", func(c *Config) interface{} { return &c.Auth.DashboardTTL }},
+	{"CF_NOSQL_BROKER_IMAGE", func(c *Config) interface{} { return &c.Runtime.Image }},
+	{"CF_NOSQL_BROKER_HOSTNAME", func(c *Config) interface{} { return &c.Runtime.Hostname }},
+	{"CF_NOSQL_BROKER_FIRST_HOST_PORT", func(c *Config) interface{} { return &c.Runtime.Ports.First }},
+	{"CF_NOSQL_BROKER_LAST_HOST_PORT", func(c *Config) interface{} { return &c.Runtime.Ports.Last }},
+	{"CF_NOSQL_BROKER_RECONCILE_INTERVAL", func(c *Config) interface{} { return &c.Runtime.ReconcileInterval }},
+	{"CF_NOSQL_BROKER_HEALTH_INTERVAL", func(c *Config) interface{} { return &c.Runtime.HealthInterval }},
+	{"CF_NOSQL_BROKER_STATE_DIR", func(c *Config) interface{} { return &c.State.Dir }},
+	{"CF_NOSQL_BROKER_AUDIT_LOG", func(c *Config) interface{} { return &c.State.AuditLog }},
+	{"CF_NOSQL_BROKER_CA_KEY_TYPE", func(c *Config) interface{} { return &c.Authority.KeyType }},
+	{"CF_NOSQL_BROKER_CA_VALIDITY", func(c *Config) interface{} { return &c.Authority.Validity }},
+	{"CF_NOSQL_BROKER_BACKUP_STORAGE", func(c *Config) interface{} { return &c.Backups.Storage }},
+	{"CF_NOSQL_BROKER_BACKUP_DIR", func(c *Config) interface{} { return &c.Backups.Dir }},
+	{"CF_NOSQL_BROKER_BACKUP_MASTER_KEY", func(c *Config) interface{} { return &c.Backups.MasterKey }},
+	{"CF_NOSQL_BROKER_BACKUP_PREVIOUS_MASTER_KEYS", func(c *Config) interface{} { return &c.Backups.PreviousMasterKeys }},
+	{"CF_NOSQL_BROKER_VERIFY_INTERVAL", func(c *Config) interface{} { return &c.Backups.VerifyInterval }},
+	{"CF_NOSQL_BROKER_S3_ENDPOINT", func(c *Config) interface{} { return &c.Backups.S3.Endpoint }},
+	{"CF_NOSQL_BROKER_S3_REGION", func(c *Config) interface{} { return &c.Backups.S3.Region }},
+	{"CF_NOSQL_BROKER_S3_BUCKET", func(c *Config) interface{} { return &c.Backups.S3.Bucket }},
+	{"CF_NOSQL_BROKER_S3_ACCESS_KEY_ID", func(c *Config) interface{} { return &c.Backups.S3.AccessKeyID }},
+	{"CF_NOSQL_BROKER_S3_SECRET_ACCESS_KEY", func(c *Config) interface{} { return &c.Backups.S3.SecretAccessKey }},
+	{"CF_NOSQL_BROKER_S3_PREFIX", func(c *Config) interface{} { return &c.Backups.S3.Prefix }},
+	{"CF_NOSQL_BROKER_S3_PATH_STYLE", func(c *Config) interface{} { return &c.Backups.S3.PathStyle }},
+	{"CF_NOSQL_BROKER_S3_SSE", func(c *Config) interface{} { return &c.Backups.S3.SSE }},
+	{"CF_NOSQL_BROKER_S3_SSE_KMS_KEY_ID", func(c *Config) interface{} { return &c.Backups.S3.KMSKeyID }},
+	{"CF_NOSQL_BROKER_S3_PART_SIZE", func(c *Config) interface{} { return &c.Backups.S3.PartSize }},
+	{"CF_NOSQL_BROKER_S3_INCOMPLETE_UPLOAD_DAYS", func(c *Config) interface{} { return &c.Backups.S3.IncompleteUploadDays }},
+	{"CF_NOSQL_BROKER_LOG_LEVEL", func(c *Config) interface{} { return &c.Logging.Level }},
+	{"CF_NOSQL_BROKER_LOG_FORMAT", func(c *Config) interface{} { return &c.Logging.Format }},
+}
+
+// flagSettings are the command-line flags overlaid on the environment.
+// nolint: lll
+var flagSettings = []setting{
+	{"port", func(c *Config) interface{} { return &c.Listen.Port }},
+	{"url", func(c *Config) interface{} { return &c.Listen.URL }},
+	{"cert", func(c *Config) interface{} { return &c.TLS.CertFile }},
+	{"key", func(c *Config) interface{} { return &c.TLS.KeyFile }},
+	{"image", func(c *Config) interface{} { return &c.Runtime.Image }},
+	{"hostname", func(c *Config) interface{} { return &c.Runtime.Hostname }},
+	{"state-dir", func(c *Config) interface{} { return &c.State.Dir }},
+	{"log-level", func(c *Config) interface{} { return &c.Logging.Level }},
+	{"log-format", func(c *Config) interface{} { return &c.Logging.Format }},
+}
+
+// overlayEnv sets the fields whose environment variable is set and not
+// empty.
+func (c *Config) overlayEnv(lookup func(string) (string, bool)) error {
+	for _, s := range envSettings {
+		value, ok := lookup(s.name)
+		if !ok || value == "" {
+			continue
+		}
+
+		if err := setValue(s.field(c), value); err != nil {
+			return errors.New("$" + s.name + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Flags are the command-line flags overriding the configuration.
+type Flags struct {
+	flags  *flag.FlagSet
+	file   *string
+	values map[string]*string
+}
+
+// RegisterFlags registers the -config flag, defaulting to $EnvFile, and the
+// flags overriding the most common settings.
+func RegisterFlags(flags *flag.FlagSet) *Flags {
+	f := &Flags{
+		flags:  flags,
+		values: map[string]*string{},
+	}
+
+	f.file = flags.String("config", "", "YAML configuration file, "+
+		"defaults to $"+EnvFile)
+	for _, s := range flagSettings {
+		f.values[s.name] = flags.String(s.name, "",
+			"overrides the "+s.name+" setting")
+	}
+
+	return f
+}
+
+// Load reads the configuration file named by the flags or the environment,
+// overlays the environment variables and then the flags set on the command
+// line.
+func (f *Flags) Load() (*Config, error) {
+	path := *f.file
+	if path == "" {
+		path = os.Getenv(EnvFile)
+	}
+
+	c, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f.flags.Visit(func(set *flag.Flag) {
+		for _, s := range flagSettings {
+			if s.name == set.Name && err == nil {
+				if err = setValue(s.field(c), *f.values[s.name]); err != nil {
+					err = errors.New("-" + s.name + ": " + err.Error())
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, c.complete()
+}
+
+// setValue parses a string into the field pointed to.
+func setValue(field interface{}, value string) error {
+	var err error
+
+	switch target := field.(type) {
+	case *string:
+		*target = value
+	case *int:
+		*target, err = strconv.Atoi(value)
+	case *bool:
+		*target, err = strconv.ParseBool(value)
+	case *Duration:
+		var parsed time.Duration
+		parsed, err = time.ParseDuration(value)
+		*target = Duration(parsed)
+	case *[]string:
+		// Lists are comma separated
+		*target = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*target = append(*target, item)
+			}
+		}
+	default:
+		err = errors.New("unsupported setting type")
+	}
+
+	if numError, ok := err.(*strconv.NumError); ok {
+		err = errors.New("invalid value " + strconv.Quote(value) + ": " +
+			numError.Err.Error())
+	}
+
+	return err
+}
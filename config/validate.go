@@ -0,0 +1,259 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/backup"
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+	"github.com/cloudfoundry-community/cf-nosql-broker/security"
+)
+
+// Validate checks the configuration and returns every problem found, each
+// prefixed by the path of the setting in the configuration file.
+func (c *Config) Validate() []error {
+	problems := []error{}
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if !validPort(c.Listen.Port) {
+		fail("listen.port: %d is not a port number", c.Listen.Port)
+	}
+	validateURL(fail, "listen.url", c.Listen.URL)
+	validateInterval(fail, "listen.shutdown_timeout", c.Listen.ShutdownTimeout)
+
+	validateFile(fail, "tls.cert_file", c.TLS.CertFile)
+	validateFile(fail, "tls.key_file", c.TLS.KeyFile)
+	if _, err := security.CipherSuites(c.TLS.CipherSuites); err != nil {
+		fail("tls.cipher_suites: %v", err)
+	}
+	validateInterval(fail, "tls.reload_interval", c.TLS.ReloadInterval)
+
+	validateCredentials(fail, "auth.broker", c.Auth.Broker)
+	validateCredentials(fail, "auth.admin", c.Auth.Admin)
+	validateCredentials(fail, "auth.viewer", c.Auth.Viewer)
+	validateCredentials(fail, "auth.metrics", c.Auth.Metrics)
+	if c.Auth.Admin.UserName != "" &&
+		c.Auth.Admin.UserName == c.Auth.Viewer.UserName {
+		fail("auth.viewer.username: the admin and viewer users must differ")
+	}
+
+	sso := c.Auth.SSO
+	if sso.ClientID != "" || sso.ClientSecret != "" {
+		if sso.ClientID == "" {
+			fail("auth.sso.client_id: required with a client secret")
+		}
+		if sso.ClientSecret == "" {
+			fail("auth.sso.client_secret: required with a client id")
+		}
+		if sso.CloudControllerURL == "" {
+			fail("auth.sso.cloud_controller_url: required to enable the " +
+				"single sign-on")
+		}
+		validateURL(fail, "auth.sso.cloud_controller_url",
+			sso.CloudControllerURL)
+	}
+	if c.Auth.DashboardTTL <= 0 {
+		fail("auth.dashboard_ttl: must be positive")
+	}
+
+	if c.Runtime.Image == "" {
+		fail("runtime.image: required")
+	}
+	ports := c.Runtime.Ports
+	switch {
+	case !validPort(ports.First) || ports.First < 1024:
+		fail("runtime.ports.first: %d is not an unprivileged port number",
+			ports.First)
+	case !validPort(ports.Last):
+		fail("runtime.ports.last: %d is not a port number", ports.Last)
+	case ports.Last < ports.First:
+		fail("runtime.ports.last: %d is before the first port %d",
+			ports.Last, ports.First)
+	case c.Listen.Port >= ports.First && c.Listen.Port <= ports.Last:
+		fail("runtime.ports: the range includes the listen port %d",
+			c.Listen.Port)
+	}
+	validateInterval(fail, "runtime.reconcile_interval",
+		c.Runtime.ReconcileInterval)
+	validateInterval(fail, "runtime.health_interval", c.Runtime.HealthInterval)
+
+	if c.State.Dir == "" {
+		fail("state.dir: required")
+	}
+
+	if _, err := security.ParseKeyType(c.Authority.KeyType); err != nil {
+		fail("authority.key_type: %v", err)
+	}
+	if c.Authority.Validity <= 0 {
+		fail("authority.validity: must be positive")
+	}
+
+	problems = append(problems, c.validateBackups()...)
+
+	names := make([]string, 0, len(c.Plans))
+	for name := range c.Plans {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		plan, where := c.Plans[name], "plans."+name
+		if plan.BackupSchedule != nil && *plan.BackupSchedule != "" {
+			if _, err := backup.ParseSchedule(*plan.BackupSchedule); err != nil {
+				fail("%s.backup_schedule: %v", where, err)
+			}
+		}
+		if plan.DailyBackups != nil && *plan.DailyBackups < 0 {
+			fail("%s.daily_backups: must not be negative", where)
+		}
+		if plan.WeeklyBackups != nil && *plan.WeeklyBackups < 0 {
+			fail("%s.weekly_backups: must not be negative", where)
+		}
+		if plan.OplogRetention != nil {
+			validateInterval(fail, where+".oplog_retention",
+				*plan.OplogRetention)
+		}
+	}
+
+	if _, err := logging.ParseLevel(c.Logging.Level); err != nil {
+		fail("logging.level: %v", err)
+	}
+	if c.Logging.Format != logging.FormatJSON &&
+		c.Logging.Format != logging.FormatLogfmt {
+		fail("logging.format: %q is neither %s nor %s", c.Logging.Format,
+			logging.FormatJSON, logging.FormatLogfmt)
+	}
+
+	return problems
+}
+
+// validateBackups checks the backup storage and its master keys.
+func (c *Config) validateBackups() []error {
+	problems := []error{}
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	s3 := c.Backups.S3
+	switch c.Backups.Storage {
+	case "local":
+		if c.Backups.Dir == "" {
+			fail("backups.dir: required by the local storage")
+		}
+	case "s3":
+		if s3.Bucket == "" {
+			fail("backups.s3.bucket: required by the s3 storage")
+		}
+		if s3.AccessKeyID == "" || s3.SecretAccessKey == "" {
+			fail("backups.s3: the s3 storage requires access_key_id and " +
+				"secret_access_key")
+		}
+		if s3.Endpoint == "" {
+			fail("backups.s3.endpoint: required by the s3 storage")
+		} else {
+			validateURL(fail, "backups.s3.endpoint", s3.Endpoint)
+		}
+		if s3.PartSize != 0 && s3.PartSize < backup.MinPartSize {
+			fail("backups.s3.part_size: %d is below the %d bytes minimum",
+				s3.PartSize, backup.MinPartSize)
+		}
+		if s3.IncompleteUploadDays < 0 {
+			fail("backups.s3.incomplete_upload_days: must not be negative")
+		}
+		if c.Backups.MasterKey == "" {
+			fail("backups.master_key: required to ship the backups to " +
+				"object storage")
+		}
+	default:
+		fail("backups.storage: %q is neither local nor s3",
+			c.Backups.Storage)
+	}
+
+	if c.Backups.MasterKey != "" {
+		if _, err := security.ParseMasterKey(c.Backups.MasterKey); err != nil {
+			fail("backups.master_key: %v", err)
+		}
+	}
+	for i, key := range c.Backups.PreviousMasterKeys {
+		if _, err := security.ParseMasterKey(key); err != nil {
+			fail("backups.previous_master_keys[%d]: %v", i, err)
+		}
+	}
+	validateInterval(fail, "backups.verify_interval", c.Backups.VerifyInterval)
+
+	return problems
+}
+
+// validPort reports whether a number is a TCP port.
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// validateCredentials checks a user name and its password are set
+// together.
+func validateCredentials(fail func(string, ...interface{}), path string,
+	credentials Credentials) {
+
+	switch {
+	case credentials.UserName != "" && credentials.Password == "":
+		fail("%s.password: required with a user name", path)
+	case credentials.UserName == "" && credentials.Password != "":
+		fail("%s.username: required with a password", path)
+	}
+}
+
+// validateFile checks a required file exists.
+func validateFile(fail func(string, ...interface{}), path, file string) {
+	if file == "" {
+		fail("%s: required", path)
+		return
+	}
+
+	if _, err := os.Stat(file); err != nil {
+		fail("%s: %v", path, err)
+	}
+}
+
+// validateURL checks an absolute HTTP or HTTPS address.
+func validateURL(fail func(string, ...interface{}), path, value string) {
+	parsed, err := url.Parse(value)
+	switch {
+	case err != nil:
+		fail("%s: %v", path, err)
+	case parsed.Scheme != "http" && parsed.Scheme != "https":
+		fail("%s: %q is not an http or https address", path, value)
+	case parsed.Host == "":
+		fail("%s: %q has no host", path, value)
+	}
+}
+
+// validateInterval checks a duration is not negative, 0 disabling a task or
+// a wait.
+func validateInterval(fail func(string, ...interface{}), path string,
+	interval Duration) {
+
+	if time.Duration(interval) < 0 {
+		fail("%s: must not be negative", path)
+	}
+}
@@ -0,0 +1,492 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/metrics"
+)
+
+const command = "docker"
+
+var runtimeErrors = metrics.NewCounter("cf_nosql_broker_runtime_errors_total",
+	"Failed calls to the container runtime, by command.", "command")
+
+// RunOptions describes the container to be started by Run.
+type RunOptions struct {
+	Name  string
+	Image string
+	// Entrypoint overrides the default entrypoint of the image.
+	Entrypoint string
+	// Ports maps host ports to container ports.
+	Ports map[string]string
+	// Env holds variables passed to the container. Their values are handed to
+	// the Docker client through its own environment so they never appear in
+	// the command line.
+	Env map[string]string
+	// Args are appended after the image name as the container command.
+	Args []string
+	// Labels are attached to the container to identify it later.
+	Labels map[string]string
+	// Secrets are written as files of SecretsDir, by file name, before the
+	// container starts. Only root can read them and they never appear in
+	// the container configuration.
+	SecretsDir string
+	Secrets    map[string][]byte
+}
+
+// Run creates and starts a detached container. The container is removed
+// when its secrets cannot be written or it does not start.
+func Run(opts RunOptions) error {
+	args := []string{"create", "--name", opts.Name}
+
+	for hostPort, containerPort := range opts.Ports {
+		args = append(args, "-p", hostPort+":"+containerPort)
+	}
+
+	for _, name := range sortedKeys(opts.Env) {
+		args = append(args, "-e", name)
+	}
+
+	for _, key := range sortedKeys(opts.Labels) {
+		args = append(args, "--label", key+"="+opts.Labels[key])
+	}
+
+	if opts.Entrypoint != "" {
+		args = append(args, "--entrypoint", opts.Entrypoint)
+	}
+
+	args = append(args, opts.Image)
+	args = append(args, opts.Args...)
+
+	cmd := exec.Command(command, args...)
+	cmd.Env = environment(opts.Env)
+
+	if _, err := cmd.Output(); err != nil {
+		return commandError("create", err)
+	}
+
+	err := copySecrets(opts.Name, opts.SecretsDir, opts.Secrets)
+	if err == nil {
+		err = Start(opts.Name)
+	}
+	if err != nil {
+		Remove(opts.Name) // nolint: errcheck
+		return err
+	}
+
+	return nil
+}
+
+// copySecrets writes the secrets into a created container as a tar archive,
+// the directory with mode 0700 and the files with mode 0600.
+func copySecrets(name, dir string, secrets map[string][]byte) error {
+	if len(secrets) == 0 {
+		return nil
+	}
+
+	var archive bytes.Buffer
+	writer := tar.NewWriter(&archive)
+
+	base := path.Base(dir)
+	err := writer.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     base + "/",
+		Mode:     0700,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, file := range sortedSecrets(secrets) {
+		err = writer.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     base + "/" + file,
+			Mode:     0600,
+			Size:     int64(len(secrets[file])),
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, err = writer.Write(secrets[file]); err != nil {
+			return err
+		}
+	}
+
+	if err = writer.Close(); err != nil {
+		return err
+	}
+
+	return copyArchive(name, path.Dir(dir), &archive)
+}
+
+// WriteFile writes a file only root can read into a container, running or
+// not, leaving the directory holding it as it is.
+func WriteFile(name, file string, content []byte) error {
+	var archive bytes.Buffer
+	writer := tar.NewWriter(&archive)
+
+	err := writer.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Base(file),
+		Mode:     0600,
+		Size:     int64(len(content)),
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err = writer.Write(content); err != nil {
+		return err
+	}
+
+	if err = writer.Close(); err != nil {
+		return err
+	}
+
+	return copyArchive(name, path.Dir(file), &archive)
+}
+
+// copyArchive extracts a tar archive into a directory of a container.
+func copyArchive(name, dir string, archive io.Reader) error {
+	cmd := exec.Command(command, "cp", "-", name+":"+dir)
+	cmd.Stdin = archive
+
+	if _, err := cmd.Output(); err != nil {
+		return commandError("cp", err)
+	}
+
+	return nil
+}
+
+// ReadSecrets returns the files of a directory of a container, running or
+// not, by file name, such as the secrets written by Run.
+func ReadSecrets(name, dir string) (map[string][]byte, error) {
+	output, err := exec.Command(command, "cp", name+":"+dir, "-").Output()
+	if err != nil {
+		return nil, commandError("cp", err)
+	}
+
+	secrets := map[string][]byte{}
+	reader := tar.NewReader(bytes.NewReader(output))
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return secrets, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		secrets[path.Base(header.Name)] = content
+	}
+}
+
+// ReadFile returns the content of a file of a container, running or not.
+func ReadFile(name, file string) ([]byte, error) {
+	files, err := ReadSecrets(name, file)
+	if err != nil {
+		return nil, err
+	}
+
+	content, ok := files[path.Base(file)]
+	if !ok {
+		return nil, errors.New("[" + command + "] cp error: " + file +
+			" is not a file")
+	}
+
+	return content, nil
+}
+
+// Remove forces the removal of a container, stopping it if needed.
+func Remove(name string) error {
+	_, err := exec.Command(command, "rm", "-f", name).Output()
+	if err != nil {
+		return commandError("rm", err)
+	}
+
+	return nil
+}
+
+// Restart stops a container, if it is running, and starts it again.
+func Restart(name string) error {
+	_, err := exec.Command(command, "restart", name).Output()
+	if err != nil {
+		return commandError("restart", err)
+	}
+
+	return nil
+}
+
+// Stop stops a running container, keeping it to be started again.
+func Stop(name string) error {
+	_, err := exec.Command(command, "stop", name).Output()
+	if err != nil {
+		return commandError("stop", err)
+	}
+
+	return nil
+}
+
+// Start starts a stopped container.
+func Start(name string) error {
+	_, err := exec.Command(command, "start", name).Output()
+	if err != nil {
+		return commandError("start", err)
+	}
+
+	return nil
+}
+
+// Exists reports whether a container with the given name exists, whatever
+// its status.
+func Exists(name string) (bool, error) {
+	output, err := exec.Command(command, "ps", "-a", "--filter",
+		"name=^/"+name+"$", "--format", "{{.Names}}").Output()
+	if err != nil {
+		return false, commandError("ps", err)
+	}
+
+	return strings.TrimSpace(string(output)) == name, nil
+}
+
+// Exec runs a command inside a running container and returns its standard
+// output. Variables in env are exported to the command the same way as in
+// Run, keeping them out of the docker command line. A command expanding them
+// into its own arguments exposes them in the process list of the host, so
+// secrets are better read from files of the container.
+func Exec(name string, env map[string]string, args ...string) ([]byte, error) {
+	var output bytes.Buffer
+	if err := ExecStream(name, env, nil, &output, args...); err != nil {
+		return nil, err
+	}
+
+	return output.Bytes(), nil
+}
+
+// ExecStream runs a command inside a running container connecting its
+// standard input and output to the given streams, so large payloads such as
+// backups never have to be held in memory. A nil stdin sends no input.
+func ExecStream(name string, env map[string]string, stdin io.Reader,
+	stdout io.Writer, args ...string) error {
+
+	execArgs := []string{"exec", "-i"}
+
+	for _, key := range sortedKeys(env) {
+		execArgs = append(execArgs, "-e", key)
+	}
+
+	execArgs = append(execArgs, name)
+	execArgs = append(execArgs, args...)
+
+	cmd := exec.Command(command, execArgs...)
+	cmd.Env = environment(env)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+
+	if err := cmd.Run(); err != nil {
+		return commandError("exec", err)
+	}
+
+	return nil
+}
+
+// State is the runtime status of a container as reported by Docker.
+type State struct {
+	Status     string    `json:"Status"`
+	Running    bool      `json:"Running"`
+	Restarting bool      `json:"Restarting"`
+	ExitCode   int       `json:"ExitCode"`
+	Error      string    `json:"Error"`
+	StartedAt  time.Time `json:"StartedAt"`
+	FinishedAt time.Time `json:"FinishedAt"`
+}
+
+// Inspect returns the runtime status of a container.
+func Inspect(name string) (State, error) {
+	output, err := exec.Command(command, "inspect", "--format",
+		"{{json .State}}", name).Output()
+	if err != nil {
+		return State{}, commandError("inspect", err)
+	}
+
+	var state State
+	if err = json.Unmarshal(output, &state); err != nil {
+		return State{}, err
+	}
+
+	return state, nil
+}
+
+// Summary identifies a container and its status, as listed by List.
+type Summary struct {
+	Name  string
+	State string
+}
+
+// List returns the containers, running or not, whose name starts with the
+// given prefix.
+func List(prefix string) ([]Summary, error) {
+	output, err := exec.Command(command, "ps", "-a", "--filter",
+		"name=^/"+prefix, "--format", "{{.Names}}\t{{.State}}").Output()
+	if err != nil {
+		return nil, commandError("ps", err)
+	}
+
+	var containers []Summary
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], prefix) {
+			continue
+		}
+
+		containers = append(containers, Summary{
+			Name:  fields[0],
+			State: fields[1],
+		})
+	}
+
+	return containers, nil
+}
+
+// Details is the configuration a container was created with.
+type Details struct {
+	Labels map[string]string
+	Env    map[string]string
+	// Ports maps the published host ports to the container ports.
+	Ports map[string]string
+}
+
+// Describe returns the configuration of a container.
+func Describe(name string) (Details, error) {
+	output, err := exec.Command(command, "inspect", "--format",
+		"{{json .}}", name).Output()
+	if err != nil {
+		return Details{}, commandError("inspect", err)
+	}
+
+	var inspected struct {
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+			Env    []string          `json:"Env"`
+		} `json:"Config"`
+		HostConfig struct {
+			PortBindings map[string][]struct {
+				HostPort string `json:"HostPort"`
+			} `json:"PortBindings"`
+		} `json:"HostConfig"`
+	}
+	if err = json.Unmarshal(output, &inspected); err != nil {
+		return Details{}, err
+	}
+
+	details := Details{
+		Labels: inspected.Config.Labels,
+		Env:    map[string]string{},
+		Ports:  map[string]string{},
+	}
+	if details.Labels == nil {
+		details.Labels = map[string]string{}
+	}
+
+	for _, variable := range inspected.Config.Env {
+		if i := strings.Index(variable, "="); i > 0 {
+			details.Env[variable[:i]] = variable[i+1:]
+		}
+	}
+
+	for containerPort, bindings := range inspected.HostConfig.PortBindings {
+		for _, binding := range bindings {
+			details.Ports[binding.HostPort] = strings.Split(containerPort, "/")[0]
+		}
+	}
+
+	return details, nil
+}
+
+// UsedPorts lists the host ports published by the running containers.
+func UsedPorts() ([]string, error) {
+	portsTaken, err := exec.Command("bash", "-c",
+		command+" ps --format '{{.Ports}}' | grep -oE ':[^-]+' | cut -c2-").Output()
+
+	if err != nil {
+		return nil, commandError("ps", err)
+	}
+
+	return strings.Fields(string(portsTaken)), nil
+}
+
+// commandError counts a failed runtime command and describes its error.
+func commandError(subcommand string, err error) error {
+	runtimeErrors.Inc(subcommand)
+	return errors.New("[" + command + "] " + subcommand + " error: " +
+		err.Error())
+}
+
+// environment returns the broker environment extended with the given
+// variables.
+func environment(env map[string]string) []string {
+	vars := os.Environ()
+	for _, key := range sortedKeys(env) {
+		vars = append(vars, key+"="+env[key])
+	}
+
+	return vars
+}
+
+// sortedSecrets returns the file names of the secrets in a stable order.
+func sortedSecrets(secrets map[string][]byte) []string {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// sortedKeys returns the keys of a map in a stable order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,130 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package database
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/container"
+)
+
+// Admin is the privileged credential generated by the broker for every
+// instance. It is only used internally to manage the binding users.
+type Admin struct {
+	UserName string
+	Password string
+}
+
+// Certificate is the PEM encoded server certificate of an instance together
+// with its private key and the authority that signed it.
+type Certificate struct {
+	CertificatePEM []byte
+	PrivateKeyPEM  []byte
+	AuthorityPEM   []byte
+}
+
+// Server identifies a running database instance.
+type Server struct {
+	ContainerName string
+	HostPort      string
+	Admin         Admin
+	// TLS requires encrypted connections to the instance.
+	TLS bool
+	// Certificate is only needed by RunOptions when TLS is enabled.
+	Certificate Certificate
+	// ReplicaSet runs the instance as a replica set so its operations log
+	// can be archived for point-in-time recovery.
+	ReplicaSet bool
+	// KeyFile authenticates the replica set members, only needed by
+	// RunOptions when ReplicaSet is enabled.
+	KeyFile string
+}
+
+// Timestamp identifies an entry of the operations log: the seconds since the
+// epoch and an ordinal within that second.
+type Timestamp struct {
+	T uint32 `json:"t"`
+	I uint32 `json:"i"`
+}
+
+// Before reports whether ts is older than other.
+func (ts Timestamp) Before(other Timestamp) bool {
+	return ts.T < other.T || (ts.T == other.T && ts.I < other.I)
+}
+
+// Time returns the wall clock second of the timestamp.
+func (ts Timestamp) Time() time.Time {
+	return time.Unix(int64(ts.T), 0).UTC()
+}
+
+// String formats the timestamp as seconds:ordinal.
+func (ts Timestamp) String() string {
+	return strconv.FormatUint(uint64(ts.T), 10) + ":" +
+		strconv.FormatUint(uint64(ts.I), 10)
+}
+
+// Engine describes how a NoSQL database runs inside a container and how its
+// users are managed.
+type Engine interface {
+	// RunOptions returns the container definition for a new instance.
+	RunOptions(server Server) container.RunOptions
+	// Port is the port the database listens to inside the container.
+	Port() string
+	// RecoverServer rebuilds the server of a container started from
+	// RunOptions, to adopt the containers whose broker record was lost.
+	RecoverServer(name string, details container.Details) (Server, error)
+	// CreateUser adds a user with read and write access to a database.
+	CreateUser(server Server, database, userName, password string) error
+	// DropUser removes a user previously created by CreateUser.
+	DropUser(server Server, database, userName string) error
+	// CollectionCounts returns the number of documents of every collection
+	// of the user databases, keyed by database.collection.
+	CollectionCounts(server Server) (map[string]int64, error)
+	// StorageSize returns the disk space used by the databases, in bytes.
+	StorageSize(server Server) (int64, error)
+	// Dump streams a compressed archive of every database to w. Replica
+	// sets include the operations applied while the dump runs, so the
+	// archive is consistent.
+	Dump(server Server, w io.Writer) error
+	// DumpFormat names the format written by Dump, recorded with the
+	// backups.
+	DumpFormat(server Server) string
+	// Restore loads an archive written by Dump in the given format. The
+	// users of the source instance are not restored.
+	Restore(server Server, format string, r io.Reader) error
+	// WaitReady blocks until the instance accepts authenticated connections
+	// or the timeout expires.
+	WaitReady(server Server, timeout time.Duration) error
+	// Ping checks once that the instance accepts authenticated connections.
+	Ping(server Server) error
+	// RotateCertificate replaces the server certificate of a running TLS
+	// enabled instance without restarting it.
+	RotateCertificate(server Server, certificate Certificate) error
+	// InitiateReplicaSet configures a new replica set instance and waits
+	// until it accepts writes.
+	InitiateReplicaSet(server Server, timeout time.Duration) error
+	// OplogRange returns the oldest and newest entries of the operations
+	// log of a replica set.
+	OplogRange(server Server) (Timestamp, Timestamp, error)
+	// DumpOplog streams the operations log entries after from and up to to
+	// included.
+	DumpOplog(server Server, from, to Timestamp, w io.Writer) error
+	// ReplayOplog applies the entries read from r older than limit.
+	ReplayOplog(server Server, r io.Reader, limit Timestamp) error
+}
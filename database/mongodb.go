@@ -0,0 +1,382 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/container"
+)
+
+const (
+	mongoImage           = "mongo"
+	mongoPort            = "27017"
+	mongoDumpFormat      = "mongodump-archive-gzip"
+	mongoOplogDumpFormat = "mongodump-archive-gzip-oplog"
+	mongoReplicaSet      = "rs0"
+
+	// The secrets are written by the broker into the container before it
+	// starts, so neither the root password nor the keys show in its
+	// configuration.
+	mongoSecretsDir           = "/etc/cf-nosql-broker"
+	mongoRootPasswordSecret   = "root-password"
+	mongoKeyFileSecret        = "keyfile"
+	mongoTLSCertificateSecret = "server.pem"
+	mongoTLSAuthoritySecret   = "ca.pem"
+	mongoToolsConfigSecret    = "tools.yaml"
+	mongoRootPasswordFile     = mongoSecretsDir + "/" + mongoRootPasswordSecret
+	mongoKeyFile              = mongoSecretsDir + "/" + mongoKeyFileSecret
+	mongoTLSCertificateFile   = mongoSecretsDir + "/" + mongoTLSCertificateSecret
+	mongoTLSAuthorityFile     = mongoSecretsDir + "/" + mongoTLSAuthoritySecret
+	mongoToolsConfigFile      = mongoSecretsDir + "/" + mongoToolsConfigSecret
+
+	// The image entrypoint reads the root password file once it runs as the
+	// mongodb user, so the broker entrypoint hands the secrets over to it.
+	mongoEntrypoint = "chown -R mongodb " + mongoSecretsDir + " && " +
+		"exec docker-entrypoint.sh \"$@\""
+
+	// The scripts read every value from the environment so user input is
+	// never interpolated into JavaScript. They first authenticate as the
+	// root user with the password read from its secret file, so it never
+	// appears in a command line.
+	authenticateScript = "db.getSiblingDB('admin').auth(" +
+		"process.env.MONGO_ADMIN_USERNAME, " +
+		"require('fs').readFileSync('" + mongoRootPasswordFile + "', 'utf8')); "
+	createUserScript = "db.getSiblingDB(process.env.BIND_DATABASE).createUser(" +
+		"{ user: process.env.BIND_USERNAME, pwd: process.env.BIND_PASSWORD, " +
+		"roles: [{ role: 'readWrite', db: process.env.BIND_DATABASE }] })"
+	dropUserScript = "db.getSiblingDB(process.env.BIND_DATABASE)." +
+		"dropUser(process.env.BIND_USERNAME)"
+	rotateCertificatesScript = "db.adminCommand({ rotateCertificates: 1 })"
+	storageSizeScript        = "print(db.adminCommand({ listDatabases: 1 }).totalSize)"
+	pingScript               = "db.adminCommand({ ping: 1 }).ok"
+	collectionCountsScript   = "const counts = {}; " +
+		"db.adminCommand({ listDatabases: 1, nameOnly: true }).databases." +
+		"filter(d => !['admin', 'config', 'local'].includes(d.name))." +
+		"forEach(d => { const database = db.getSiblingDB(d.name); " +
+		"database.getCollectionNames().forEach(c => { " +
+		"counts[d.name + '.' + c] = database.getCollection(c).countDocuments({}) " +
+		"}) }); print(JSON.stringify(counts))"
+
+	errorNotReady      = "the database did not become ready in time"
+	errorNotRecognized = "the container was not started by the broker"
+
+	// The new certificate is read from the standard input, written next to
+	// the current one and moved over it so mongod never reads a partial file.
+	writeCertificateScript = "umask 077 && " +
+		"cat > " + mongoTLSCertificateFile + ".new && " +
+		"chown mongodb " + mongoTLSCertificateFile + ".new && " +
+		"mv " + mongoTLSCertificateFile + ".new " + mongoTLSCertificateFile
+)
+
+// MongoDB runs the official mongo image with authentication enabled.
+type MongoDB struct {
+	// Image is the Docker image of the containers, the official mongo image
+	// when empty.
+	Image string
+}
+
+// RunOptions starts mongod with --auth and the broker generated root user.
+// When TLS is enabled mongod only accepts encrypted connections, and replica
+// set instances are started with their own key file. The root password, the
+// certificate, the key file and the configuration giving the root password
+// to the database tools are secret files of the container.
+func (m MongoDB) RunOptions(server Server) container.RunOptions {
+	image := m.Image
+	if image == "" {
+		image = mongoImage
+	}
+
+	opts := container.RunOptions{
+		Name:       server.ContainerName,
+		Image:      image,
+		Entrypoint: "sh",
+		Ports:      map[string]string{server.HostPort: mongoPort},
+		Env: map[string]string{
+			"MONGO_INITDB_ROOT_USERNAME":      server.Admin.UserName,
+			"MONGO_INITDB_ROOT_PASSWORD_FILE": mongoRootPasswordFile,
+		},
+		SecretsDir: mongoSecretsDir,
+		Secrets: map[string][]byte{
+			mongoRootPasswordSecret: []byte(server.Admin.Password),
+			mongoToolsConfigSecret:  toolsConfig(server.Admin.Password),
+		},
+	}
+
+	args := []string{"mongod", "--auth"}
+
+	if server.TLS {
+		opts.Secrets[mongoTLSCertificateSecret] =
+			[]byte(certificateKey(server.Certificate))
+		opts.Secrets[mongoTLSAuthoritySecret] = server.Certificate.AuthorityPEM
+		args = append(args, "--tlsMode", "requireTLS",
+			"--tlsCertificateKeyFile", mongoTLSCertificateFile)
+	}
+
+	if server.ReplicaSet {
+		opts.Secrets[mongoKeyFileSecret] = []byte(server.KeyFile)
+		args = append(args, "--replSet", mongoReplicaSet,
+			"--keyFile", mongoKeyFile)
+	}
+
+	opts.Args = append([]string{"-c", mongoEntrypoint, "sh"}, args...)
+
+	return opts
+}
+
+// Port is the port mongod listens to inside the container.
+func (MongoDB) Port() string {
+	return mongoPort
+}
+
+// RecoverServer reads the root user name RunOptions passed to the container
+// through its environment, and the root password, TLS and replica set
+// settings back from its secret files.
+func (MongoDB) RecoverServer(
+	name string, details container.Details) (Server, error) {
+
+	secrets, err := container.ReadSecrets(name, mongoSecretsDir)
+	if err != nil {
+		return Server{}, errors.New(errorNotRecognized + ": " + err.Error())
+	}
+
+	server := Server{
+		ContainerName: name,
+		Admin: Admin{
+			UserName: details.Env["MONGO_INITDB_ROOT_USERNAME"],
+			Password: string(secrets[mongoRootPasswordSecret]),
+		},
+		TLS:        len(secrets[mongoTLSCertificateSecret]) > 0,
+		ReplicaSet: len(secrets[mongoKeyFileSecret]) > 0,
+		KeyFile:    string(secrets[mongoKeyFileSecret]),
+	}
+
+	for hostPort, containerPort := range details.Ports {
+		if containerPort == mongoPort {
+			server.HostPort = hostPort
+		}
+	}
+
+	if server.Admin.UserName == "" || server.Admin.Password == "" ||
+		server.HostPort == "" {
+		return Server{}, errors.New(errorNotRecognized)
+	}
+
+	return server, nil
+}
+
+// CreateUser adds a readWrite user to the given database.
+func (m MongoDB) CreateUser(
+	server Server, database, userName, password string) error {
+
+	env := map[string]string{
+		"BIND_DATABASE": database,
+		"BIND_USERNAME": userName,
+		"BIND_PASSWORD": password,
+	}
+
+	_, err := m.eval(server, env, createUserScript)
+	return err
+}
+
+// DropUser removes a user from the given database.
+func (m MongoDB) DropUser(server Server, database, userName string) error {
+	env := map[string]string{
+		"BIND_DATABASE": database,
+		"BIND_USERNAME": userName,
+	}
+
+	_, err := m.eval(server, env, dropUserScript)
+	return err
+}
+
+// StorageSize returns the total size on disk of the databases.
+func (m MongoDB) StorageSize(server Server) (int64, error) {
+	output, err := m.eval(server, map[string]string{}, storageSizeScript)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(size), nil
+}
+
+// CollectionCounts counts the documents of the collections outside the
+// admin, config and local databases.
+func (m MongoDB) CollectionCounts(server Server) (map[string]int64, error) {
+	output, err := m.eval(server, map[string]string{}, collectionCountsScript)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int64{}
+	if err = json.Unmarshal(output, &counts); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// Dump runs mongodump inside the container writing a gzipped archive to w.
+// Replica sets are dumped with --oplog for a consistent snapshot.
+func (m MongoDB) Dump(server Server, w io.Writer) error {
+	flags := "--quiet --archive --gzip "
+	if server.ReplicaSet {
+		flags += "--oplog "
+	}
+
+	return container.ExecStream(server.ContainerName, adminEnv(server), nil, w,
+		"sh", "-c", "mongodump "+flags+toolFlags(server))
+}
+
+// DumpFormat is the format written by Dump.
+func (MongoDB) DumpFormat(server Server) string {
+	if server.ReplicaSet {
+		return mongoOplogDumpFormat
+	}
+
+	return mongoDumpFormat
+}
+
+// Restore runs mongorestore inside the container reading a gzipped archive
+// from r. The admin and config databases are skipped, so the users of the
+// source instance, including its root user, are never restored.
+func (MongoDB) Restore(server Server, format string, r io.Reader) error {
+	flags := "--quiet --archive --gzip --drop " +
+		"--nsExclude 'admin.*' --nsExclude 'config.*' "
+	if format == mongoOplogDumpFormat {
+		flags += "--oplogReplay "
+	}
+
+	return container.ExecStream(server.ContainerName, adminEnv(server), r, nil,
+		"sh", "-c", "mongorestore "+flags+toolFlags(server))
+}
+
+// WaitReady pings mongod as the root user until it answers.
+func (m MongoDB) WaitReady(server Server, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		err := m.Ping(server)
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return errors.New(errorNotReady + ": " + err.Error())
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// Ping checks once that mongod answers the root user. The image entrypoint
+// first runs a temporary mongod to create the root user and only then
+// replaces itself with the final one, so the ping is only attempted once
+// mongod is the main process of the container.
+func (MongoDB) Ping(server Server) error {
+	_, err := container.Exec(server.ContainerName, adminEnv(server), "sh", "-c",
+		`[ "$(cat /proc/1/comm)" = mongod ] && mongosh --quiet `+
+			connectionFlags(server)+` --eval "$0"`,
+		authenticateScript+pingScript)
+	return err
+}
+
+// RotateCertificate installs a new server certificate and asks mongod to load
+// it, keeping the established connections open.
+func (m MongoDB) RotateCertificate(server Server, certificate Certificate) error {
+	err := container.ExecStream(server.ContainerName, nil,
+		strings.NewReader(certificateKey(certificate)), nil, "sh", "-c",
+		writeCertificateScript)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.eval(server, map[string]string{}, rotateCertificatesScript)
+	return err
+}
+
+// certificateKey returns the certificate followed by its private key, the
+// format expected by --tlsCertificateKeyFile.
+func certificateKey(certificate Certificate) string {
+	return string(certificate.CertificatePEM) +
+		string(certificate.PrivateKeyPEM)
+}
+
+// eval runs a mongosh script inside the container authenticated as the root
+// user and returns its output. The user name travels as an environment
+// variable and the password is read from its secret file.
+func (MongoDB) eval(
+	server Server, env map[string]string, script string) ([]byte, error) {
+
+	env["MONGO_ADMIN_USERNAME"] = server.Admin.UserName
+
+	return container.Exec(server.ContainerName, env, "sh", "-c",
+		"mongosh --quiet "+connectionFlags(server)+` --eval "$0"`,
+		authenticateScript+script)
+}
+
+// adminEnv returns the root user name as the variable expanded by toolFlags
+// and read by authenticateScript.
+func adminEnv(server Server) map[string]string {
+	return map[string]string{
+		"MONGO_ADMIN_USERNAME": server.Admin.UserName,
+	}
+}
+
+// toolsConfig returns the configuration file giving the root password to the
+// database tools through --config.
+func toolsConfig(password string) []byte {
+	// A JSON string is a valid YAML double-quoted scalar
+	quoted, _ := json.Marshal(password)
+	return []byte("password: " + string(quoted) + "\n")
+}
+
+// connectionFlags returns the shell flags used by mongosh to connect to the
+// local mongod, before authenticateScript logs in as the root user.
+func connectionFlags(server Server) string {
+	flags := "--host localhost"
+
+	if server.TLS {
+		flags += " --tls --tlsCAFile " + mongoTLSAuthorityFile
+	}
+
+	return flags
+}
+
+// toolFlags returns the connection flags of the MongoDB database tools, such
+// as mongodump, which still name the TLS options after SSL. The root
+// password is read from the configuration file written by RunOptions.
+func toolFlags(server Server) string {
+	flags := `--host localhost --authenticationDatabase admin ` +
+		`-u "$MONGO_ADMIN_USERNAME" --config ` + mongoToolsConfigFile
+
+	if server.TLS {
+		flags += " --ssl --sslCAFile " + mongoTLSAuthorityFile
+	}
+
+	return flags
+}
@@ -0,0 +1,131 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package database
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/container"
+)
+
+const (
+	// The only member is reached through localhost, clients bind with
+	// directConnection so the member name never has to resolve outside the
+	// container.
+	initiateReplicaSetScript = "try { rs.status() } catch (e) { " +
+		"rs.initiate({ _id: '" + mongoReplicaSet + "', " +
+		"members: [{ _id: 0, host: 'localhost:" + mongoPort + "' }] }) }"
+	writablePrimaryScript = "print(db.hello().isWritablePrimary)"
+	oplogRangeScript      = "const oplog = db.getSiblingDB('local').oplog.rs; " +
+		"const first = oplog.find().sort({ $natural: 1 }).limit(1).next().ts; " +
+		"const last = oplog.find().sort({ $natural: -1 }).limit(1).next().ts; " +
+		"print([first.getHighBits(), first.getLowBits(), " +
+		"last.getHighBits(), last.getLowBits()].join(' '))"
+
+	// The users and sessions of the source instance are never replayed,
+	// like Restore skips the admin and config databases.
+	oplogQuery = `{ "ts": { "$gt": { "$timestamp": { "t": %FT, "i": %FI } }, ` +
+		`"$lte": { "$timestamp": { "t": %TT, "i": %TI } } }, ` +
+		`"ns": { "$not": { "$regex": "^(admin\\.system\\.|config\\.)" } } }`
+
+	replayDir = "/tmp/oplog-replay"
+
+	errorPrimaryNotReady = "the replica set did not elect a primary in time"
+)
+
+// InitiateReplicaSet configures the single member replica set and waits for
+// it to become writable.
+func (m MongoDB) InitiateReplicaSet(server Server, timeout time.Duration) error {
+	if _, err := m.eval(server, map[string]string{},
+		initiateReplicaSetScript); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		output, err := m.eval(server, map[string]string{}, writablePrimaryScript)
+		if err == nil && strings.TrimSpace(string(output)) == "true" {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return errors.New(errorPrimaryNotReady)
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// OplogRange returns the oldest and newest timestamps of local.oplog.rs.
+func (m MongoDB) OplogRange(server Server) (Timestamp, Timestamp, error) {
+	output, err := m.eval(server, map[string]string{}, oplogRangeScript)
+	if err != nil {
+		return Timestamp{}, Timestamp{}, err
+	}
+
+	fields := strings.Fields(string(output))
+	if len(fields) != 4 {
+		return Timestamp{}, Timestamp{}, errors.New(
+			"unexpected oplog range: " + strings.TrimSpace(string(output)))
+	}
+
+	values := make([]uint32, 4)
+	for i, field := range fields {
+		value, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return Timestamp{}, Timestamp{}, err
+		}
+		values[i] = uint32(value)
+	}
+
+	return Timestamp{T: values[0], I: values[1]},
+		Timestamp{T: values[2], I: values[3]}, nil
+}
+
+// DumpOplog runs mongodump on local.oplog.rs writing the raw BSON entries
+// in (from, to] to w.
+func (MongoDB) DumpOplog(server Server, from, to Timestamp, w io.Writer) error {
+	query := strings.NewReplacer(
+		"%FT", strconv.FormatUint(uint64(from.T), 10),
+		"%FI", strconv.FormatUint(uint64(from.I), 10),
+		"%TT", strconv.FormatUint(uint64(to.T), 10),
+		"%TI", strconv.FormatUint(uint64(to.I), 10),
+	).Replace(oplogQuery)
+
+	env := adminEnv(server)
+	env["OPLOG_QUERY"] = query
+
+	return container.ExecStream(server.ContainerName, env, nil, w, "sh", "-c",
+		`mongodump --quiet -d local -c oplog.rs --query "$OPLOG_QUERY" `+
+			`--out - `+toolFlags(server))
+}
+
+// ReplayOplog copies the BSON entries read from r into the container and
+// applies the ones older than limit with mongorestore --oplogReplay.
+func (MongoDB) ReplayOplog(server Server, r io.Reader, limit Timestamp) error {
+	return container.ExecStream(server.ContainerName, adminEnv(server), r, nil,
+		"sh", "-c", "umask 077 && mkdir -p "+replayDir+" && "+
+			"cat > "+replayDir+"/oplog.bson && "+
+			"mongorestore --quiet --oplogReplay --oplogLimit "+limit.String()+
+			" "+toolFlags(server)+" "+replayDir+"; "+
+			"status=$?; rm -rf "+replayDir+"; exit $status")
+}
@@ -0,0 +1,487 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/container"
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+	"github.com/cloudfoundry-community/cf-nosql-broker/model"
+	"github.com/cloudfoundry-community/cf-nosql-broker/state"
+	"github.com/gorilla/mux"
+)
+
+// Roles of the operators of the administration API. Viewers can only read,
+// operators can also act on the instances.
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+)
+
+const (
+	adminPath          = "/admin/v1"
+	errorUnauthorized  = "Valid administrator credentials are required."
+	errorAdminDisabled = "The administration API is not enabled."
+	errorRoleRequired  = "The operator role is required."
+
+	// adminPlatform identifies the operators in the audit log, in place of
+	// the platform of the originating identity.
+	adminPlatform = "admin"
+)
+
+// Operator holds the credentials of a user of the administration API,
+// distinct from the ones of the platform.
+type Operator struct {
+	UserName string
+	Password string
+	Role     string
+}
+
+// adminInstance is an instance as listed by the administration API.
+type adminInstance struct {
+	ID               string    `json:"id"`
+	ServiceID        string    `json:"service_id"`
+	PlanID           string    `json:"plan_id"`
+	Plan             string    `json:"plan"`
+	OrganizationID   string    `json:"organization_guid"`
+	SpaceID          string    `json:"space_guid"`
+	ContainerName    string    `json:"container_name"`
+	HostPort         string    `json:"host_port"`
+	TLS              bool      `json:"tls"`
+	ReplicaSet       bool      `json:"replica_set"`
+	Stopped          bool      `json:"stopped"`
+	State            string    `json:"state,omitempty"`
+	StateDescription string    `json:"state_description,omitempty"`
+	Health           string    `json:"health"`
+	Bindings         int       `json:"bindings"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// adminInstanceDetails adds the container status, the bindings and the
+// recent operations to an instance.
+type adminInstanceDetails struct {
+	adminInstance
+	Container      *container.State    `json:"container"`
+	ContainerError string              `json:"container_error,omitempty"`
+	BindingList    []adminBinding      `json:"binding_list"`
+	Operations     []state.Operation   `json:"operations"`
+	HealthEvents   []state.HealthEvent `json:"health_events"`
+}
+
+// adminBinding is a binding as listed by the administration API, without
+// its credentials.
+type adminBinding struct {
+	ID             string    `json:"id"`
+	InstanceID     string    `json:"instance_id"`
+	OrganizationID string    `json:"organization_guid"`
+	SpaceID        string    `json:"space_guid"`
+	DatabaseName   string    `json:"database_name"`
+	UserName       string    `json:"username"`
+	State          string    `json:"state"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// portAllocation is a port of the pool allocated to an instance or
+// reserved by a provision in progress.
+type portAllocation struct {
+	Port          int    `json:"port"`
+	InstanceID    string `json:"instance_id,omitempty"`
+	ContainerName string `json:"container_name,omitempty"`
+}
+
+// portPool describes the host ports handed to the instances.
+type portPool struct {
+	First     int              `json:"first"`
+	Last      int              `json:"last"`
+	Allocated []portAllocation `json:"allocated"`
+}
+
+// adminAuth restricts a handler to the operators holding the given role,
+// viewers being allowed the handlers open to RoleViewer only. The
+// administration API is disabled when no operator is configured.
+func adminAuth(role string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(broker.Operators) == 0 {
+			requestLog(r).Warning(errorAdminDisabled)
+			writeResponse(w, http.StatusNotFound, model.ErrorResponse{
+				Description: errorAdminDisabled,
+			})
+			return
+		}
+
+		userName, password, ok := r.BasicAuth()
+		operator, found := authenticateOperator(userName, password)
+		if !ok || !found {
+			requestLog(r).Warning(errorUnauthorized)
+			w.Header().Set("WWW-Authenticate", `Basic realm="cf-nosql-broker admin"`)
+			writeResponse(w, http.StatusUnauthorized, model.ErrorResponse{
+				Description: errorUnauthorized,
+			})
+			return
+		}
+
+		log := requestLog(r).With("operator", operator.UserName)
+		if role == RoleOperator && operator.Role != RoleOperator {
+			log.Warning(errorRoleRequired)
+			writeResponse(w, http.StatusForbidden, model.ErrorResponse{
+				Description: errorRoleRequired,
+			})
+			return
+		}
+
+		// The operator stands for the user behind the request in the logs
+		// and the audit log
+		r = r.WithContext(logging.NewContext(r.Context(), log))
+		handler(w, withIdentity(r, originatingIdentity{
+			Platform: adminPlatform,
+			UserID:   operator.UserName,
+		}))
+	}
+}
+
+// authenticateOperator returns the operator holding the given credentials.
+// Every operator is compared so the time taken does not tell which one
+// matched.
+func authenticateOperator(userName, password string) (Operator, bool) {
+	var matched Operator
+	found := false
+
+	for _, operator := range broker.Operators {
+		if subtle.ConstantTimeCompare([]byte(userName),
+			[]byte(operator.UserName)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password),
+				[]byte(operator.Password)) == 1 {
+			matched = operator
+			found = true
+		}
+	}
+
+	return matched, found
+}
+
+// ListInstances returns the instances managed by the broker, optionally
+// filtered by organization_guid and space_guid.
+func ListInstances(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Listing the service instances")
+
+	organizationID := r.FormValue("organization_guid")
+	spaceID := r.FormValue("space_guid")
+
+	instances := []adminInstance{}
+	for _, instance := range broker.Store.Instances() {
+		if (organizationID == "" || instance.OrganizationID == organizationID) &&
+			(spaceID == "" || instance.SpaceID == spaceID) {
+			instances = append(instances, newAdminInstance(instance))
+		}
+	}
+
+	log.Info("Service instances listed", "count", len(instances))
+	writeResponse(w, http.StatusOK, instances)
+}
+
+// GetAdminInstance returns an instance with its container status, its
+// bindings and its recent operations.
+func GetAdminInstance(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Inspecting a service instance")
+
+	instance, ok := broker.Store.Instance(mux.Vars(r)["instance_id"])
+	if !ok {
+		log.Warning(errorInstanceNotFound)
+		writeResponse(w, http.StatusNotFound, model.ErrorResponse{
+			Description: errorInstanceNotFound,
+		})
+		return
+	}
+
+	details := adminInstanceDetails{
+		adminInstance: newAdminInstance(instance),
+		BindingList:   []adminBinding{},
+		Operations:    broker.Store.Operations(instance.ID),
+		HealthEvents:  broker.Store.HealthEvents(instance.ID),
+	}
+
+	for _, binding := range broker.Store.Bindings(instance.ID) {
+		details.BindingList = append(details.BindingList,
+			newAdminBinding(instance, binding))
+	}
+
+	containerState, err := container.Inspect(instance.ContainerName)
+	if err != nil {
+		log.Warning("Inspecting the container failed", "error", err)
+		details.ContainerError = err.Error()
+	} else {
+		details.Container = &containerState
+	}
+
+	log.Info("Service instance inspected")
+	writeResponse(w, http.StatusOK, details)
+}
+
+// ListAdminBindings returns the bindings of every instance, or of the one
+// given as instance_id, without their credentials.
+func ListAdminBindings(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Listing the service bindings")
+
+	instanceID := r.FormValue("instance_id")
+
+	bindings := []adminBinding{}
+	for _, instance := range broker.Store.Instances() {
+		if instanceID != "" && instance.ID != instanceID {
+			continue
+		}
+
+		for _, binding := range broker.Store.Bindings(instance.ID) {
+			bindings = append(bindings, newAdminBinding(instance, binding))
+		}
+	}
+
+	log.Info("Service bindings listed", "count", len(bindings))
+	writeResponse(w, http.StatusOK, bindings)
+}
+
+// ListPorts returns the host ports of the pool and the ones allocated to
+// the instances or reserved by the provisions in progress.
+func ListPorts(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Listing the port allocations")
+
+	reservedPortsMu.Lock()
+	allocated, err := allocatedPorts()
+	reservedPortsMu.Unlock()
+
+	if err != nil {
+		log.Error("Reading the allocated ports failed", "error", err)
+		writeResponse(w, http.StatusInternalServerError, model.ErrorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+
+	owners := map[int]state.Instance{}
+	for _, instance := range broker.Store.Instances() {
+		if port, err := strconv.Atoi(instance.HostPort); err == nil {
+			owners[port] = instance
+		}
+	}
+
+	pool := portPool{
+		First:     broker.FirstHostPort,
+		Last:      broker.LastHostPort,
+		Allocated: []portAllocation{},
+	}
+
+	for port := broker.FirstHostPort; port <= broker.LastHostPort; port++ {
+		if !allocated[port] {
+			continue
+		}
+
+		allocation := portAllocation{Port: port}
+		if owner, ok := owners[port]; ok {
+			allocation.InstanceID = owner.ID
+			allocation.ContainerName = owner.ContainerName
+		}
+		pool.Allocated = append(pool.Allocated, allocation)
+	}
+
+	log.Info("Port allocations listed", "count", len(pool.Allocated))
+	writeResponse(w, http.StatusOK, pool)
+}
+
+// ForceDeleteInstance removes an instance whatever the state of its
+// container, for the instances the platform can no longer delete. The
+// container is removed when it exists, then the record, the bindings and
+// the certificate records are forgotten.
+func ForceDeleteInstance(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Force deleting a service instance")
+
+	instanceID := mux.Vars(r)["instance_id"]
+
+	if !beginOperation(instanceID) {
+		log.Warning(errorOperationInProgress)
+		writeResponse(w, http.StatusUnprocessableEntity, model.ErrorResponse{
+			Error:       concurrencyError,
+			Description: errorOperationInProgress,
+		})
+		return
+	}
+	defer endOperation(instanceID)
+
+	instance, ok := broker.Store.Instance(instanceID)
+	if !ok {
+		log.Warning(errorInstanceNotFound)
+		writeResponse(w, http.StatusNotFound, model.ErrorResponse{
+			Description: errorInstanceNotFound,
+		})
+		return
+	}
+
+	view := newAdminInstance(instance)
+
+	err := removeOrphanedContainer(instance.ContainerName)
+	if err == nil {
+		err = broker.Store.DeleteInstance(instanceID)
+	}
+	if err == nil {
+		forgetHealth(instanceID)
+		if _, ok := broker.Authority.Current(instance.ContainerName); ok {
+			err = broker.Authority.Forget(instance.ContainerName)
+		}
+	}
+
+	if err != nil {
+		log.Error("Force deleting the instance failed", "error", err)
+		writeResponse(w, http.StatusInternalServerError, model.ErrorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+
+	// The instance operations went with the instance, the deletion is only
+	// kept in the audit log
+	log.Info("Service instance force deleted", "container",
+		instance.ContainerName)
+	writeResponse(w, http.StatusOK, view)
+}
+
+// RestartInstance restarts the container of an instance.
+func RestartInstance(w http.ResponseWriter, r *http.Request) {
+	controlContainer(w, r, "restart", container.Restart, false)
+}
+
+// StopInstance stops the container of an instance until it is started
+// again, the health monitor leaving it alone meanwhile.
+func StopInstance(w http.ResponseWriter, r *http.Request) {
+	controlContainer(w, r, "stop", container.Stop, true)
+}
+
+// StartInstance starts the container of an instance stopped by an
+// operator.
+func StartInstance(w http.ResponseWriter, r *http.Request) {
+	controlContainer(w, r, "start", container.Start, false)
+}
+
+// controlContainer runs a runtime command on the container of an instance
+// and records whether the instance is left stopped.
+func controlContainer(w http.ResponseWriter, r *http.Request, action string,
+	command func(name string) error, stopped bool) {
+
+	log := requestLog(r)
+	log.Info("Controlling the container of a service instance", "action",
+		action)
+
+	instanceID := mux.Vars(r)["instance_id"]
+
+	if !beginOperation(instanceID) {
+		log.Warning(errorOperationInProgress)
+		writeResponse(w, http.StatusUnprocessableEntity, model.ErrorResponse{
+			Error:       concurrencyError,
+			Description: errorOperationInProgress,
+		})
+		return
+	}
+	defer endOperation(instanceID)
+
+	instance, ok := broker.Store.Instance(instanceID)
+	if !ok {
+		log.Warning(errorInstanceNotFound)
+		writeResponse(w, http.StatusNotFound, model.ErrorResponse{
+			Description: errorInstanceNotFound,
+		})
+		return
+	}
+
+	err := command(instance.ContainerName)
+	if err == nil && instance.Stopped != stopped {
+		instance.Stopped = stopped
+		err = broker.Store.PutInstance(instance)
+	}
+
+	operator := requestIdentity(r).UserID
+	if err != nil {
+		log.Error("Controlling the container failed", "action", action,
+			"error", err)
+		recordOperation(instanceID, action, "Container "+action+
+			" requested by "+operator, false)
+		writeResponse(w, http.StatusInternalServerError, model.ErrorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+
+	recordOperation(instanceID, action, "Container "+action+
+		" requested by "+operator, true)
+
+	log.Info("Container controlled", "action", action)
+	writeResponse(w, http.StatusOK, newAdminInstance(instance))
+}
+
+// newAdminInstance describes an instance for the administration API.
+func newAdminInstance(instance state.Instance) adminInstance {
+	view := adminInstance{
+		ID:               instance.ID,
+		ServiceID:        instance.ServiceID,
+		PlanID:           instance.PlanID,
+		Plan:             planName(instance.PlanID),
+		OrganizationID:   instance.OrganizationID,
+		SpaceID:          instance.SpaceID,
+		ContainerName:    instance.ContainerName,
+		HostPort:         instance.HostPort,
+		TLS:              instance.TLS,
+		ReplicaSet:       instance.ReplicaSet,
+		Stopped:          instance.Stopped,
+		State:            instance.State,
+		StateDescription: instance.StateDescription,
+		Health:           currentHealth(instance.ID).Status,
+		Bindings:         len(broker.Store.Bindings(instance.ID)),
+		CreatedAt:        instance.CreatedAt,
+	}
+
+	if instance.Stopped {
+		view.Health = "stopped"
+	}
+
+	return view
+}
+
+// newAdminBinding describes a binding for the administration API.
+func newAdminBinding(instance state.Instance,
+	binding state.Binding) adminBinding {
+
+	bindingState := binding.State
+	if bindingState == "" {
+		bindingState = state.OperationSucceeded
+	}
+
+	return adminBinding{
+		ID:             binding.ID,
+		InstanceID:     binding.InstanceID,
+		OrganizationID: instance.OrganizationID,
+		SpaceID:        instance.SpaceID,
+		DatabaseName:   binding.DatabaseName,
+		UserName:       binding.UserName,
+		State:          bindingState,
+		CreatedAt:      binding.CreatedAt,
+	}
+}
@@ -0,0 +1,211 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/audit"
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+	"github.com/cloudfoundry-community/cf-nosql-broker/model"
+	"github.com/gorilla/mux"
+)
+
+const (
+	errorAuditDisabled = "The audit log is not enabled."
+	errorAuditQuery    = "Error reading the audit log."
+	errorAuditTime     = "The from and to parameters must be RFC 3339 times."
+	errorAuditLimit    = "The limit parameter must be a positive integer."
+)
+
+// audited records in the audit log who asked for an action on an instance
+// and its outcome, read from the status code of the response.
+func audited(action string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry := auditEntry(r, action)
+
+		// The organization and space of an instance that is not provisioned
+		// are only known from the provision request
+		if action == audit.Provision && entry.OrganizationID == "" {
+			r = peekProvisionBody(r, &entry)
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		handler(recorder, r)
+
+		if entry.OrganizationID == "" {
+			entry = withInstance(entry)
+		}
+
+		entry.Status = recorder.code
+		switch {
+		case recorder.code == http.StatusAccepted:
+			entry.Outcome = audit.Accepted
+		case recorder.code >= 200 && recorder.code < 300:
+			entry.Outcome = audit.Succeeded
+		default:
+			entry.Outcome = audit.Failed
+		}
+
+		recordAudit(requestLog(r), entry)
+	}
+}
+
+// auditEntry starts the audit entry of an action requested by r, carrying
+// the request ID, the originating identity and the targeted instance.
+func auditEntry(r *http.Request, action string) audit.Entry {
+	identity := requestIdentity(r)
+
+	return withInstance(audit.Entry{
+		RequestID:  requestIDOf(r),
+		Action:     action,
+		InstanceID: mux.Vars(r)["instance_id"],
+		BindingID:  mux.Vars(r)["binding_id"],
+		Platform:   identity.Platform,
+		UserID:     identity.UserID,
+	})
+}
+
+// withInstance completes an audit entry with the service, plan,
+// organization and space of its instance, when the instance is known.
+func withInstance(entry audit.Entry) audit.Entry {
+	instance, ok := broker.Store.Instance(entry.InstanceID)
+	if !ok {
+		return entry
+	}
+
+	entry.ServiceID = instance.ServiceID
+	entry.PlanID = instance.PlanID
+	entry.OrganizationID = instance.OrganizationID
+	entry.SpaceID = instance.SpaceID
+
+	return entry
+}
+
+// peekProvisionBody reads the service, plan, organization and space of a
+// provision request into an audit entry and returns the request with its
+// body restored for the handler.
+func peekProvisionBody(r *http.Request, entry *audit.Entry) *http.Request {
+	content, err := ioutil.ReadAll(r.Body)
+	r.Body.Close() // nolint: errcheck
+	r.Body = ioutil.NopCloser(bytes.NewReader(content))
+	if err != nil {
+		return r
+	}
+
+	var body model.ProvisionBody
+	if json.Unmarshal(content, &body) == nil {
+		entry.ServiceID = body.ServiceID
+		entry.PlanID = body.PlanID
+		entry.OrganizationID = body.OrganizationID
+		entry.SpaceID = body.SpaceID
+	}
+
+	return r
+}
+
+// recordAudit appends an entry to the audit log, if enabled. A failure is
+// logged with the entry so it is not lost.
+func recordAudit(log *logging.Logger, entry audit.Entry) {
+	if broker.Audit == nil {
+		return
+	}
+
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+
+	if err := broker.Audit.Append(entry); err != nil {
+		log.Error("Recording the audit entry failed", "error", err,
+			"action", entry.Action, "outcome", entry.Outcome)
+	}
+}
+
+// ListAudit returns the audit log entries, newest first, optionally filtered
+// by instance_id, user_id, organization_guid and a from and to time range,
+// and bounded by limit.
+func ListAudit(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Querying the audit log")
+
+	if broker.Audit == nil {
+		log.Warning(errorAuditDisabled)
+		writeResponse(w, http.StatusNotFound, model.ErrorResponse{
+			Description: errorAuditDisabled,
+		})
+		return
+	}
+
+	query := r.URL.Query()
+	filter := audit.Filter{
+		InstanceID:     query.Get("instance_id"),
+		UserID:         query.Get("user_id"),
+		OrganizationID: query.Get("organization_guid"),
+	}
+
+	var err error
+	filter.From, err = parseAuditTime(query.Get("from"))
+
+	if err == nil {
+		filter.To, err = parseAuditTime(query.Get("to"))
+	}
+	if err != nil {
+		log.Warning("Invalid request", "error", err)
+		writeResponse(w, http.StatusBadRequest, model.ErrorResponse{
+			Description: errorAuditTime,
+		})
+		return
+	}
+
+	if value := query.Get("limit"); value != "" {
+		filter.Limit, err = strconv.Atoi(value)
+		if err != nil || filter.Limit <= 0 {
+			log.Warning("Invalid request", "limit", value)
+			writeResponse(w, http.StatusBadRequest, model.ErrorResponse{
+				Description: errorAuditLimit,
+			})
+			return
+		}
+	}
+
+	entries, err := broker.Audit.Query(filter)
+	if err != nil {
+		log.Error("Querying the audit log failed", "error", err)
+		writeResponse(w, http.StatusInternalServerError, model.ErrorResponse{
+			Description: errorAuditQuery,
+		})
+		return
+	}
+
+	log.Info("Audit log queried", "count", len(entries))
+	writeResponse(w, http.StatusOK, entries)
+}
+
+// parseAuditTime parses a bound of the audit log time range, zero when it is
+// not given.
+func parseAuditTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
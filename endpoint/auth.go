@@ -0,0 +1,53 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/model"
+)
+
+const errorPlatformUnauthorized = "Valid broker credentials are required."
+
+// platformAuth restricts a handler of the service broker API to the platform,
+// which authenticates with the credentials the broker was registered with.
+// The API stays open when no credentials are configured.
+func platformAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if broker.UserName == "" && broker.Password == "" {
+			handler(w, r)
+			return
+		}
+
+		userName, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(userName),
+			[]byte(broker.UserName)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password),
+				[]byte(broker.Password)) != 1 {
+			requestLog(r).Warning(errorPlatformUnauthorized)
+			w.Header().Set("WWW-Authenticate", `Basic realm="cf-nosql-broker"`)
+			writeResponse(w, http.StatusUnauthorized, model.ErrorResponse{
+				Description: errorPlatformUnauthorized,
+			})
+			return
+		}
+
+		handler(w, r)
+	}
+}
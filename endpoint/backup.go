@@ -0,0 +1,385 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/backup"
+	"github.com/cloudfoundry-community/cf-nosql-broker/database"
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+	"github.com/cloudfoundry-community/cf-nosql-broker/model"
+	"github.com/cloudfoundry-community/cf-nosql-broker/state"
+	"github.com/gorilla/mux"
+)
+
+const (
+	backupError        = "Error creating the backup."
+	restoreError       = "Error restoring the backup."
+	errorRestoreSource = "The backup does not exist or cannot be restored in this space." // nolint: lll
+	errorRestoreAccess = "the backup belongs to another organization or space"
+	errorRestoreEngine = "the backup was taken from another service"
+
+	// restoreReadyTimeout bounds the wait for a new instance to accept the
+	// restore.
+	restoreReadyTimeout = 2 * time.Minute
+)
+
+// rewrapResponse reports how many data keys RewrapBackupKeys updated.
+type rewrapResponse struct {
+	Rewrapped int `json:"rewrapped"`
+}
+
+// backupSchedules holds the parsed backup schedule of every plan.
+var backupSchedules = map[string]*backup.Schedule{}
+
+// parseBackupSchedules validates the cron expressions of the plans.
+func parseBackupSchedules() error {
+	for planID, options := range plans {
+		if options.BackupSchedule == "" {
+			continue
+		}
+
+		schedule, err := backup.ParseSchedule(options.BackupSchedule)
+		if err != nil {
+			return err
+		}
+		backupSchedules[planID] = schedule
+	}
+
+	return nil
+}
+
+// scheduleBackups starts the backups of the instances whose plan schedule
+// matches the current minute.
+func scheduleBackups() {
+	for {
+		now := time.Now()
+		if !pause(now.Truncate(time.Minute).Add(time.Minute).Sub(now)) {
+			return
+		}
+
+		minute := time.Now().Truncate(time.Minute)
+		for _, instance := range broker.Store.Instances() {
+			schedule, ok := backupSchedules[instance.PlanID]
+			if ok && schedule.Matches(minute) {
+				instance := instance
+				startTask(func() {
+					runBackup(instance, backup.TriggerScheduled) // nolint: errcheck
+				})
+			}
+		}
+	}
+}
+
+// runBackup takes a backup of an instance and records the outcome in its
+// operations history.
+func runBackup(instance state.Instance, trigger string) (backup.Backup, error) {
+	log := logging.With("operation", "backup", "instance_id", instance.ID,
+		"trigger", trigger)
+	server, engine, err := instanceServer(instance)
+
+	var taken backup.Backup
+	if err == nil {
+		taken, err = broker.Backups.Create(instance, server, engine, trigger)
+	}
+
+	if err != nil {
+		log.Error("Backup failed", "error", err)
+		recordOperation(instance.ID, "backup", "The "+trigger+" backup failed",
+			false)
+		return backup.Backup{}, err
+	}
+
+	log.Info("Backup completed", "backup_id", taken.ID)
+	recordOperation(instance.ID, "backup", "The "+trigger+" backup "+taken.ID+
+		" completed", true)
+
+	pruneBackups(instance)
+	return taken, nil
+}
+
+// pruneBackups deletes the backups of an instance its plan retention no
+// longer keeps.
+func pruneBackups(instance state.Instance) {
+	deleted, err := broker.Backups.ApplyRetention(instance.ID,
+		plans[instance.PlanID].BackupRetention)
+	backupsPruned.Add(float64(len(deleted)))
+	log := logging.With("operation", "prune_backups", "instance_id",
+		instance.ID)
+	if err != nil {
+		log.Warning("Pruning the backups failed", "error", err)
+	}
+
+	for _, pruned := range deleted {
+		log.Info("Backup removed by the retention rules", "backup_id",
+			pruned.ID)
+	}
+}
+
+// CreateBackup takes an on demand backup of an instance.
+func CreateBackup(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Backing up a service instance")
+
+	instanceID := mux.Vars(r)["instance_id"]
+
+	instance, ok := broker.Store.Instance(instanceID)
+	if !ok {
+		log.Warning(errorInstanceNotFound)
+		response := model.ErrorResponse{
+			Description: errorInstanceNotFound,
+		}
+		writeResponse(w, http.StatusNotFound, response)
+		return
+	}
+
+	taken, err := runBackup(instance, backup.TriggerManual)
+	if err != nil {
+		response := model.ErrorResponse{
+			Description: backupError,
+		}
+		writeResponse(w, http.StatusInternalServerError, response)
+		return
+	}
+
+	log.Info("Backup completed", "backup_id", taken.ID)
+	writeResponse(w, http.StatusCreated, taken)
+}
+
+// ListBackups returns the backups of an instance, newest first.
+func ListBackups(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Listing the backups of a service instance")
+
+	instanceID := mux.Vars(r)["instance_id"]
+
+	backups, err := broker.Backups.List(instanceID)
+	if err != nil {
+		log.Error("Listing the backups failed", "error", err)
+		response := model.ErrorResponse{
+			Description: err.Error(),
+		}
+		writeResponse(w, http.StatusInternalServerError, response)
+		return
+	}
+
+	log.Info("Backups listed")
+	writeResponse(w, http.StatusOK, backups)
+}
+
+// RestoreBackup restores a backup into a running instance, replacing the
+// collections it contains. The source is named like the restore_from
+// provision parameter; a timestamp without instance restores the instance
+// to that point in time.
+func RestoreBackup(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Restoring a backup into a service instance")
+
+	instanceID := mux.Vars(r)["instance_id"]
+
+	var source model.RestoreSource
+	err := json.NewDecoder(r.Body).Decode(&source)
+	defer r.Body.Close() // nolint: errcheck
+	if err == nil {
+		if source.BackupID == "" && source.InstanceID == "" {
+			source.InstanceID = instanceID
+		}
+		err = validateRestoreSource(&source)
+	}
+	if err != nil {
+		log.Warning("Invalid request", "error", err)
+		writeResponse(w, http.StatusBadRequest, model.ErrorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+
+	if !beginOperation(instanceID) {
+		log.Warning(errorOperationInProgress)
+		writeResponse(w, http.StatusUnprocessableEntity, model.ErrorResponse{
+			Error:       concurrencyError,
+			Description: errorOperationInProgress,
+		})
+		return
+	}
+	defer endOperation(instanceID)
+
+	instance, ok := broker.Store.Instance(instanceID)
+	if !ok {
+		log.Warning(errorInstanceNotFound)
+		writeResponse(w, http.StatusNotFound, model.ErrorResponse{
+			Description: errorInstanceNotFound,
+		})
+		return
+	}
+
+	resolved, err := resolveRestoreSource(&model.ProvisionBody{
+		ServiceID:      instance.ServiceID,
+		OrganizationID: instance.OrganizationID,
+		SpaceID:        instance.SpaceID,
+		Parameters:     model.ProvisionParameters{RestoreFrom: &source},
+	})
+	if err != nil {
+		log.Warning("Invalid restore source", "error", err)
+		writeResponse(w, http.StatusUnprocessableEntity, model.ErrorResponse{
+			Description: errorRestoreSource,
+		})
+		return
+	}
+
+	server, engine, err := instanceServer(instance)
+	if err == nil {
+		err = restoreBackup(server, engine, *resolved)
+	}
+
+	if err != nil {
+		log.Error("Error restoring the backup", "backup_id",
+			resolved.Backup.ID, "error", err)
+		recordOperation(instanceID, "restore", "Restore of backup "+
+			resolved.Backup.ID, false)
+		writeResponse(w, http.StatusInternalServerError, model.ErrorResponse{
+			Description: restoreError,
+		})
+		return
+	}
+
+	recordOperation(instanceID, "restore", "Restore of backup "+
+		resolved.Backup.ID, true)
+
+	log.Info("Backup restored", "backup_id", resolved.Backup.ID)
+	writeResponse(w, http.StatusOK, appliedRestoreSource(*resolved))
+}
+
+// restoreSource is the backup a new instance is seeded from and, for point
+// in time restores, the moment its archived oplog is replayed up to.
+type restoreSource struct {
+	Backup      backup.Backup
+	PointInTime time.Time
+}
+
+// RewrapBackupKeys wraps the data keys of the encrypted backups with the
+// current master key, after it was rotated.
+func RewrapBackupKeys(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Re-wrapping the backup data keys")
+
+	rewrapped, err := broker.Backups.RewrapKeys()
+	if err != nil {
+		log.Error("Re-wrapping the data keys failed", "error", err)
+		response := model.ErrorResponse{
+			Description: err.Error(),
+		}
+		writeResponse(w, http.StatusInternalServerError, response)
+		return
+	}
+
+	log.Info("Backup data keys re-wrapped", "count", rewrapped)
+
+	writeResponse(w, http.StatusOK, rewrapResponse{Rewrapped: rewrapped})
+}
+
+// resolveRestoreSource finds the backup requested by the restore_from
+// parameter and checks the requesting space may read it: only backups taken
+// from instances of the same organization and space can be restored. A
+// timestamp restores the latest backup taken before it and, when the source
+// instance is a replica set, replays its oplog up to that time.
+func resolveRestoreSource(body *model.ProvisionBody) (*restoreSource, error) {
+	source := body.Parameters.RestoreFrom
+
+	var found backup.Backup
+	var at time.Time
+	var err error
+	if source.BackupID != "" {
+		found, err = broker.Backups.Get(source.BackupID)
+	} else {
+		// The timestamp format was checked by validateRestoreSource
+		at, _ = time.Parse(time.RFC3339, source.Timestamp)
+		found, err = broker.Backups.Find(source.InstanceID, at)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if found.OrganizationID != body.OrganizationID ||
+		found.SpaceID != body.SpaceID {
+		return nil, errors.New(errorRestoreAccess)
+	}
+
+	if found.ServiceID != body.ServiceID {
+		return nil, errors.New(errorRestoreEngine)
+	}
+
+	resolved := &restoreSource{Backup: found}
+	if !at.IsZero() && found.OplogTimestamp != nil {
+		// The coverage is checked now so a restore never silently stops
+		// short of the requested time. The segments themselves are only
+		// downloaded by the restore
+		if _, _, err = broker.Backups.CheckOplog(found, at); err != nil {
+			return nil, err
+		}
+		resolved.PointInTime = at
+	}
+
+	return resolved, nil
+}
+
+// appliedRestoreSource describes the restore as performed: the backup
+// actually restored and, for point in time restores, the time replayed to.
+func appliedRestoreSource(source restoreSource) model.RestoreSource {
+	applied := model.RestoreSource{BackupID: source.Backup.ID}
+	if !source.PointInTime.IsZero() {
+		applied.InstanceID = source.Backup.InstanceID
+		applied.Timestamp = source.PointInTime.UTC().Format(time.RFC3339)
+	}
+
+	return applied
+}
+
+// restoreBackup loads a backup into a freshly started instance once it is
+// ready to accept connections, then replays the archived oplog for point in
+// time restores.
+func restoreBackup(server database.Server, engine database.Engine,
+	source restoreSource) error {
+
+	if err := engine.WaitReady(server, restoreReadyTimeout); err != nil {
+		return err
+	}
+
+	archive, err := broker.Backups.Open(source.Backup)
+	if err != nil {
+		return err
+	}
+	defer archive.Close() // nolint: errcheck
+
+	err = engine.Restore(server, source.Backup.Format, archive)
+	if err != nil || source.PointInTime.IsZero() {
+		return err
+	}
+
+	oplog, limit, err := broker.Backups.OpenOplog(source.Backup,
+		source.PointInTime)
+	if err != nil {
+		return err
+	}
+	defer oplog.Close() // nolint: errcheck
+
+	return engine.ReplayOplog(server, oplog, limit)
+}
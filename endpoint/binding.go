@@ -0,0 +1,230 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/audit"
+	"github.com/cloudfoundry-community/cf-nosql-broker/database"
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+	"github.com/cloudfoundry-community/cf-nosql-broker/model"
+	"github.com/cloudfoundry-community/cf-nosql-broker/security"
+	"github.com/cloudfoundry-community/cf-nosql-broker/state"
+	"github.com/gorilla/mux"
+)
+
+const (
+	bindOperation          = "bind"
+	errorBindingNotFound   = "The service binding does not exist."
+	errorBindingInProgress = "The service binding is still being created."
+	concurrencyError       = "ConcurrencyError"
+)
+
+// GetBinding returns the credentials and parameters of a binding once its
+// database user has been created.
+func GetBinding(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Fetching a service binding")
+
+	instanceID := mux.Vars(r)["instance_id"]
+	bindingID := mux.Vars(r)["binding_id"]
+
+	instance, instanceFound := broker.Store.Instance(instanceID)
+	binding, ok := broker.Store.Binding(bindingID)
+	if !instanceFound || !ok || binding.InstanceID != instanceID ||
+		!binding.Ready() {
+		log.Warning(errorBindingNotFound)
+		response := model.ErrorResponse{
+			Description: errorBindingNotFound,
+		}
+		writeResponse(w, http.StatusNotFound, response)
+		return
+	}
+
+	password, err := security.Unseal(broker.SecretKey, binding.Password)
+	if err != nil {
+		log.Error("Error unsealing credentials", "error", err)
+		response := model.ErrorResponse{
+			Description: bindError,
+		}
+		writeResponse(w, http.StatusInternalServerError, response)
+		return
+	}
+
+	response := model.FetchBindingResponse{
+		Credentials: bindingCredentials(instance, binding, password),
+		Parameters: map[string]string{
+			"name":     binding.DatabaseName,
+			"username": binding.UserName,
+		},
+	}
+
+	log.Info("Service binding fetched")
+	writeResponse(w, http.StatusOK, response)
+}
+
+// BindingLastOperation reports the state of the creation of a binding
+// accepted asynchronously.
+func BindingLastOperation(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Polling a service binding operation")
+
+	instanceID := mux.Vars(r)["instance_id"]
+	bindingID := mux.Vars(r)["binding_id"]
+
+	binding, ok := broker.Store.Binding(bindingID)
+	if !ok || binding.InstanceID != instanceID {
+		log.Warning("The service binding does not exist")
+		writeResponse(w, http.StatusGone, struct{}{})
+		return
+	}
+
+	response := model.LastOperationResponse{
+		State:       binding.State,
+		Description: binding.StateDescription,
+	}
+	if response.State == "" {
+		response.State = state.OperationSucceeded
+	}
+
+	log.Info("Service binding operation polled", "state", response.State)
+	writeResponse(w, http.StatusOK, response)
+}
+
+// respondExistingBinding answers a bind request for a binding that already
+// exists: identical requests get the same response again, as the broker API
+// requires, and any other one is a conflict.
+func respondExistingBinding(w http.ResponseWriter, log *logging.Logger,
+	instance state.Instance, binding state.Binding, body *model.BindBody) {
+
+	password, err := security.Unseal(broker.SecretKey, binding.Password)
+	identical := err == nil && binding.InstanceID == instance.ID &&
+		binding.DatabaseName == body.Database.Name &&
+		binding.UserName == body.Database.UserName &&
+		password == body.Database.Password
+
+	switch {
+	case identical && binding.State == state.OperationInProgress:
+		log.Info(errorBindingInProgress)
+		writeResponse(w, http.StatusAccepted, model.OperationResponse{
+			Operation: bindOperation,
+		})
+
+	case identical && binding.Ready():
+		log.Info("The service binding already exists")
+		writeResponse(w, http.StatusOK, model.BindResponse{
+			Credentials: bindingCredentials(instance, binding, password),
+		})
+
+	default:
+		log.Warning(errorBindingExists)
+		response := model.ErrorResponse{
+			Description: errorBindingExists,
+		}
+		writeResponse(w, http.StatusConflict, response)
+	}
+}
+
+// createBindingUser creates the database user of a binding accepted
+// asynchronously and records the outcome for the last operation endpoint.
+func createBindingUser(log *logging.Logger, entry audit.Entry,
+	server database.Server, engine database.Engine, binding state.Binding,
+	password string) {
+
+	err := engine.CreateUser(server, binding.DatabaseName, binding.UserName,
+		password)
+	if err != nil {
+		log.Error("Error creating the database user", "error", err)
+		dropPartialBindingUser(log, server, engine, binding)
+		binding.State = state.OperationFailed
+		binding.StateDescription = bindError
+	} else {
+		binding.State = state.OperationSucceeded
+		binding.StateDescription = ""
+	}
+
+	if err = broker.Store.PutBinding(binding); err != nil {
+		log.Error("Error saving the binding", "error", err)
+		return
+	}
+
+	entry.Outcome = audit.Succeeded
+	if binding.State == state.OperationFailed {
+		entry.Outcome = audit.Failed
+		entry.Description = bindError
+	}
+	recordAudit(log, entry)
+
+	if binding.State == state.OperationFailed {
+		recordOperation(binding.InstanceID, "bind", "Binding "+binding.ID,
+			false)
+		return
+	}
+
+	recordOperation(binding.InstanceID, "bind", "Binding "+binding.ID+
+		" as user "+binding.UserName+" on database "+binding.DatabaseName, true)
+}
+
+// dropPartialBindingUser removes the user of a failed binding, which exists
+// when the creation failed after reaching the database, for example on a
+// timeout. Most of the time there is no user and the removal fails.
+func dropPartialBindingUser(log *logging.Logger, server database.Server,
+	engine database.Engine, binding state.Binding) {
+
+	err := engine.DropUser(server, binding.DatabaseName, binding.UserName)
+	if err != nil {
+		log.Info("No user removed for the failed binding", "error", err)
+		return
+	}
+
+	log.Info("Removed the user created by the failed binding")
+}
+
+// bindingCredentials builds the credentials handed to the applications
+// bound to an instance.
+func bindingCredentials(instance state.Instance, binding state.Binding,
+	password string) model.Credentials {
+
+	credentials := model.Credentials{
+		ConnectionString: "MONGO_URL=mongodb://" + binding.UserName + ":" +
+			password + "@" + broker.Hostname + ":" +
+			instance.HostPort + "/" + binding.DatabaseName,
+		UserName:     binding.UserName,
+		Password:     password,
+		Hostname:     broker.Hostname,
+		Port:         instance.HostPort,
+		DatabaseName: binding.DatabaseName,
+	}
+
+	// The replica set member is only known by its name inside the
+	// container, the clients must not try to discover it
+	options := []string{}
+	if instance.ReplicaSet {
+		options = append(options, "directConnection=true")
+	}
+	if instance.TLS {
+		options = append(options, "tls=true")
+		credentials.CACertificate = string(broker.Authority.CertificatePEM())
+	}
+	if len(options) > 0 {
+		credentials.ConnectionString += "?" + strings.Join(options, "&")
+	}
+
+	return credentials
+}
@@ -0,0 +1,249 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/container"
+	"github.com/cloudfoundry-community/cf-nosql-broker/model"
+	"github.com/cloudfoundry-community/cf-nosql-broker/security"
+	"github.com/cloudfoundry-community/cf-nosql-broker/state"
+	"github.com/gorilla/mux"
+)
+
+const (
+	dashboardPath         = "/dashboard/"
+	dashboardTokenSubject = "dashboard:"
+	errorDashboardAccess  = "The dashboard link is not valid or has expired."
+	unavailable           = "unavailable"
+)
+
+// dashboardPage holds the values rendered by dashboardTemplate.
+type dashboardPage struct {
+	Instance   state.Instance
+	Plan       string
+	Status     string
+	Uptime     string
+	Storage    string
+	Health     string
+	Bindings   []state.Binding
+	Operations []state.Operation
+	HealthLog  []state.HealthEvent
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Instance.ContainerName}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{.Instance.ContainerName}}</h1>
+<table>
+<tr><th>Status</th><td>{{.Status}}</td></tr>
+<tr><th>Health</th><td>{{.Health}}</td></tr>
+<tr><th>Uptime</th><td>{{.Uptime}}</td></tr>
+<tr><th>Plan</th><td>{{.Plan}}</td></tr>
+<tr><th>Port</th><td>{{.Instance.HostPort}}</td></tr>
+<tr><th>TLS</th><td>{{.Instance.TLS}}</td></tr>
+<tr><th>Storage</th><td>{{.Storage}}</td></tr>
+<tr><th>Created</th><td>{{.Instance.CreatedAt.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+</table>
+<h2>Bindings</h2>
+<table>
+<tr><th>Binding</th><th>Database</th><th>User</th><th>Created</th></tr>
+{{range .Bindings}}<tr><td>{{.ID}}</td><td>{{.DatabaseName}}</td><td>{{.UserName}}</td><td>{{.CreatedAt.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+{{else}}<tr><td colspan="4">No bindings</td></tr>
+{{end}}</table>
+<h2>Recent operations</h2>
+<table>
+<tr><th>Time</th><th>Operation</th><th>Result</th><th>Description</th></tr>
+{{range .Operations}}<tr><td>{{.Time.Format "2006-01-02 15:04:05 MST"}}</td><td>{{.Type}}</td><td>{{if .Succeeded}}succeeded{{else}}failed{{end}}</td><td>{{.Description}}</td></tr>
+{{else}}<tr><td colspan="4">No operations</td></tr>
+{{end}}</table>
+<h2>Health history</h2>
+<table>
+<tr><th>Time</th><th>Status</th><th>Description</th></tr>
+{{range .HealthLog}}<tr><td>{{.Time.Format "2006-01-02 15:04:05 MST"}}</td><td>{{.Status}}</td><td>{{.Description}}</td></tr>
+{{else}}<tr><td colspan="3">No health events</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// Dashboard renders the status page of a service instance. Access requires
+// a link signed by DashboardLink or, when single sign-on is configured, a
+// session opened through the platform UAA.
+func Dashboard(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Showing a service instance dashboard")
+
+	instanceID := mux.Vars(r)["instance_id"]
+
+	// The token travels in the URL, keep it out of caches and referrers
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy",
+		"default-src 'none'; style-src 'unsafe-inline'")
+
+	// Signed links are always accepted, otherwise the user must sign on
+	// through the platform when it is configured
+	err := security.VerifyToken(broker.SigningKey,
+		dashboardTokenSubject+instanceID, r.FormValue("token"), time.Now())
+	if err != nil && broker.SSO != nil {
+		if !hasSSOSession(r, instanceID) {
+			redirectToSSO(w, r, instanceID)
+			return
+		}
+		err = nil
+	}
+
+	if err != nil {
+		log.Warning("Dashboard access denied", "error", err)
+		http.Error(w, errorDashboardAccess, http.StatusForbidden)
+		return
+	}
+
+	instance, ok := broker.Store.Instance(instanceID)
+	if !ok {
+		log.Warning(errorInstanceNotFound)
+		http.Error(w, errorInstanceNotFound, http.StatusNotFound)
+		return
+	}
+
+	page := dashboardPage{
+		Instance:   instance,
+		Plan:       planName(instance.PlanID),
+		Status:     unavailable,
+		Uptime:     unavailable,
+		Storage:    unavailable,
+		Health:     currentHealth(instanceID).Status,
+		Bindings:   broker.Store.Bindings(instanceID),
+		Operations: broker.Store.Operations(instanceID),
+		HealthLog:  broker.Store.HealthEvents(instanceID),
+	}
+
+	if instance.State == state.OperationFailed {
+		page.Health = instance.StateDescription
+	}
+
+	containerState, err := container.Inspect(instance.ContainerName)
+	if err == nil {
+		page.Status = containerState.Status
+		if containerState.Running {
+			page.Uptime = time.Since(containerState.StartedAt).
+				Truncate(time.Second).String()
+		}
+	} else {
+		log.Warning("Inspecting the container failed", "error", err)
+	}
+
+	server, engine, err := instanceServer(instance)
+	if err == nil && containerState.Running {
+		var size int64
+		size, err = engine.StorageSize(server)
+		if err == nil {
+			page.Storage = formatBytes(size)
+		}
+	}
+	if err != nil {
+		log.Warning("Reading the storage usage failed", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err = dashboardTemplate.Execute(w, page); err != nil {
+		log.Error("Error rendering the dashboard", "error", err)
+		return
+	}
+
+	log.Info("Dashboard rendered")
+}
+
+// DashboardLink redirects an operator to the dashboard of an instance
+// through a link signed for the configured time.
+func DashboardLink(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Signing a dashboard link")
+
+	instanceID := mux.Vars(r)["instance_id"]
+	if _, ok := broker.Store.Instance(instanceID); !ok {
+		log.Warning(errorInstanceNotFound)
+		writeResponse(w, http.StatusNotFound, model.ErrorResponse{
+			Description: errorInstanceNotFound,
+		})
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, signedDashboardURL(instanceID), http.StatusFound)
+}
+
+// dashboardURL returns the dashboard address of an instance without token,
+// which never expires: the platform users open it through single sign-on
+// and the operators through DashboardLink.
+func dashboardURL(instanceID string) string {
+	return broker.URL + dashboardPath + instanceID
+}
+
+// platformDashboardURL returns the dashboard address of an instance given to
+// the platform: the token-free one when single sign-on lets the platform
+// users in, a signed one otherwise, as they would have no other way in.
+func platformDashboardURL(instanceID string) string {
+	if broker.SSO == nil {
+		return signedDashboardURL(instanceID)
+	}
+
+	return dashboardURL(instanceID)
+}
+
+// signedDashboardURL returns the dashboard address of an instance including a
+// token valid for the configured time.
+func signedDashboardURL(instanceID string) string {
+	token := security.SignToken(broker.SigningKey,
+		dashboardTokenSubject+instanceID, time.Now().Add(broker.DashboardTTL))
+
+	return dashboardURL(instanceID) + "?token=" + url.QueryEscape(token)
+}
+
+// formatBytes returns a human readable size.
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return strconv.FormatInt(size, 10) + " B"
+	}
+
+	value, suffix := float64(size), "B"
+	for _, s := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		if value < unit {
+			break
+		}
+		value, suffix = value/unit, s
+	}
+
+	return strconv.FormatFloat(value, 'f', 1, 64) + " " + suffix
+}
@@ -20,44 +20,61 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
-	"log"
 	"net/http"
-	"os/exec"
-	"sort"
 	"strconv"
-	"strings"
+	"time"
 
+	"github.com/cloudfoundry-community/cf-nosql-broker/audit"
+	"github.com/cloudfoundry-community/cf-nosql-broker/container"
+	"github.com/cloudfoundry-community/cf-nosql-broker/database"
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
 	"github.com/cloudfoundry-community/cf-nosql-broker/model"
+	"github.com/cloudfoundry-community/cf-nosql-broker/security"
+	"github.com/cloudfoundry-community/cf-nosql-broker/state"
 	"github.com/gorilla/mux"
 )
 
 const (
 	provisionError        = "Error creating the database service."
 	deprovisionError      = "Error deleting the database service."
+	bindError             = "Error creating the database credentials."
+	unbindError           = "Error deleting the database credentials."
 	errorEmptyBodyRequest = "Please send a request body."
+	errorInstanceExists   = "The service instance already exists."
+	errorInstanceNotFound = "The service instance does not exist."
+	errorBindingExists    = "The service binding already exists."
+	errorServiceNotFound  = "The service is not offered by this broker."
+	errorPlanNotFound     = "The plan is not offered by this broker."
+
+	mongoServiceID      = "011ca270-ad21-44e2-95d6-60c70a840a80"
+	adminUserName       = "cf-nosql-broker"
+	adminPasswordLength = 32
+	replicaSetKeyLength = 64
+
+	errorNoPortAvailable = "no port is left in the pool"
 )
 
+// engines maps the catalog services to the database engine running them,
+// Start sets the image configured for MongoDB.
+var engines = map[string]database.Engine{
+	mongoServiceID: database.MongoDB{},
+}
+
 // GetCatalog returns the NoSQL database services offered.
 func GetCatalog(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[REQUEST] Getting catalog "+
-		"{ Hostname: %s, URI: %s, Method: %s, Agent: %s } \n",
-		r.RemoteAddr, r.RequestURI, r.Method, r.UserAgent())
+	log := requestLog(r)
+	log.Info("Getting catalog")
 
-	plans := []model.ServicePlan{
-		{
-			Name:        "Standard",
-			ID:          "4f79aa95-b5ca-4030-a263-c58cb2c61dfc",
-			Description: "MongoDB database",
-			Metadata:    nil,
-			Free:        true,
-			Bindable:    true,
-		},
-	}
+	log.Info("Service catalog fetched")
+	writeResponse(w, http.StatusOK, catalog())
+}
 
+// catalog describes the services and plans offered by the broker.
+func catalog() model.Catalog {
 	services := []model.Service{
 		{
 			Name:            "MongoDB",
-			ID:              "011ca270-ad21-44e2-95d6-60c70a840a80",
+			ID:              mongoServiceID,
 			Description:     "MongoDB database service based on Docker containers",
 			Tags:            []string{"database", "no-sql", "container-based"},
 			Requires:        []string{},
@@ -65,33 +82,36 @@ func GetCatalog(w http.ResponseWriter, r *http.Request) {
 			Metadata:        nil,
 			DashboardClient: nil,
 			PlanUpdateable:  true,
-			Plans:           plans,
+			Plans:           servicePlans,
+			// The instances and bindings are fetched from the broker state
+			InstancesRetrievable: true,
+			BindingsRetrievable:  true,
 		},
 	}
 
-	catalog := model.Catalog{
-		Services: services,
+	// A nil pointer in the interface field would be encoded as null
+	if client := dashboardClient(); client != nil {
+		services[0].DashboardClient = client
 	}
 
-	log.Println("[RESPONSE] OK: Service catalog fetched.")
-	writeResponse(w, http.StatusOK, catalog)
+	return model.Catalog{
+		Services: services,
+	}
 }
 
 // Provision starts the database service creation using Docker commands.
 func Provision(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[REQUEST] Provisioning a database service "+
-		"{ Hostname: %s, URI: %s, Method: %s, Agent: %s } \n",
-		r.RemoteAddr, r.RequestURI, r.Method, r.UserAgent())
+	log := requestLog(r)
+	log.Info("Provisioning a database service")
 
 	instanceID := mux.Vars(r)["instance_id"]
-	command := "docker"
 
 	var body *model.ProvisionBody
 	bodyErr := json.NewDecoder(r.Body).Decode(&body)
 	defer r.Body.Close() // nolint: errcheck
 
 	if bodyErr == io.EOF {
-		log.Println("[RESPONSE] Error: " + bodyErr.Error())
+		log.Warning("Empty request body", "error", bodyErr)
 		response := model.ErrorResponse{
 			Description: errorEmptyBodyRequest,
 		}
@@ -101,7 +121,7 @@ func Provision(w http.ResponseWriter, r *http.Request) {
 
 	err := validateProvisionInputs(body, instanceID)
 	if err != nil {
-		log.Println("[RESPONSE] Error: " + err.Error())
+		log.Warning("Invalid request", "error", err)
 		response := model.ErrorResponse{
 			Description: err.Error(),
 		}
@@ -109,26 +129,139 @@ func Provision(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	port, err := nextAvailablePort()
+	if !beginOperation(instanceID) {
+		// The platform repeats an accepted provision it has no answer for
+		if operation, ok := provisionState(instanceID); ok &&
+			operation.State == state.OperationInProgress {
+			log.Info("The database service is being created")
+			writeResponse(w, http.StatusAccepted, model.ProvisionResponse{
+				DashboardURL: platformDashboardURL(instanceID),
+				Operation:    provisionOperation,
+			})
+			return
+		}
 
-	if err != nil {
-		log.Println("[RESPONSE] Error: " + err.Error())
+		log.Warning(errorOperationInProgress)
 		response := model.ErrorResponse{
-			Description: provisionError,
+			Error:       concurrencyError,
+			Description: errorOperationInProgress,
 		}
-		writeResponse(w, http.StatusInternalServerError, response)
+		writeResponse(w, http.StatusUnprocessableEntity, response)
 		return
 	}
 
-	containerPort := port + ":27017"
-	containerName := "cf-mongo-" + instanceID
-	_, err = exec.Command(command, "run", "-d",
-		"--name", containerName,
-		"-p", containerPort, "mongo").Output()
+	// An accepted provision releases the instance once completed in the
+	// background
+	handedOver := false
+	defer func() {
+		if !handedOver {
+			endOperation(instanceID)
+		}
+	}()
+
+	if instance, ok := broker.Store.Instance(instanceID); ok {
+		if instance.ServiceID == body.ServiceID &&
+			instance.PlanID == body.PlanID &&
+			instance.OrganizationID == body.OrganizationID &&
+			instance.SpaceID == body.SpaceID {
+			log.Info("The database service already exists")
+			writeResponse(w, http.StatusOK, model.ProvisionResponse{
+				DashboardURL: platformDashboardURL(instanceID),
+			})
+			return
+		}
 
+		log.Warning(errorInstanceExists)
+		response := model.ErrorResponse{
+			Description: errorInstanceExists,
+		}
+		writeResponse(w, http.StatusConflict, response)
+		return
+	}
+
+	engine, ok := engines[body.ServiceID]
+	if !ok {
+		log.Warning(errorServiceNotFound)
+		response := model.ErrorResponse{
+			Description: errorServiceNotFound,
+		}
+		writeResponse(w, http.StatusBadRequest, response)
+		return
+	}
+
+	options, ok := plans[body.PlanID]
+	if !ok {
+		log.Warning(errorPlanNotFound)
+		response := model.ErrorResponse{
+			Description: errorPlanNotFound,
+		}
+		writeResponse(w, http.StatusBadRequest, response)
+		return
+	}
+
+	// The backup to restore is resolved, and access to it checked, before
+	// any resource is created
+	var source *restoreSource
+	if body.Parameters.RestoreFrom != nil {
+		source, err = resolveRestoreSource(body)
+		if err != nil {
+			log.Warning("Invalid restore source", "error", err)
+			response := model.ErrorResponse{
+				Description: errorRestoreSource,
+			}
+			writeResponse(w, http.StatusBadRequest, response)
+			return
+		}
+	}
+
+	request := provisionRequest{
+		instanceID: instanceID,
+		body:       body,
+		engine:     engine,
+		options:    options,
+		source:     source,
+	}
+	forgetProvision(log, instanceID)
+
+	// When the platform accepts it, the container is started and the backup
+	// restored in the background while the platform polls the instance last
+	// operation
+	if r.FormValue("accepts_incomplete") == "true" {
+		// The provision is persisted so its outcome survives a restart
+		if err = acceptProvision(instanceID); err != nil {
+			log.Error("Error saving the provision", "error", err)
+			response := model.ErrorResponse{
+				Description: provisionError,
+			}
+			writeResponse(w, http.StatusInternalServerError, response)
+			return
+		}
+
+		entry := auditEntry(r, audit.Provision)
+		entry.OrganizationID = body.OrganizationID
+		entry.SpaceID = body.SpaceID
+		handedOver = startTask(func() {
+			provisionInBackground(log, entry, request)
+		})
+		if !handedOver {
+			forgetProvision(log, instanceID)
+			log.Warning(errorInterrupted)
+			writeResponse(w, http.StatusServiceUnavailable, model.ErrorResponse{
+				Description: errorInterrupted,
+			})
+			return
+		}
+
+		log.Info("The database service is being created")
+		writeResponse(w, http.StatusAccepted, model.ProvisionResponse{
+			DashboardURL: platformDashboardURL(instanceID),
+			Operation:    provisionOperation,
+		})
+		return
+	}
+
+	err = provisionInstance(log, request)
 	if err != nil {
-		log.Println("[RESPONSE] Error in " +
-			"[" + command + "] run : " + err.Error())
 		response := model.ErrorResponse{
 			Description: provisionError,
 		}
@@ -137,20 +270,50 @@ func Provision(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := model.ProvisionResponse{
-		DashboardURL: "https://dashboard.example.com",
-		Operation:    "task_01",
+		DashboardURL: platformDashboardURL(instanceID),
 	}
 
-	log.Println("[RESPONSE] Created: The database service " + containerName +
-		" has been created successfully.")
 	writeResponse(w, http.StatusCreated, response)
 }
 
+// GetInstance returns the service, plan, dashboard and applied parameters of
+// an instance.
+func GetInstance(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Fetching a service instance")
+
+	instanceID := mux.Vars(r)["instance_id"]
+
+	instance, ok := broker.Store.Instance(instanceID)
+	if !ok {
+		log.Warning(errorInstanceNotFound)
+		response := model.ErrorResponse{
+			Description: errorInstanceNotFound,
+		}
+		writeResponse(w, http.StatusNotFound, response)
+		return
+	}
+
+	parameters := instance.Parameters
+	if parameters == nil {
+		parameters = map[string]interface{}{}
+	}
+
+	response := model.FetchInstanceResponse{
+		ServiceID:    instance.ServiceID,
+		PlanID:       instance.PlanID,
+		DashboardURL: platformDashboardURL(instanceID),
+		Parameters:   parameters,
+	}
+
+	log.Info("Database service fetched")
+	writeResponse(w, http.StatusOK, response)
+}
+
 // Bind associates the database service to a specific application.
 func Bind(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[REQUEST] Binding a service instance "+
-		"{ Hostname: %s, URI: %s, Method: %s, Agent: %s } \n",
-		r.RemoteAddr, r.RequestURI, r.Method, r.UserAgent())
+	log := requestLog(r)
+	log.Info("Binding a service instance")
 
 	instanceID := mux.Vars(r)["instance_id"]
 	bindingID := mux.Vars(r)["binding_id"]
@@ -160,7 +323,7 @@ func Bind(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close() // nolint: errcheck
 
 	if bodyErr == io.EOF {
-		log.Println("[RESPONSE] Error: " + bodyErr.Error())
+		log.Warning("Empty request body", "error", bodyErr)
 		response := model.ErrorResponse{
 			Description: errorEmptyBodyRequest,
 		}
@@ -170,7 +333,7 @@ func Bind(w http.ResponseWriter, r *http.Request) {
 
 	err := validateBindInputs(body, instanceID, bindingID)
 	if err != nil {
-		log.Println("[RESPONSE] Error: " + err.Error())
+		log.Warning("Invalid request", "error", err)
 		response := model.ErrorResponse{
 			Description: err.Error(),
 		}
@@ -178,35 +341,135 @@ func Bind(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//TODO: Implement bind functionality
+	instance, ok := broker.Store.Instance(instanceID)
+	if !ok {
+		log.Warning(errorInstanceNotFound)
+		response := model.ErrorResponse{
+			Description: errorInstanceNotFound,
+		}
+		writeResponse(w, http.StatusNotFound, response)
+		return
+	}
 
-	//TODO: Assign user credentials to the server instance specified
-	//TODO: Validate if the server instance exists - returns 404
-	//TODO: Get server instance Hostname
+	if existing, ok := broker.Store.Binding(bindingID); ok {
+		respondExistingBinding(w, log, instance, existing, body)
+		return
+	}
 
-	credentials := model.Credentials{
-		ConnectionString: "MONGO_URL=mongodb://" + body.Database.UserName + ":" +
-			body.Database.Password + "@HOSTNAME:27017/" + body.Database.Name,
-		UserName:     body.Database.UserName,
-		Password:     body.Database.Password,
-		Hostname:     "",
+	server, engine, err := instanceServer(instance)
+	if err != nil {
+		log.Error("Error reading the instance credentials", "error", err)
+		response := model.ErrorResponse{
+			Description: bindError,
+		}
+		writeResponse(w, http.StatusInternalServerError, response)
+		return
+	}
+
+	// The password is kept so the credentials can be fetched again
+	sealedPassword, err := security.Seal(broker.SecretKey,
+		body.Database.Password)
+	if err != nil {
+		log.Error("Error sealing credentials", "error", err)
+		response := model.ErrorResponse{
+			Description: bindError,
+		}
+		writeResponse(w, http.StatusInternalServerError, response)
+		return
+	}
+
+	binding := state.Binding{
+		ID:           bindingID,
+		InstanceID:   instanceID,
+		ServiceID:    body.ServiceID,
+		PlanID:       body.PlanID,
 		DatabaseName: body.Database.Name,
+		UserName:     body.Database.UserName,
+		Password:     sealedPassword,
+		State:        state.OperationInProgress,
+		CreatedAt:    time.Now().UTC(),
 	}
 
+	// When the platform accepts it, the user is created in the background
+	// and the platform polls the binding last operation
+	if r.FormValue("accepts_incomplete") == "true" {
+		err = broker.Store.PutBinding(binding)
+		if err != nil {
+			log.Error("Error saving the binding", "error", err)
+			response := model.ErrorResponse{
+				Description: bindError,
+			}
+			writeResponse(w, http.StatusInternalServerError, response)
+			return
+		}
+
+		entry, password := auditEntry(r, audit.Bind), body.Database.Password
+		handedOver := startTask(func() {
+			createBindingUser(log, entry, server, engine, binding, password)
+		})
+		if !handedOver {
+			// Nothing would ever create the user, so the platform retries
+			// against a binding it can create again
+			if err = broker.Store.DeleteBinding(bindingID); err != nil {
+				log.Error("Error deleting the binding", "error", err)
+			}
+			log.Warning(errorInterrupted)
+			writeResponse(w, http.StatusServiceUnavailable, model.ErrorResponse{
+				Description: errorInterrupted,
+			})
+			return
+		}
+
+		log.Info("The credentials are being created")
+		writeResponse(w, http.StatusAccepted, model.OperationResponse{
+			Operation: bindOperation,
+		})
+		return
+	}
+
+	err = engine.CreateUser(server, body.Database.Name,
+		body.Database.UserName, body.Database.Password)
+	if err != nil {
+		log.Error("Error creating the database user", "error", err)
+		dropPartialBindingUser(log, server, engine, binding)
+		recordOperation(instanceID, "bind", "Binding "+bindingID, false)
+		response := model.ErrorResponse{
+			Description: bindError,
+		}
+		writeResponse(w, http.StatusInternalServerError, response)
+		return
+	}
+
+	binding.State = state.OperationSucceeded
+	err = broker.Store.PutBinding(binding)
+	if err != nil {
+		log.Error("Error saving the binding", "error", err)
+		engine.DropUser(server, binding.DatabaseName, // nolint: errcheck
+			binding.UserName)
+		response := model.ErrorResponse{
+			Description: bindError,
+		}
+		writeResponse(w, http.StatusInternalServerError, response)
+		return
+	}
+
+	recordOperation(instanceID, "bind", "Binding "+bindingID+" as user "+
+		binding.UserName+" on database "+binding.DatabaseName, true)
+
 	response := model.BindResponse{
-		Credentials: credentials,
+		Credentials: bindingCredentials(instance, binding,
+			body.Database.Password),
 	}
 
-	log.Println("[RESPONSE] Bind: The credentials for the service " +
-		instanceID + " has been generated successfully.")
+	log.Info("Credentials created", "database", binding.DatabaseName,
+		"username", binding.UserName)
 	writeResponse(w, http.StatusCreated, response)
 }
 
 // UnBind deletes any resources associated with the binding.
 func UnBind(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[REQUEST] Unbinding a service instance "+
-		"{ Hostname: %s, URI: %s, Method: %s, Agent: %s } \n",
-		r.RemoteAddr, r.RequestURI, r.Method, r.UserAgent())
+	log := requestLog(r)
+	log.Info("Unbinding a service instance")
 
 	instanceID := mux.Vars(r)["instance_id"]
 	bindingID := mux.Vars(r)["binding_id"]
@@ -215,7 +478,7 @@ func UnBind(w http.ResponseWriter, r *http.Request) {
 
 	err := validateUnBindInputs(instanceID, bindingID, serviceID, planID)
 	if err != nil {
-		log.Println("[RESPONSE] Error: " + err.Error())
+		log.Warning("Invalid request", "error", err)
 		response := model.ErrorResponse{
 			Description: err.Error(),
 		}
@@ -223,30 +486,73 @@ func UnBind(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//TODO: Implement unbinding
+	binding, ok := broker.Store.Binding(bindingID)
+	if !ok || binding.InstanceID != instanceID {
+		log.Warning("The service binding does not exist")
+		writeResponse(w, http.StatusGone, struct{}{})
+		return
+	}
 
-	response := "{}"
-	log.Println("[RESPONSE] Unbind: The resources associated to the service " +
-		instanceID + " has been deleted successfully.")
+	if binding.State == state.OperationInProgress {
+		log.Warning(errorBindingInProgress)
+		response := model.ErrorResponse{
+			Error:       concurrencyError,
+			Description: errorBindingInProgress,
+		}
+		writeResponse(w, http.StatusUnprocessableEntity, response)
+		return
+	}
+
+	// The user of a binding whose creation failed was already dropped, or
+	// its removal attempted, when it failed
+	instance, ok := broker.Store.Instance(instanceID)
+	if ok && binding.Ready() {
+		server, engine, err := instanceServer(instance)
+		if err == nil {
+			err = engine.DropUser(server, binding.DatabaseName, binding.UserName)
+		}
+
+		if err != nil {
+			log.Error("Error deleting the database user", "error", err)
+			recordOperation(instanceID, "unbind", "Binding "+bindingID, false)
+			response := model.ErrorResponse{
+				Description: unbindError,
+			}
+			writeResponse(w, http.StatusInternalServerError, response)
+			return
+		}
+	}
+
+	err = broker.Store.DeleteBinding(bindingID)
+	if err != nil {
+		log.Error("Error deleting the binding", "error", err)
+		response := model.ErrorResponse{
+			Description: unbindError,
+		}
+		writeResponse(w, http.StatusInternalServerError, response)
+		return
+	}
+
+	recordOperation(instanceID, "unbind", "Binding "+bindingID+" removed user "+
+		binding.UserName, true)
+
+	response := struct{}{}
+	log.Info("Credentials deleted", "username", binding.UserName)
 	writeResponse(w, http.StatusOK, response)
 }
 
 // Deprovision destroy the container where the database service is running.
 func Deprovision(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[REQUEST] Deprovisioning a database service "+
-		"{ Hostname: %s, URI: %s, Method: %s, Agent: %s } \n",
-		r.RemoteAddr, r.RequestURI, r.Method, r.UserAgent())
+	log := requestLog(r)
+	log.Info("Deprovisioning a database service")
 
 	instanceID := mux.Vars(r)["instance_id"]
 	serviceID := r.FormValue("service_id")
 	planID := r.FormValue("plan_id")
 
-	command := "docker"
-	containerName := "cf-mongo-" + instanceID
-
 	err := validateDeprovisionInputs(instanceID, serviceID, planID)
 	if err != nil {
-		log.Println("[RESPONSE] Error: " + err.Error())
+		log.Warning("Invalid request", "error", err)
 		response := model.ErrorResponse{
 			Description: err.Error(),
 		}
@@ -254,12 +560,49 @@ func Deprovision(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//TODO: Validate that the server instance exists - returns 404
+	if !beginOperation(instanceID) {
+		log.Warning(errorOperationInProgress)
+		response := model.ErrorResponse{
+			Error:       concurrencyError,
+			Description: errorOperationInProgress,
+		}
+		writeResponse(w, http.StatusUnprocessableEntity, response)
+		return
+	}
+	defer endOperation(instanceID)
+
+	instance, ok := broker.Store.Instance(instanceID)
+	if !ok {
+		// The platform deletes the instances whose provision failed or timed
+		// out, whatever the broker answered, to clean up their resources
+		err = removeOrphans(instanceID)
+		if err != nil {
+			log.Error("Error removing the orphaned resources", "error", err)
+			response := model.ErrorResponse{
+				Description: deprovisionError,
+			}
+			writeResponse(w, http.StatusInternalServerError, response)
+			return
+		}
+		forgetProvision(log, instanceID)
+
+		log.Warning(errorInstanceNotFound)
+		writeResponse(w, http.StatusGone, struct{}{})
+		return
+	}
+
+	start := time.Now()
+	succeeded := false
+	defer func() {
+		observeOperation(deprovisionDuration, start, instance.PlanID,
+			succeeded)
+	}()
 
-	_, err = exec.Command(command, "rm", "-f", containerName).Output()
+	containerName := instance.ContainerName
+	err = container.Remove(containerName)
 
 	if err != nil {
-		log.Println("[RESPONSE] Error in [" + command + "]: " + err.Error())
+		log.Error("Error removing the container", "error", err)
 		response := model.ErrorResponse{
 			Description: deprovisionError,
 		}
@@ -267,12 +610,29 @@ func Deprovision(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := model.DeprovisionResponse{
-		Operation: "task_01",
+	err = broker.Store.DeleteInstance(instanceID)
+	if err != nil {
+		log.Error("Error deleting the instance", "error", err)
+		response := model.ErrorResponse{
+			Description: deprovisionError,
+		}
+		writeResponse(w, http.StatusInternalServerError, response)
+		return
 	}
 
-	log.Println("[RESPONSE] Destroyed: The database service " + containerName +
-		" has been deleted successfully.")
+	forgetHealth(instanceID)
+
+	if instance.TLS {
+		err = broker.Authority.Forget(containerName)
+		if err != nil {
+			log.Warning("Error deleting the certificate records", "error", err)
+		}
+	}
+
+	succeeded = true
+	response := model.DeprovisionResponse{}
+
+	log.Info("Database service deleted", "container", containerName)
 	writeResponse(w, http.StatusOK, response)
 }
 
@@ -289,27 +649,133 @@ func writeResponse(w http.ResponseWriter, code int, object interface{}) {
 	w.Write(data) // nolint: errcheck
 }
 
-// nextAvailablePort finds an available port to be used by Docker to run the
-// container.
-func nextAvailablePort() (string, error) {
-	initHostPort := "59000"
+// recordOperation adds an entry to the operations history of an instance,
+// shown in its dashboard.
+func recordOperation(instanceID, operationType, description string,
+	succeeded bool) {
+
+	err := broker.Store.AddOperation(instanceID, state.Operation{
+		Type:        operationType,
+		Description: description,
+		Succeeded:   succeeded,
+		Time:        time.Now().UTC(),
+	})
+	if err != nil {
+		logging.Warning("Recording the operation failed", "operation",
+			operationType, "instance_id", instanceID, "error", err)
+	}
+}
 
-	portsTaken, err := exec.Command("bash", "-c",
-		"docker ps --format '{{.Ports}}' | grep -oE ':[^-]+' | cut -c2-").Output()
+// reservePort finds an available port of the pool to be used by Docker to
+// run the container and reserves it until released with releasePort, so
+// concurrent provisions never get the same one. The port after the highest
+// allocated one is preferred, so a released port is only reused once the
+// end of the pool is reached.
+func reservePort() (string, error) {
+	reservedPortsMu.Lock()
+	defer reservedPortsMu.Unlock()
 
+	allocated, err := allocatedPorts()
 	if err != nil {
-		return "", errors.New("[docker] ps error: " + err.Error())
+		return "", err
 	}
 
-	ports := strings.Fields(string(portsTaken))
+	port := broker.FirstHostPort
+	for allocatedPort := range allocated {
+		if allocatedPort >= port {
+			port = allocatedPort + 1
+		}
+	}
 
-	if len(ports) == 0 {
-		return initHostPort, nil
+	for candidate := broker.FirstHostPort; port > broker.LastHostPort &&
+		candidate <= broker.LastHostPort; candidate++ {
+		if !allocated[candidate] {
+			port = candidate
+		}
 	}
 
-	sort.Strings(ports)
-	port, _ := strconv.Atoi(ports[len(ports)-1])
-	port = port + 1
+	if port > broker.LastHostPort {
+		return "", errors.New(errorNoPortAvailable)
+	}
 
+	reservedPorts[strconv.Itoa(port)] = true
 	return strconv.Itoa(port), nil
 }
+
+// allocatedPorts returns the ports of the pool published by the containers
+// or reserved by a provision. The ports of the stopped instances stay
+// allocated to them, while the ones of the failed instances are released.
+// The caller must hold reservedPortsMu.
+func allocatedPorts() (map[int]bool, error) {
+	ports, err := container.UsedPorts()
+	if err != nil {
+		return nil, err
+	}
+
+	for port := range reservedPorts {
+		ports = append(ports, port)
+	}
+
+	for _, instance := range broker.Store.Instances() {
+		if instance.State != state.OperationFailed {
+			ports = append(ports, instance.HostPort)
+		}
+	}
+
+	allocated := map[int]bool{}
+	for _, port := range ports {
+		number, err := strconv.Atoi(port)
+		if err == nil && number >= broker.FirstHostPort &&
+			number <= broker.LastHostPort {
+			allocated[number] = true
+		}
+	}
+
+	return allocated, nil
+}
+
+// instanceServer unseals the root credential of an instance and returns the
+// engine that manages it.
+func instanceServer(
+	instance state.Instance) (database.Server, database.Engine, error) {
+
+	engine, ok := engines[instance.ServiceID]
+	if !ok {
+		return database.Server{}, nil, errors.New(errorServiceNotFound)
+	}
+
+	password, err := security.Unseal(broker.SecretKey, instance.AdminPassword)
+	if err != nil {
+		return database.Server{}, nil, err
+	}
+
+	server := database.Server{
+		ContainerName: instance.ContainerName,
+		HostPort:      instance.HostPort,
+		Admin: database.Admin{
+			UserName: instance.AdminUserName,
+			Password: password,
+		},
+		TLS:        instance.TLS,
+		ReplicaSet: instance.ReplicaSet,
+	}
+
+	return server, engine, nil
+}
+
+// issueServerCertificate signs the certificate of a TLS enabled instance. It
+// is valid for the broker hostname given to the applications and for the
+// local connections made by the broker inside the container.
+func issueServerCertificate(containerName string) (database.Certificate, error) {
+	certPEM, keyPEM, err := broker.Authority.Issue(containerName,
+		[]string{broker.Hostname, "localhost", "127.0.0.1"})
+	if err != nil {
+		return database.Certificate{}, err
+	}
+
+	return database.Certificate{
+		CertificatePEM: certPEM,
+		PrivateKeyPEM:  keyPEM,
+		AuthorityPEM:   broker.Authority.CertificatePEM(),
+	}, nil
+}
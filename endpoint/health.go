@@ -0,0 +1,288 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/container"
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+	"github.com/cloudfoundry-community/cf-nosql-broker/model"
+	"github.com/cloudfoundry-community/cf-nosql-broker/state"
+	"github.com/gorilla/mux"
+)
+
+const (
+	healthHealthy   = "healthy"
+	healthDegraded  = "degraded"
+	healthRestarted = "restarted"
+
+	// healthFailureThreshold is the number of consecutive failed probes
+	// before the container is restarted.
+	healthFailureThreshold = 3
+
+	// The delay between two restarts of a container that stays unhealthy
+	// doubles from minRestartBackoff up to maxRestartBackoff.
+	minRestartBackoff = time.Minute
+	maxRestartBackoff = 30 * time.Minute
+)
+
+// instanceHealth is the latest health of an instance, as probed by the
+// health monitor.
+type instanceHealth struct {
+	Status string
+	Error  string
+	// Since is when the instance entered its status.
+	Since     time.Time
+	CheckedAt time.Time
+	// Failures counts the consecutive failed probes.
+	Failures int
+	// Restarts counts the restarts since the instance was last healthy.
+	Restarts    int
+	NextRestart time.Time
+}
+
+var (
+	health   = map[string]instanceHealth{}
+	healthMu sync.Mutex
+)
+
+// monitorHealth probes the instances every broker.HealthInterval and
+// restarts the containers that stop answering. Failed and stopped instances
+// and the ones with an operation in progress are skipped. The probes run
+// without holding the instance, so a hanging database does not block its
+// operations; only the restart does.
+func monitorHealth() {
+	if broker.HealthInterval <= 0 {
+		return
+	}
+
+	for {
+		if !pause(broker.HealthInterval) {
+			return
+		}
+
+		for _, instance := range broker.Store.Instances() {
+			if instance.State == state.OperationFailed || instance.Stopped ||
+				operationInProgress(instance.ID) {
+				continue
+			}
+
+			checkHealth(instance, time.Now().UTC())
+		}
+	}
+}
+
+// checkHealth runs the readiness probe of the engine of an instance and
+// restarts its container, with backoff, once it failed
+// healthFailureThreshold times in a row.
+func checkHealth(instance state.Instance, now time.Time) {
+	current := currentHealth(instance.ID)
+
+	server, engine, err := instanceServer(instance)
+	if err == nil {
+		err = engine.Ping(server)
+	}
+
+	if err == nil {
+		if current.Status == healthDegraded {
+			recordHealth(instance.ID, healthHealthy,
+				"The database answers again", now)
+		}
+
+		since := current.Since
+		if current.Status != healthHealthy || since.IsZero() {
+			since = now
+		}
+
+		setHealth(instance.ID, instanceHealth{
+			Status:    healthHealthy,
+			Since:     since,
+			CheckedAt: now,
+		})
+		return
+	}
+
+	if current.Status != healthDegraded {
+		recordHealth(instance.ID, healthDegraded, err.Error(), now)
+		current.Since = now
+	}
+
+	current.Status = healthDegraded
+	current.Error = err.Error()
+	current.CheckedAt = now
+	current.Failures++
+
+	if current.Failures >= healthFailureThreshold &&
+		!now.Before(current.NextRestart) {
+		restartUnhealthy(instance.ID, &current, now)
+	}
+
+	// The instance may have been deleted while it was probed
+	if _, ok := broker.Store.Instance(instance.ID); !ok {
+		return
+	}
+
+	setHealth(instance.ID, current)
+}
+
+// restartUnhealthy restarts the container of an instance that failed its
+// health checks, unless an operation started on the instance since it was
+// probed or left it failed, stopped or deleted. The restart is then tried
+// again at the next probe.
+func restartUnhealthy(instanceID string, current *instanceHealth,
+	now time.Time) {
+
+	if !beginOperation(instanceID) {
+		return
+	}
+	defer endOperation(instanceID)
+
+	instance, ok := broker.Store.Instance(instanceID)
+	if !ok || instance.State == state.OperationFailed || instance.Stopped {
+		return
+	}
+
+	current.Restarts++
+	current.NextRestart = now.Add(restartBackoff(current.Restarts))
+
+	err := container.Restart(instance.ContainerName)
+	if err != nil {
+		logging.Warning("Restarting the unhealthy container failed",
+			"operation", "health_check", "instance_id", instance.ID,
+			"error", err)
+		recordOperation(instance.ID, "restart", "Restart after "+
+			strconv.Itoa(current.Failures)+" failed health checks", false)
+	} else {
+		containerRestarts.Inc()
+		recordHealth(instance.ID, healthRestarted, "Restarted after "+
+			strconv.Itoa(current.Failures)+" failed health checks", now)
+		recordOperation(instance.ID, "restart", "Restart after "+
+			strconv.Itoa(current.Failures)+" failed health checks", true)
+	}
+}
+
+// restartBackoff is the delay before the next restart of a container
+// restarted the given number of times.
+func restartBackoff(restarts int) time.Duration {
+	backoff := minRestartBackoff
+	for i := 1; i < restarts && backoff < maxRestartBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxRestartBackoff {
+		return maxRestartBackoff
+	}
+
+	return backoff
+}
+
+// currentHealth returns the latest health of an instance, healthy when it
+// was not probed yet.
+func currentHealth(instanceID string) instanceHealth {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	current, ok := health[instanceID]
+	if !ok {
+		return instanceHealth{Status: healthHealthy}
+	}
+
+	return current
+}
+
+// setHealth stores the latest health of an instance and exports it.
+func setHealth(instanceID string, current instanceHealth) {
+	healthMu.Lock()
+	health[instanceID] = current
+	healthMu.Unlock()
+
+	if current.Status == healthHealthy {
+		instanceHealthy.Set(1, instanceID)
+	} else {
+		instanceHealthy.Set(0, instanceID)
+	}
+}
+
+// forgetHealth drops the health of a deleted instance.
+func forgetHealth(instanceID string) {
+	healthMu.Lock()
+	delete(health, instanceID)
+	healthMu.Unlock()
+
+	instanceHealthy.Delete(instanceID)
+}
+
+// recordHealth adds an event to the health history of an instance.
+func recordHealth(instanceID, status, description string, now time.Time) {
+	log := logging.With("operation", "health_check", "instance_id", instanceID)
+	log.Info("Health changed", "status", status, "description", description)
+
+	err := broker.Store.AddHealthEvent(instanceID, state.HealthEvent{
+		Status:      status,
+		Description: description,
+		Time:        now,
+	})
+	if err != nil {
+		log.Warning("Recording the health failed", "error", err)
+	}
+}
+
+// InstanceLastOperation reports the state of an instance: the state of its
+// provision while accepted asynchronously, then succeeded unless the
+// instance failed, the description telling when it is degraded.
+func InstanceLastOperation(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Polling a service instance operation")
+
+	instanceID := mux.Vars(r)["instance_id"]
+
+	instance, ok := broker.Store.Instance(instanceID)
+	if !ok {
+		// An accepted provision has no record until it succeeds
+		if operation, ok := provisionState(instanceID); ok {
+			log.Info("Service instance provision polled", "state",
+				operation.State)
+			writeResponse(w, http.StatusOK, operation)
+			return
+		}
+
+		log.Warning(errorInstanceNotFound)
+		writeResponse(w, http.StatusGone, struct{}{})
+		return
+	}
+
+	response := model.LastOperationResponse{
+		State: state.OperationSucceeded,
+	}
+
+	current := currentHealth(instanceID)
+	switch {
+	case instance.State == state.OperationFailed:
+		response.State = state.OperationFailed
+		response.Description = instance.StateDescription
+	case current.Status == healthDegraded:
+		response.Description = "The service instance is degraded since " +
+			current.Since.Format(time.RFC3339) + ": " + current.Error
+	}
+
+	log.Info("Service instance operation polled", "state", response.State)
+	writeResponse(w, http.StatusOK, response)
+}
@@ -0,0 +1,90 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// originatingIdentityHeader carries the platform and the user on whose
+// behalf the platform sends a request.
+const originatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
+const errorOriginatingIdentity = "the originating identity must be a " +
+	"platform followed by base64 encoded JSON"
+
+// originatingIdentity is the user behind a request, as identified by the
+// platform. Cloud Foundry sends a user_id, Kubernetes a username and uid.
+type originatingIdentity struct {
+	Platform string
+	UserID   string
+	// Value holds every property sent by the platform.
+	Value map[string]interface{}
+}
+
+type identityContextKey struct{}
+
+// parseOriginatingIdentity decodes the value of the originating identity
+// header, "<platform> <base64 encoded JSON object>".
+func parseOriginatingIdentity(header string) (originatingIdentity, error) {
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return originatingIdentity{}, errors.New(errorOriginatingIdentity)
+	}
+
+	value, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		// Some platforms leave the padding out
+		value, err = base64.RawStdEncoding.DecodeString(fields[1])
+	}
+	if err != nil {
+		return originatingIdentity{}, errors.New(errorOriginatingIdentity)
+	}
+
+	identity := originatingIdentity{Platform: fields[0]}
+	if err = json.Unmarshal(value, &identity.Value); err != nil {
+		return originatingIdentity{}, errors.New(errorOriginatingIdentity)
+	}
+
+	for _, key := range []string{"user_id", "uid", "username"} {
+		if userID, ok := identity.Value[key].(string); ok && userID != "" {
+			identity.UserID = userID
+			break
+		}
+	}
+
+	return identity, nil
+}
+
+// withIdentity returns a copy of the request carrying its originating
+// identity, read with requestIdentity.
+func withIdentity(r *http.Request, identity originatingIdentity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityContextKey{},
+		identity))
+}
+
+// requestIdentity returns the originating identity of a request, empty when
+// the platform sent none.
+func requestIdentity(r *http.Request) originatingIdentity {
+	identity, _ := r.Context().Value(identityContextKey{}).(originatingIdentity)
+	return identity
+}
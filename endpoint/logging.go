@@ -0,0 +1,106 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+	"github.com/gorilla/mux"
+)
+
+// requestIdentityHeader carries the identifier the platform gives to a
+// request, so the broker logs can be matched with its own.
+const requestIdentityHeader = "X-Broker-API-Request-Identity"
+
+type requestIDContextKey struct{}
+
+// traced logs a request and its outcome and hands the handler a logger,
+// read with requestLog, whose entries carry the request ID, the operation,
+// the instance and binding the request targets and the user behind it. The
+// originating identity is also kept in the request, see requestIdentity.
+func traced(operation string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(requestIdentityHeader)
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIdentityHeader, requestID)
+		r = r.WithContext(context.WithValue(r.Context(),
+			requestIDContextKey{}, requestID))
+
+		log := logging.With("request_id", requestID, "operation", operation)
+		if instanceID := mux.Vars(r)["instance_id"]; instanceID != "" {
+			log = log.With("instance_id", instanceID)
+		}
+		if bindingID := mux.Vars(r)["binding_id"]; bindingID != "" {
+			log = log.With("binding_id", bindingID)
+		}
+
+		if header := r.Header.Get(originatingIdentityHeader); header != "" {
+			identity, err := parseOriginatingIdentity(header)
+			if err != nil {
+				log.Warning("Invalid originating identity", "error", err)
+			} else {
+				log = log.With("platform", identity.Platform, "user_id",
+					identity.UserID)
+				r = withIdentity(r, identity)
+			}
+		}
+
+		log.Debug("Request received", "method", r.Method, "path", r.URL.Path,
+			"remote_addr", r.RemoteAddr, "user_agent", r.UserAgent())
+
+		recorder := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		handler(recorder, r.WithContext(logging.NewContext(r.Context(), log)))
+
+		log.Info("Request completed", "method", r.Method, "status",
+			recorder.code, "duration_ms",
+			time.Since(start).Nanoseconds()/int64(time.Millisecond))
+	}
+}
+
+// requestIDOf returns the ID traced gave to a request.
+func requestIDOf(r *http.Request) string {
+	requestID, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// requestLog returns the logger of a request wrapped by traced.
+func requestLog(r *http.Request) *logging.Logger {
+	return logging.FromContext(r.Context())
+}
+
+// newRequestID returns a random version 4 UUID.
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "unknown"
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+
+	encoded := hex.EncodeToString(id)
+	return encoded[:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" +
+		encoded[16:20] + "-" + encoded[20:]
+}
@@ -0,0 +1,192 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+	"github.com/cloudfoundry-community/cf-nosql-broker/metrics"
+	"github.com/cloudfoundry-community/cf-nosql-broker/model"
+)
+
+// operationBuckets suit the durations of the provisions and deprovisions,
+// which can take minutes when a backup is restored.
+var operationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800}
+
+// Metrics reported by the broker.
+var (
+	backupsPruned = metrics.NewCounter("cf_nosql_broker_backups_pruned_total",
+		"Backups deleted by the retention rules of their plan.")
+	backupVerifications = metrics.NewCounter(
+		"cf_nosql_broker_backup_verifications_total",
+		"Verification restores of backups, by result.", "result")
+	backupVerificationFailed = metrics.NewGauge(
+		"cf_nosql_broker_backup_verification_failed",
+		"1 when the latest verification restore of an instance backup failed.",
+		"instance_id")
+	instanceHealthy = metrics.NewGauge("cf_nosql_broker_instance_healthy",
+		"1 when the latest health check of an instance succeeded.",
+		"instance_id")
+	containerRestarts = metrics.NewCounter(
+		"cf_nosql_broker_container_restarts_total",
+		"Containers restarted by the health monitor.")
+	osbRequests = metrics.NewCounter("cf_nosql_broker_osb_requests_total",
+		"Requests to the service broker API, by endpoint and status code.",
+		"endpoint", "code")
+	osbRequestDuration = metrics.NewHistogram(
+		"cf_nosql_broker_osb_request_duration_seconds",
+		"Latency of the service broker API, by endpoint and status code.",
+		metrics.DefaultBuckets, "endpoint", "code")
+	provisionDuration = metrics.NewHistogram(
+		"cf_nosql_broker_provision_duration_seconds",
+		"Duration of the provisions, by plan and result.",
+		operationBuckets, "plan", "result")
+	deprovisionDuration = metrics.NewHistogram(
+		"cf_nosql_broker_deprovision_duration_seconds",
+		"Duration of the deprovisions, by plan and result.",
+		operationBuckets, "plan", "result")
+	instanceCount = metrics.NewGauge("cf_nosql_broker_instances",
+		"Service instances, by service and plan.", "service_id", "plan")
+	bindingCount = metrics.NewGauge("cf_nosql_broker_bindings",
+		"Service bindings, by service and plan.", "service_id", "plan")
+	portsAllocated = metrics.NewGauge("cf_nosql_broker_ports_allocated",
+		"Host ports of the pool allocated to instances.")
+	portPoolSize = metrics.NewGauge("cf_nosql_broker_port_pool_size",
+		"Host ports in the pool.")
+	portPoolUtilisation = metrics.NewGauge(
+		"cf_nosql_broker_port_pool_utilisation",
+		"Fraction of the host ports of the pool allocated to instances.")
+)
+
+// statusRecorder keeps the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// instrument traces the requests to a service broker API endpoint, counts
+// them and measures their latency.
+func instrument(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	return traced(endpoint, func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+
+		handler(recorder, r)
+
+		code := strconv.Itoa(recorder.code)
+		osbRequests.Inc(endpoint, code)
+		osbRequestDuration.Observe(time.Since(start).Seconds(), endpoint, code)
+	})
+}
+
+// observeOperation records the duration of a provision or deprovision.
+func observeOperation(histogram metrics.Histogram, start time.Time,
+	planID string, succeeded bool) {
+
+	result := "failed"
+	if succeeded {
+		result = "succeeded"
+	}
+
+	histogram.Observe(time.Since(start).Seconds(), planName(planID), result)
+}
+
+// collectStateMetrics sets the gauges describing the broker state, read
+// when the metrics are scraped.
+func collectStateMetrics() {
+	type servicePlan struct{ serviceID, plan string }
+	instances := map[servicePlan]int{}
+	bindings := map[servicePlan]int{}
+
+	// Every plan is reported, even without instances
+	for serviceID := range engines {
+		for _, plan := range servicePlans {
+			instances[servicePlan{serviceID, plan.Name}] = 0
+		}
+	}
+
+	for _, instance := range broker.Store.Instances() {
+		key := servicePlan{instance.ServiceID, planName(instance.PlanID)}
+		instances[key]++
+		bindings[key] += len(broker.Store.Bindings(instance.ID))
+	}
+
+	instanceCount.Reset()
+	bindingCount.Reset()
+	for key, count := range instances {
+		instanceCount.Set(float64(count), key.serviceID, key.plan)
+		bindingCount.Set(float64(bindings[key]), key.serviceID, key.plan)
+	}
+
+	reservedPortsMu.Lock()
+	allocated, err := allocatedPorts()
+	reservedPortsMu.Unlock()
+	if err != nil {
+		logging.Warning("Reading the allocated ports failed", "error", err)
+		return
+	}
+
+	size := float64(broker.LastHostPort - broker.FirstHostPort + 1)
+	portsAllocated.Set(float64(len(allocated)))
+	portPoolSize.Set(size)
+	portPoolUtilisation.Set(float64(len(allocated)) / size)
+}
+
+// metricsAuth protects the metrics endpoint with its own credentials, when
+// they are configured, so the scrapers never hold the broker credentials.
+func metricsAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if broker.MetricsUserName == "" && broker.MetricsPassword == "" {
+			handler(w, r)
+			return
+		}
+
+		userName, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(userName),
+			[]byte(broker.MetricsUserName)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password),
+				[]byte(broker.MetricsPassword)) != 1 {
+			requestLog(r).Warning(errorUnauthorized)
+			w.Header().Set("WWW-Authenticate", `Basic realm="cf-nosql-broker metrics"`)
+			writeResponse(w, http.StatusUnauthorized, model.ErrorResponse{
+				Description: errorUnauthorized,
+			})
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// Metrics writes the broker metrics in the Prometheus text format.
+func Metrics(w http.ResponseWriter, r *http.Request) {
+	collectStateMetrics()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := metrics.Write(w); err != nil {
+		requestLog(r).Error("Error writing the metrics", "error", err)
+	}
+}
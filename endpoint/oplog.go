@@ -0,0 +1,145 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/database"
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+	"github.com/cloudfoundry-community/cf-nosql-broker/model"
+	"github.com/cloudfoundry-community/cf-nosql-broker/state"
+	"github.com/gorilla/mux"
+)
+
+const (
+	errorNotReplicaSet = "The service instance plan does not support point-in-time recovery." // nolint: lll
+
+	// oplogArchiveInterval is how often the oplog of the replica sets is
+	// archived, and so the most data a lost host can take with it.
+	oplogArchiveInterval = time.Minute
+)
+
+// recoveryWindow is the range of time an instance can be restored to.
+type recoveryWindow struct {
+	Earliest time.Time `json:"earliest"`
+	Latest   time.Time `json:"latest"`
+}
+
+// initiateReplicaSet configures the replica set of a new instance once its
+// container accepts connections.
+func initiateReplicaSet(server database.Server, engine database.Engine) error {
+	if err := engine.WaitReady(server, restoreReadyTimeout); err != nil {
+		return err
+	}
+
+	return engine.InitiateReplicaSet(server, restoreReadyTimeout)
+}
+
+// archiveOplogs tails the oplog of the replica set instances, storing the new
+// entries next to their backups and dropping the ones older than the
+// retention of their plan.
+func archiveOplogs() {
+	for {
+		if !pause(oplogArchiveInterval) {
+			return
+		}
+
+		for _, instance := range broker.Store.Instances() {
+			if instance.ReplicaSet {
+				instance := instance
+				startTask(func() { archiveOplog(instance) })
+			}
+		}
+	}
+}
+
+// archiveOplog archives and prunes the oplog of one instance.
+func archiveOplog(instance state.Instance) {
+	log := logging.With("operation", "archive_oplog", "instance_id",
+		instance.ID)
+
+	server, engine, err := instanceServer(instance)
+	if err == nil {
+		_, _, err = broker.Backups.ArchiveOplog(instance, server, engine)
+	}
+	if err != nil {
+		log.Warning("Archiving the oplog failed", "error", err)
+		return
+	}
+
+	retention := plans[instance.PlanID].OplogRetention
+	if retention == 0 {
+		return
+	}
+
+	removed, err := broker.Backups.PruneOplog(instance.ID,
+		time.Now().Add(-retention))
+	if err != nil {
+		log.Warning("Pruning the oplog failed", "error", err)
+		return
+	}
+
+	if removed > 0 {
+		log.Info("Oplog segments removed by the retention", "count", removed)
+	}
+}
+
+// GetRecoveryWindow returns the points in time a replica set instance can be
+// restored to.
+func GetRecoveryWindow(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Reading the recovery window of a service instance")
+
+	instanceID := mux.Vars(r)["instance_id"]
+
+	instance, ok := broker.Store.Instance(instanceID)
+	if !ok {
+		log.Warning(errorInstanceNotFound)
+		response := model.ErrorResponse{
+			Description: errorInstanceNotFound,
+		}
+		writeResponse(w, http.StatusNotFound, response)
+		return
+	}
+
+	if !instance.ReplicaSet {
+		log.Warning(errorNotReplicaSet)
+		response := model.ErrorResponse{
+			Description: errorNotReplicaSet,
+		}
+		writeResponse(w, http.StatusBadRequest, response)
+		return
+	}
+
+	earliest, latest, err := broker.Backups.RecoveryWindow(instanceID)
+	if err != nil {
+		log.Warning("No recovery window", "error", err)
+		response := model.ErrorResponse{
+			Description: err.Error(),
+		}
+		writeResponse(w, http.StatusNotFound, response)
+		return
+	}
+
+	log.Info("Recovery window read")
+	writeResponse(w, http.StatusOK, recoveryWindow{
+		Earliest: earliest,
+		Latest:   latest,
+	})
+}
@@ -0,0 +1,151 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"sync"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/container"
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+)
+
+const (
+	containerPrefix          = "cf-mongo-"
+	errorOperationInProgress = "An operation is already in progress for " +
+		"the service instance."
+)
+
+var (
+	// inFlight holds the instances being provisioned or deprovisioned, so
+	// the platform orphan mitigation can not race the operation it cleans.
+	inFlight   = map[string]bool{}
+	inFlightMu sync.Mutex
+
+	// reservedPorts holds the ports handed to a provision until its
+	// container publishes them.
+	reservedPorts   = map[string]bool{}
+	reservedPortsMu sync.Mutex
+)
+
+// rollback records the resources created by a multi-step operation so they
+// can be released, most recent first, when a later step fails.
+type rollback struct {
+	log   *logging.Logger
+	steps []rollbackStep
+}
+
+type rollbackStep struct {
+	description string
+	undo        func() error
+}
+
+// add records how to release a resource just created.
+func (rb *rollback) add(description string, undo func() error) {
+	rb.steps = append(rb.steps, rollbackStep{description, undo})
+}
+
+// run releases the recorded resources. A failing step is logged and does
+// not stop the others; what is left behind is removed by the orphan
+// mitigation of the platform.
+func (rb *rollback) run() {
+	for i := len(rb.steps) - 1; i >= 0; i-- {
+		step := rb.steps[i]
+		if err := step.undo(); err != nil {
+			rb.log.Warning("Rolling back "+step.description+" failed",
+				"error", err)
+			continue
+		}
+
+		rb.log.Info("Rolled back " + step.description)
+	}
+
+	rb.steps = nil
+}
+
+// beginOperation marks an instance as being changed, returning false when
+// another operation already holds it.
+func beginOperation(instanceID string) bool {
+	inFlightMu.Lock()
+	defer inFlightMu.Unlock()
+
+	if inFlight[instanceID] {
+		return false
+	}
+
+	inFlight[instanceID] = true
+	return true
+}
+
+// operationInProgress reports whether an operation holds an instance, without
+// taking it.
+func operationInProgress(instanceID string) bool {
+	inFlightMu.Lock()
+	defer inFlightMu.Unlock()
+
+	return inFlight[instanceID]
+}
+
+// endOperation releases an instance marked by beginOperation.
+func endOperation(instanceID string) {
+	inFlightMu.Lock()
+	defer inFlightMu.Unlock()
+
+	delete(inFlight, instanceID)
+}
+
+// releasePort gives back a port reserved by reservePort.
+func releasePort(port string) {
+	reservedPortsMu.Lock()
+	defer reservedPortsMu.Unlock()
+
+	delete(reservedPorts, port)
+}
+
+// removeOrphanedContainer removes a container left behind by a failed
+// operation, if there is one.
+func removeOrphanedContainer(name string) error {
+	exists, err := container.Exists(name)
+	if err != nil || !exists {
+		return err
+	}
+
+	logging.Info("Removing an orphaned container", "container", name)
+	return container.Remove(name)
+}
+
+// removeOrphans removes the container and certificate records a failed
+// provision of an instance may have left behind.
+func removeOrphans(instanceID string) error {
+	name := containerName(instanceID)
+
+	if err := removeOrphanedContainer(name); err != nil {
+		return err
+	}
+
+	if _, ok := broker.Authority.Current(name); ok {
+		logging.Info("Removing orphaned certificate records", "container",
+			name)
+		return broker.Authority.Forget(name)
+	}
+
+	return nil
+}
+
+// containerName is the name of the container running an instance.
+func containerName(instanceID string) string {
+	return containerPrefix + instanceID
+}
@@ -0,0 +1,273 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/backup"
+	"github.com/cloudfoundry-community/cf-nosql-broker/config"
+	"github.com/cloudfoundry-community/cf-nosql-broker/model"
+)
+
+const (
+	standardPlanID   = "4f79aa95-b5ca-4030-a263-c58cb2c61dfc"
+	tlsPlanID        = "8d3f4b2e-6a1c-4e7f-9b05-2c8a7d6e1f34"
+	replicaSetPlanID = "c2a7e95d-3f1b-4d86-a0e4-7b9c5d2f8a61"
+)
+
+// servicePlans are the plans advertised in the catalog.
+var servicePlans = []model.ServicePlan{
+	{
+		Name:        "Standard",
+		ID:          standardPlanID,
+		Description: "MongoDB database",
+		Metadata:    nil,
+		Free:        true,
+		Bindable:    true,
+	},
+	{
+		Name:        "Standard-TLS",
+		ID:          tlsPlanID,
+		Description: "MongoDB database only reachable through TLS",
+		Metadata:    nil,
+		Free:        true,
+		Bindable:    true,
+	},
+	{
+		Name:        "Standard-PITR",
+		ID:          replicaSetPlanID,
+		Description: "MongoDB replica set restorable to any point in time of the last 7 days", // nolint: lll
+		Metadata:    nil,
+		Free:        true,
+		Bindable:    true,
+	},
+}
+
+// planOptions describes how the instances of a plan are run.
+type planOptions struct {
+	// TLS starts the database accepting only encrypted connections, using a
+	// server certificate issued by the broker authority.
+	TLS bool
+	// BackupSchedule is the cron expression of the automatic backups, empty
+	// to disable them.
+	BackupSchedule string
+	// BackupRetention selects the backups kept after each new one.
+	BackupRetention backup.Retention
+	// ReplicaSet runs a single member replica set whose operations log is
+	// archived continuously, so restores can target any point in time.
+	ReplicaSet bool
+	// OplogRetention is how far back in time the instances can be restored.
+	OplogRetention time.Duration
+}
+
+// plans maps the catalog plans to their options.
+var plans = map[string]planOptions{
+	standardPlanID: {
+		BackupSchedule:  "0 2 * * *",
+		BackupRetention: backup.Retention{Daily: 7, Weekly: 4},
+	},
+	tlsPlanID: {
+		TLS:             true,
+		BackupSchedule:  "0 2 * * *",
+		BackupRetention: backup.Retention{Daily: 7, Weekly: 4},
+	},
+	// One more daily backup than the oplog retention, so the oldest point
+	// in time still has a base backup taken before it
+	replicaSetPlanID: {
+		BackupSchedule:  "0 2 * * *",
+		BackupRetention: backup.Retention{Daily: 8, Weekly: 4},
+		ReplicaSet:      true,
+		OplogRetention:  7 * 24 * time.Hour,
+	},
+}
+
+// ConfigurePlans overrides the options of the catalog plans, by plan name,
+// with the ones set in the configuration. It returns the names matching no
+// plan, the options themselves being checked by ValidateCatalog.
+func ConfigurePlans(overrides map[string]config.Plan) []error {
+	problems := []error{}
+
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		planID := ""
+		for _, plan := range servicePlans {
+			if plan.Name == name {
+				planID = plan.ID
+			}
+		}
+
+		if planID == "" {
+			problems = append(problems, fmt.Errorf("plans.%s: no such plan "+
+				"in the catalog", name))
+			continue
+		}
+
+		override, options := overrides[name], plans[planID]
+		if override.BackupSchedule != nil {
+			options.BackupSchedule = *override.BackupSchedule
+		}
+		if override.DailyBackups != nil {
+			options.BackupRetention.Daily = *override.DailyBackups
+		}
+		if override.WeeklyBackups != nil {
+			options.BackupRetention.Weekly = *override.WeeklyBackups
+		}
+		if override.OplogRetention != nil {
+			options.OplogRetention = time.Duration(*override.OplogRetention)
+		}
+		plans[planID] = options
+	}
+
+	return problems
+}
+
+// planName returns the catalog name of a plan.
+func planName(planID string) string {
+	for _, plan := range servicePlans {
+		if plan.ID == planID {
+			return plan.Name
+		}
+	}
+
+	return planID
+}
+
+// ValidateCatalog checks the services and plans advertised in the catalog
+// against the broker API rules and the options of the plans, returning
+// every problem found.
+func ValidateCatalog() []error {
+	problems := []error{}
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	services := catalog().Services
+	if len(services) == 0 {
+		fail("the catalog has no service")
+	}
+
+	ids := map[string]string{}
+	serviceNames := map[string]bool{}
+	for _, service := range services {
+		where := "service " + strconv.Quote(service.Name)
+
+		switch {
+		case service.Name == "":
+			fail("a service has no name")
+		case serviceNames[service.Name]:
+			fail("%s: the name is used by another service", where)
+		}
+		serviceNames[service.Name] = true
+
+		if service.Description == "" {
+			fail("%s: the description is empty", where)
+		}
+
+		if !isUUID(service.ID) {
+			fail("%s: the id %q is not a UUID", where, service.ID)
+		} else if other, ok := ids[service.ID]; ok {
+			fail("%s: the id is also used by %s", where, other)
+		}
+		ids[service.ID] = where
+
+		if _, ok := engines[service.ID]; !ok {
+			fail("%s: no database engine runs the service", where)
+		}
+
+		if len(service.Plans) == 0 {
+			fail("%s: the service has no plan", where)
+		}
+
+		planNames := map[string]bool{}
+		for _, plan := range service.Plans {
+			problems = append(problems,
+				validatePlan(where, plan, ids, planNames)...)
+		}
+	}
+
+	return problems
+}
+
+// validatePlan checks a plan of a service, recording its id and name in
+// the ones already used.
+func validatePlan(service string, plan model.ServicePlan,
+	ids map[string]string, names map[string]bool) []error {
+
+	problems := []error{}
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	where := service + " plan " + strconv.Quote(plan.Name)
+
+	switch {
+	case plan.Name == "":
+		fail("%s: a plan has no name", service)
+	case names[plan.Name]:
+		fail("%s: the name is used by another plan", where)
+	}
+	names[plan.Name] = true
+
+	if plan.Description == "" {
+		fail("%s: the description is empty", where)
+	}
+
+	if !isUUID(plan.ID) {
+		fail("%s: the id %q is not a UUID", where, plan.ID)
+	} else if other, ok := ids[plan.ID]; ok {
+		fail("%s: the id is also used by %s", where, other)
+	}
+	ids[plan.ID] = where
+
+	options, ok := plans[plan.ID]
+	if !ok {
+		fail("%s: the plan has no options", where)
+		return problems
+	}
+
+	if options.BackupSchedule != "" {
+		if _, err := backup.ParseSchedule(options.BackupSchedule); err != nil {
+			fail("%s: backup schedule %q: %v", where, options.BackupSchedule,
+				err)
+		}
+	}
+
+	if options.ReplicaSet {
+		kept := time.Duration(options.BackupRetention.Daily) * 24 * time.Hour
+		switch {
+		case options.OplogRetention <= 0:
+			fail("%s: a replica set plan needs an oplog retention", where)
+		case kept <= options.OplogRetention:
+			fail("%s: the %d daily backups kept do not cover the %s oplog "+
+				"retention", where, options.BackupRetention.Daily,
+				options.OplogRetention)
+		}
+	} else if options.OplogRetention > 0 {
+		fail("%s: only replica set plans archive their oplog", where)
+	}
+
+	return problems
+}
@@ -0,0 +1,295 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/audit"
+	"github.com/cloudfoundry-community/cf-nosql-broker/container"
+	"github.com/cloudfoundry-community/cf-nosql-broker/database"
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+	"github.com/cloudfoundry-community/cf-nosql-broker/model"
+	"github.com/cloudfoundry-community/cf-nosql-broker/security"
+	"github.com/cloudfoundry-community/cf-nosql-broker/state"
+)
+
+const provisionOperation = "provision"
+
+// provisionRequest is a validated provision, ready to create the resources
+// of its instance.
+type provisionRequest struct {
+	instanceID string
+	body       *model.ProvisionBody
+	engine     database.Engine
+	options    planOptions
+	source     *restoreSource
+}
+
+// provisionInstance creates the container of an instance, restores its
+// backup if requested and saves its record. The caller must hold the
+// instance with beginOperation.
+func provisionInstance(log *logging.Logger, request provisionRequest) error {
+	instanceID, body := request.instanceID, request.body
+	engine, options, source := request.engine, request.options, request.source
+
+	start := time.Now()
+	succeeded := false
+	defer func() {
+		observeOperation(provisionDuration, start, body.PlanID, succeeded)
+	}()
+
+	// Every resource created from here on is released if a later step fails
+	created := rollback{log: log}
+
+	port, err := reservePort()
+	if err != nil {
+		log.Error("Error reserving a port", "error", err)
+		return err
+	}
+	defer releasePort(port)
+
+	// Every instance gets its own root credential, generated here and never
+	// returned to Cloud Foundry.
+	password, err := security.GeneratePassword(adminPasswordLength)
+	if err != nil {
+		log.Error("Error generating credentials", "error", err)
+		return err
+	}
+
+	sealedPassword, err := security.Seal(broker.SecretKey, password)
+	if err != nil {
+		log.Error("Error sealing credentials", "error", err)
+		return err
+	}
+
+	server := database.Server{
+		ContainerName: containerName(instanceID),
+		HostPort:      port,
+		Admin: database.Admin{
+			UserName: adminUserName,
+			Password: password,
+		},
+		TLS:        options.TLS,
+		ReplicaSet: options.ReplicaSet,
+	}
+
+	if options.ReplicaSet {
+		server.KeyFile, err = security.GeneratePassword(replicaSetKeyLength)
+		if err != nil {
+			log.Error("Error generating the replica set key", "error", err)
+			return err
+		}
+	}
+
+	// Without a record the container can only be left over from a failed
+	// attempt, and would make the new one fail on a name conflict
+	err = removeOrphanedContainer(server.ContainerName)
+	if err != nil {
+		log.Error("Error removing the orphaned container", "error", err)
+		return err
+	}
+
+	if options.TLS {
+		server.Certificate, err = issueServerCertificate(server.ContainerName)
+		if err != nil {
+			log.Error("Error issuing the server certificate", "error", err)
+			return err
+		}
+
+		created.add("the certificate of "+server.ContainerName, func() error {
+			return broker.Authority.Forget(server.ContainerName)
+		})
+	}
+
+	// The container may be left behind by a failed run should the broker
+	// stop before Run removes it, so the removal is recorded before running it
+	created.add("the container "+server.ContainerName, func() error {
+		return removeOrphanedContainer(server.ContainerName)
+	})
+
+	// The labels let the reconciler recognize the container and adopt it,
+	// once marked as provisioned, should its record be lost
+	runOptions := engine.RunOptions(server)
+	runOptions.Labels = map[string]string{
+		labelInstanceID:     instanceID,
+		labelServiceID:      body.ServiceID,
+		labelPlanID:         body.PlanID,
+		labelOrganizationID: body.OrganizationID,
+		labelSpaceID:        body.SpaceID,
+	}
+
+	err = container.Run(runOptions)
+	if err != nil {
+		log.Error("Error running the container", "error", err)
+		created.run()
+		return err
+	}
+
+	if options.ReplicaSet {
+		err = initiateReplicaSet(server, engine)
+		if err != nil {
+			log.Error("Error initiating the replica set", "error", err)
+			created.run()
+			return err
+		}
+	}
+
+	if source != nil {
+		err = restoreBackup(server, engine, *source)
+		if err != nil {
+			log.Error("Error restoring the backup", "backup_id",
+				source.Backup.ID, "error", err)
+			created.run()
+			return err
+		}
+	}
+
+	// Only now may the reconciler adopt the container should its record be
+	// lost
+	err = container.WriteFile(server.ContainerName, provisionedMarker,
+		[]byte(time.Now().UTC().Format(time.RFC3339)))
+	if err != nil {
+		log.Error("Error marking the container as provisioned", "error", err)
+		created.run()
+		return err
+	}
+
+	instance := state.Instance{
+		ID:             instanceID,
+		ServiceID:      body.ServiceID,
+		PlanID:         body.PlanID,
+		OrganizationID: body.OrganizationID,
+		SpaceID:        body.SpaceID,
+		ContainerName:  server.ContainerName,
+		HostPort:       port,
+		AdminUserName:  adminUserName,
+		AdminPassword:  sealedPassword,
+		TLS:            options.TLS,
+		ReplicaSet:     options.ReplicaSet,
+		CreatedAt:      time.Now().UTC(),
+	}
+
+	description := "Plan " + planName(body.PlanID) + " on port " + port
+	if source != nil {
+		instance.RestoredFrom = source.Backup.ID
+		description += " restored from backup " + source.Backup.ID
+		if !source.PointInTime.IsZero() {
+			description += " to " + source.PointInTime.Format(time.RFC3339)
+		}
+		instance.Parameters = map[string]interface{}{
+			"restore_from": appliedRestoreSource(*source),
+		}
+	}
+
+	err = broker.Store.PutInstance(instance)
+	if err != nil {
+		log.Error("Error saving the instance", "error", err)
+		created.run()
+		return err
+	}
+
+	recordOperation(instanceID, provisionOperation, description, true)
+	succeeded = true
+
+	log.Info("Database service created", "container", server.ContainerName,
+		"port", port)
+	return nil
+}
+
+// provisionInBackground runs an accepted provision, keeping its outcome for
+// InstanceLastOperation and recording it in the audit log. The instance is
+// released with endOperation once done.
+func provisionInBackground(log *logging.Logger, entry audit.Entry,
+	request provisionRequest) {
+
+	defer endOperation(request.instanceID)
+
+	err := provisionInstance(log, request)
+
+	// A successful provision is completed by the record of its instance
+	entry.Outcome = audit.Succeeded
+	if err != nil {
+		failProvision(log, request.instanceID, provisionError)
+		entry.Outcome = audit.Failed
+		entry.Description = provisionError
+	}
+
+	recordAudit(log, entry)
+}
+
+// acceptProvision records an asynchronous provision as in progress.
+func acceptProvision(instanceID string) error {
+	return broker.Store.PutProvision(state.Provision{
+		InstanceID: instanceID,
+		State:      state.OperationInProgress,
+		AcceptedAt: time.Now().UTC(),
+	})
+}
+
+// failProvision records an asynchronous provision as failed, reported to the
+// platform until the instance is provisioned again or deleted.
+func failProvision(log *logging.Logger, instanceID, description string) {
+	provision, ok := broker.Store.Provision(instanceID)
+	if !ok {
+		return
+	}
+
+	provision.State = state.OperationFailed
+	provision.StateDescription = description
+	if err := broker.Store.PutProvision(provision); err != nil {
+		log.Error("Error saving the provision", "error", err,
+			"instance_id", instanceID)
+	}
+}
+
+// forgetProvision drops the state of an asynchronous provision.
+func forgetProvision(log *logging.Logger, instanceID string) {
+	if err := broker.Store.DeleteProvision(instanceID); err != nil {
+		log.Error("Error deleting the provision", "error", err,
+			"instance_id", instanceID)
+	}
+}
+
+// provisionState returns the state of an asynchronous provision without a
+// record in the Store.
+func provisionState(instanceID string) (model.LastOperationResponse, bool) {
+	provision, ok := broker.Store.Provision(instanceID)
+	if !ok {
+		return model.LastOperationResponse{}, false
+	}
+
+	return model.LastOperationResponse{
+		State:       provision.State,
+		Description: provision.StateDescription,
+	}, true
+}
+
+// failInterruptedProvisions marks as failed the asynchronous provisions
+// still in progress, no goroutine being left to complete them. The platform
+// then deletes their instance, which removes what they created.
+func failInterruptedProvisions(log *logging.Logger) {
+	for _, provision := range broker.Store.Provisions() {
+		if provision.State != state.OperationInProgress {
+			continue
+		}
+
+		failProvision(log, provision.InstanceID, errorInterrupted)
+		log.Warning("Provision interrupted", "instance_id",
+			provision.InstanceID)
+	}
+}
@@ -0,0 +1,411 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/container"
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+	"github.com/cloudfoundry-community/cf-nosql-broker/model"
+	"github.com/cloudfoundry-community/cf-nosql-broker/security"
+	"github.com/cloudfoundry-community/cf-nosql-broker/state"
+	"github.com/gorilla/mux"
+)
+
+const (
+	labelInstanceID     = "cf-nosql-broker.instance_id"
+	labelServiceID      = "cf-nosql-broker.service_id"
+	labelPlanID         = "cf-nosql-broker.plan_id"
+	labelOrganizationID = "cf-nosql-broker.organization_guid"
+	labelSpaceID        = "cf-nosql-broker.space_guid"
+
+	// provisionedMarker is written into a container once its provision
+	// completed, as the labels cannot change after it is created. Only
+	// marked containers are adopted, a provision interrupted halfway leaving
+	// an incomplete database behind.
+	provisionedMarker = "/etc/cf-nosql-broker.provisioned"
+
+	// driftUnknownContainer is a container without record the reconciler
+	// could not adopt, driftMissingContainer a record whose container is
+	// gone.
+	driftUnknownContainer = "unknown_container"
+	driftMissingContainer = "missing_container"
+
+	reconcileError        = "Error comparing the broker state with the containers."
+	errorContainerMissing = "The container of the service instance no longer exists." // nolint: lll
+	errorDriftNotFound    = "No drift is reported for the container."
+	errorNotLabeled       = "the container has no broker labels for this instance"
+	errorNotProvisioned   = "the provision of the container never completed"
+	errorPlanMismatch     = "the container does not match the labeled plan"
+)
+
+// drift is a difference between the broker state and the containers that
+// needs an operator.
+type drift struct {
+	Kind          string    `json:"kind"`
+	InstanceID    string    `json:"instance_id"`
+	ContainerName string    `json:"container_name"`
+	Description   string    `json:"description"`
+	DetectedAt    time.Time `json:"detected_at"`
+}
+
+// reconcileState compares the broker state with the containers at startup
+// and then every broker.ReconcileInterval.
+func reconcileState() {
+	log := logging.With("operation", "reconcile")
+
+	for {
+		found, err := reconcile(true)
+		if err != nil {
+			log.Warning("Reconciling the broker state failed", "error", err)
+		}
+
+		for _, d := range found {
+			log.Warning(d.Description, "drift", d.Kind, "instance_id",
+				d.InstanceID, "container", d.ContainerName)
+		}
+
+		if broker.ReconcileInterval <= 0 {
+			return
+		}
+
+		if !pause(broker.ReconcileInterval) {
+			return
+		}
+	}
+}
+
+// reconcile compares the broker state with the containers and returns what
+// is left for an operator to resolve. With fix, it adopts the labeled
+// containers that have no record and marks the instances whose container is
+// gone as failed, which releases their port. Without, it changes nothing and
+// leaves out the containers it would adopt. Instances with an operation in
+// progress are left alone.
+func reconcile(fix bool) ([]drift, error) {
+	containers, err := container.List(containerPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	found := []drift{}
+	existing := map[string]bool{}
+
+	for _, c := range containers {
+		if strings.HasPrefix(c.Name, verificationPrefix) {
+			continue
+		}
+		existing[c.Name] = true
+
+		instanceID := strings.TrimPrefix(c.Name, containerPrefix)
+		if fix {
+			if !beginOperation(instanceID) {
+				continue
+			}
+
+			err = adoptContainer(instanceID, c.Name)
+			endOperation(instanceID)
+		} else {
+			if operationInProgress(instanceID) {
+				continue
+			}
+
+			if _, ok := broker.Store.Instance(instanceID); !ok {
+				_, err = recoverInstance(instanceID, c.Name)
+			}
+		}
+
+		if err != nil {
+			found = append(found, drift{
+				Kind:          driftUnknownContainer,
+				InstanceID:    instanceID,
+				ContainerName: c.Name,
+				Description:   "The container has no record: " + err.Error(),
+				DetectedAt:    time.Now().UTC(),
+			})
+		}
+	}
+
+	for _, instance := range broker.Store.Instances() {
+		var missing bool
+		listed := existing[instance.ContainerName]
+
+		if fix {
+			if !beginOperation(instance.ID) {
+				continue
+			}
+
+			missing, err = checkContainer(instance, listed)
+			endOperation(instance.ID)
+		} else {
+			if operationInProgress(instance.ID) {
+				continue
+			}
+
+			var exists bool
+			exists, err = containerExists(instance.ContainerName, listed)
+			missing = !exists
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if missing {
+			found = append(found, drift{
+				Kind:          driftMissingContainer,
+				InstanceID:    instance.ID,
+				ContainerName: instance.ContainerName,
+				Description:   errorContainerMissing,
+				DetectedAt:    time.Now().UTC(),
+			})
+		}
+	}
+
+	return found, nil
+}
+
+// adoptContainer saves the record rebuilt by recoverInstance. It does
+// nothing when the record exists, which happens when a provision completed
+// since the containers were listed.
+func adoptContainer(instanceID, name string) error {
+	if _, ok := broker.Store.Instance(instanceID); ok {
+		return nil
+	}
+
+	instance, err := recoverInstance(instanceID, name)
+	if err != nil {
+		return err
+	}
+
+	if err = broker.Store.PutInstance(instance); err != nil {
+		return err
+	}
+
+	logging.Info("Container adopted", "operation", "reconcile",
+		"instance_id", instanceID, "container", name, "port",
+		instance.HostPort)
+	recordOperation(instanceID, "reconcile", "Container "+name+
+		" adopted on port "+instance.HostPort, true)
+
+	return nil
+}
+
+// recoverInstance rebuilds the record of a container from its labels and
+// configuration, refusing the containers whose provision never completed.
+func recoverInstance(instanceID, name string) (state.Instance, error) {
+	details, err := container.Describe(name)
+	if err != nil {
+		return state.Instance{}, err
+	}
+
+	labels := details.Labels
+	if labels[labelInstanceID] != instanceID {
+		return state.Instance{}, errors.New(errorNotLabeled)
+	}
+
+	// Any error reading the marker leaves the container to an operator
+	if _, err = container.ReadFile(name, provisionedMarker); err != nil {
+		return state.Instance{}, errors.New(errorNotProvisioned)
+	}
+
+	engine, ok := engines[labels[labelServiceID]]
+	if !ok {
+		return state.Instance{}, errors.New(errorServiceNotFound)
+	}
+
+	options, ok := plans[labels[labelPlanID]]
+	if !ok {
+		return state.Instance{}, errors.New(errorPlanNotFound)
+	}
+
+	server, err := engine.RecoverServer(name, details)
+	if err != nil {
+		return state.Instance{}, err
+	}
+
+	if server.TLS != options.TLS || server.ReplicaSet != options.ReplicaSet {
+		return state.Instance{}, errors.New(errorPlanMismatch)
+	}
+
+	sealedPassword, err := security.Seal(broker.SecretKey,
+		server.Admin.Password)
+	if err != nil {
+		return state.Instance{}, err
+	}
+
+	return state.Instance{
+		ID:             instanceID,
+		ServiceID:      labels[labelServiceID],
+		PlanID:         labels[labelPlanID],
+		OrganizationID: labels[labelOrganizationID],
+		SpaceID:        labels[labelSpaceID],
+		ContainerName:  name,
+		HostPort:       server.HostPort,
+		AdminUserName:  server.Admin.UserName,
+		AdminPassword:  sealedPassword,
+		TLS:            server.TLS,
+		ReplicaSet:     server.ReplicaSet,
+		CreatedAt:      time.Now().UTC(),
+	}, nil
+}
+
+// checkContainer marks an instance as failed when its container is gone and
+// clears the mark when it is back. It reports whether the container is
+// missing. A container not listed is looked up again, as it may have been
+// created since the containers were listed.
+func checkContainer(instance state.Instance, listed bool) (bool, error) {
+	// The instance may have been deleted since it was read
+	instance, ok := broker.Store.Instance(instance.ID)
+	if !ok {
+		return false, nil
+	}
+
+	exists, err := containerExists(instance.ContainerName, listed)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case !exists && instance.State != state.OperationFailed:
+		instance.State = state.OperationFailed
+		instance.StateDescription = errorContainerMissing
+		if err = broker.Store.PutInstance(instance); err != nil {
+			return true, err
+		}
+
+		logging.Warning("The container no longer exists, port released",
+			"operation", "reconcile", "instance_id", instance.ID,
+			"port", instance.HostPort)
+		recordOperation(instance.ID, "reconcile", errorContainerMissing, false)
+
+	case exists && instance.StateDescription == errorContainerMissing:
+		instance.State = ""
+		instance.StateDescription = ""
+		if err = broker.Store.PutInstance(instance); err != nil {
+			return false, err
+		}
+
+		logging.Info("The container is back", "operation", "reconcile",
+			"instance_id", instance.ID)
+		recordOperation(instance.ID, "reconcile", "The container "+
+			instance.ContainerName+" is back", true)
+	}
+
+	return !exists, nil
+}
+
+// containerExists reports whether a container exists, looking it up when it
+// was not listed.
+func containerExists(name string, listed bool) (bool, error) {
+	if listed {
+		return true, nil
+	}
+
+	return container.Exists(name)
+}
+
+// ListDrift compares the broker state with the containers and returns the
+// differences left for an operator to resolve, without changing either.
+func ListDrift(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Listing the drift from the broker state")
+
+	found, err := reconcile(false)
+	if err != nil {
+		log.Error("Reconciling the broker state failed", "error", err)
+		response := model.ErrorResponse{
+			Description: reconcileError,
+		}
+		writeResponse(w, http.StatusInternalServerError, response)
+		return
+	}
+
+	log.Info("Drift listed", "count", len(found))
+	writeResponse(w, http.StatusOK, found)
+}
+
+// ResolveDrift removes a container without record, or forgets the record of
+// an instance whose container is gone.
+func ResolveDrift(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Resolving a drift from the broker state")
+
+	name := mux.Vars(r)["container_name"]
+
+	found, err := reconcile(false)
+	if err != nil {
+		log.Error("Reconciling the broker state failed", "error", err)
+		response := model.ErrorResponse{
+			Description: reconcileError,
+		}
+		writeResponse(w, http.StatusInternalServerError, response)
+		return
+	}
+
+	var resolved *drift
+	for i := range found {
+		if found[i].ContainerName == name {
+			resolved = &found[i]
+		}
+	}
+
+	if resolved == nil {
+		log.Warning(errorDriftNotFound)
+		response := model.ErrorResponse{
+			Description: errorDriftNotFound,
+		}
+		writeResponse(w, http.StatusNotFound, response)
+		return
+	}
+
+	if !beginOperation(resolved.InstanceID) {
+		log.Warning(errorOperationInProgress)
+		response := model.ErrorResponse{
+			Error:       concurrencyError,
+			Description: errorOperationInProgress,
+		}
+		writeResponse(w, http.StatusUnprocessableEntity, response)
+		return
+	}
+	defer endOperation(resolved.InstanceID)
+
+	if resolved.Kind == driftUnknownContainer {
+		err = container.Remove(name)
+	} else {
+		err = broker.Store.DeleteInstance(resolved.InstanceID)
+		if err == nil {
+			forgetHealth(resolved.InstanceID)
+			err = broker.Authority.Forget(name)
+		}
+	}
+
+	if err != nil {
+		log.Error("Resolving the drift failed", "error", err)
+		response := model.ErrorResponse{
+			Description: err.Error(),
+		}
+		writeResponse(w, http.StatusInternalServerError, response)
+		return
+	}
+
+	log.Info("Drift resolved", "drift", resolved.Kind, "container", name)
+	writeResponse(w, http.StatusOK, resolved)
+}
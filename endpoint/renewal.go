@@ -0,0 +1,86 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/database"
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+)
+
+const renewalInterval = time.Hour
+
+// renewCertificates periodically re-issues the server certificates of the
+// TLS enabled instances before they expire.
+func renewCertificates() {
+	for {
+		renewExpiringCertificates(time.Now())
+		if !pause(renewalInterval) {
+			return
+		}
+	}
+}
+
+// renewExpiringCertificates installs a new certificate in every TLS enabled
+// instance whose certificate entered its renewal window.
+func renewExpiringCertificates(now time.Time) {
+	for _, instance := range broker.Store.Instances() {
+		if !instance.TLS ||
+			!broker.Authority.NeedsRenewal(instance.ContainerName, now) {
+			continue
+		}
+
+		server, engine, err := instanceServer(instance)
+		if err == nil {
+			server.Certificate, err = renewServerCertificate(server)
+		}
+		if err == nil {
+			err = engine.RotateCertificate(server, server.Certificate)
+		}
+
+		if err != nil {
+			logging.Error("Renewing the certificate failed", "operation",
+				"renew_certificate", "instance_id", instance.ID, "error", err)
+			continue
+		}
+
+		logging.Info("Certificate renewed", "operation", "renew_certificate",
+			"instance_id", instance.ID)
+	}
+}
+
+// renewServerCertificate re-issues the certificate of an instance, falling
+// back to a new one for instances that have no record in the authority.
+func renewServerCertificate(server database.Server) (
+	database.Certificate, error) {
+
+	if _, ok := broker.Authority.Current(server.ContainerName); !ok {
+		return issueServerCertificate(server.ContainerName)
+	}
+
+	certPEM, keyPEM, err := broker.Authority.Renew(server.ContainerName)
+	if err != nil {
+		return database.Certificate{}, err
+	}
+
+	return database.Certificate{
+		CertificatePEM: certPEM,
+		PrivateKeyPEM:  keyPEM,
+		AuthorityPEM:   broker.Authority.CertificatePEM(),
+	}, nil
+}
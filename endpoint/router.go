@@ -18,32 +18,157 @@ package endpoint
 
 import (
 	"crypto/tls"
-	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/cloudfoundry-community/cf-nosql-broker/audit"
+	"github.com/cloudfoundry-community/cf-nosql-broker/backup"
+	"github.com/cloudfoundry-community/cf-nosql-broker/database"
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+	"github.com/cloudfoundry-community/cf-nosql-broker/security"
+	"github.com/cloudfoundry-community/cf-nosql-broker/state"
 	"github.com/gorilla/mux"
 )
 
+// Broker holds the components shared by the endpoint handlers.
+type Broker struct {
+	// Store persists the instances and bindings managed by the broker.
+	Store *state.Store
+	// SecretKey seals the database credentials kept in the Store.
+	SecretKey []byte
+	// SigningKey signs the dashboard links and sessions. It is derived from
+	// the SecretKey, which is only used for sealing.
+	SigningKey []byte
+	// Hostname is the address applications use to reach the databases.
+	Hostname string
+	// Image is the Docker image of the MongoDB containers.
+	Image string
+	// FirstHostPort and LastHostPort bound the pool of host ports published
+	// by the instances.
+	FirstHostPort int
+	LastHostPort  int
+	// Authority issues the server certificates of the TLS enabled instances.
+	Authority *security.Authority
+	// UserName and Password are the credentials the platform registered the
+	// broker with, required on every service broker API request when set.
+	UserName string
+	Password string
+	// URL is the external address of the broker, used to build the
+	// dashboard links.
+	URL string
+	// DashboardTTL is how long a dashboard link remains valid.
+	DashboardTTL time.Duration
+	// SSO enables the dashboard single sign-on, nil when not configured.
+	SSO *SSO
+	// Backups takes and stores the backups of the instances.
+	Backups *backup.Manager
+	// VerificationInterval is how often a recent backup is restored into a
+	// throwaway container to verify it, 0 to disable.
+	VerificationInterval time.Duration
+	// ReconcileInterval is how often the broker state is compared with the
+	// containers after the comparison made at startup, 0 to disable.
+	ReconcileInterval time.Duration
+	// HealthInterval is how often the health of the instances is probed, 0
+	// to disable the health monitor.
+	HealthInterval time.Duration
+	// Operators hold the credentials of the administration API, which is
+	// disabled when there is none.
+	Operators []Operator
+	// Audit records who asked for which action on the instances, nil to
+	// disable it.
+	Audit *audit.Log
+	// ShutdownTimeout bounds the wait for the requests being served and the
+	// background tasks when the broker is asked to stop.
+	ShutdownTimeout time.Duration
+	// MetricsUserName and MetricsPassword protect the /metrics endpoint,
+	// which is open when they are empty.
+	MetricsUserName string
+	MetricsPassword string
+}
+
+var broker Broker
+
 // Start enables the service broker endpoints and specified their handlers.
-func Start(port string, tlsConfig *tls.Config) {
+// It returns once the server failed, or after a graceful shutdown when the
+// broker receives SIGTERM or SIGINT.
+func Start(port string, tlsConfig *tls.Config, b Broker) {
+	broker = b
+	engines[mongoServiceID] = database.MongoDB{Image: b.Image}
+
+	if err := parseBackupSchedules(); err != nil {
+		logging.Error("Invalid backup schedule", "error", err)
+		return
+	}
+
+	// No goroutine survived the previous run to complete these provisions
+	// and bindings
+	failInterruptedProvisions(logging.With("operation", "startup"))
+	failInterruptedBindings(logging.With("operation", "startup"))
+
+	startTask(reconcileState)
+	startTask(renewCertificates)
+	startTask(scheduleBackups)
+	startTask(archiveOplogs)
+	startTask(verifyBackups)
+	startTask(monitorHealth)
+
 	// nolint: lll
 	router := mux.NewRouter()
-	router.HandleFunc("/v2/catalog", GetCatalog).Methods("GET")
-	router.HandleFunc("/v2/service_instances/{instance_id}", Provision).Methods("PUT")
-	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", Bind).Methods("PUT")
-	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", UnBind).Methods("DELETE")
-	router.HandleFunc("/v2/service_instances/{instance_id}", Deprovision).Methods("DELETE")
+	router.HandleFunc("/v2/catalog", instrument("catalog", platformAuth(GetCatalog))).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}", instrument("provision", platformAuth(audited(audit.Provision, Provision)))).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", instrument("fetch_instance", platformAuth(GetInstance))).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/last_operation", instrument("instance_last_operation", platformAuth(InstanceLastOperation))).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", instrument("bind", platformAuth(audited(audit.Bind, Bind)))).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", instrument("fetch_binding", platformAuth(GetBinding))).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}/last_operation", instrument("binding_last_operation", platformAuth(BindingLastOperation))).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", instrument("unbind", platformAuth(audited(audit.Unbind, UnBind)))).Methods("DELETE")
+	router.HandleFunc("/v2/service_instances/{instance_id}", instrument("deprovision", platformAuth(audited(audit.Deprovision, Deprovision)))).Methods("DELETE")
+	router.HandleFunc("/metrics", traced("metrics", metricsAuth(Metrics))).Methods("GET")
+	router.HandleFunc(ssoCallbackPath, traced("sso_callback", SSOCallback)).Methods("GET")
+	router.HandleFunc(adminPath+"/instances", traced("list_instances", adminAuth(RoleViewer, ListInstances))).Methods("GET")
+	router.HandleFunc(adminPath+"/instances/{instance_id}", traced("inspect_instance", adminAuth(RoleViewer, GetAdminInstance))).Methods("GET")
+	router.HandleFunc(adminPath+"/instances/{instance_id}/dashboard", traced("dashboard_link", adminAuth(RoleViewer, DashboardLink))).Methods("GET")
+	router.HandleFunc(adminPath+"/instances/{instance_id}", traced("force_delete", adminAuth(RoleOperator, audited(audit.Deprovision, ForceDeleteInstance)))).Methods("DELETE")
+	router.HandleFunc(adminPath+"/instances/{instance_id}/restart", traced("restart_instance", adminAuth(RoleOperator, RestartInstance))).Methods("POST")
+	router.HandleFunc(adminPath+"/instances/{instance_id}/stop", traced("stop_instance", adminAuth(RoleOperator, StopInstance))).Methods("POST")
+	router.HandleFunc(adminPath+"/instances/{instance_id}/start", traced("start_instance", adminAuth(RoleOperator, StartInstance))).Methods("POST")
+	router.HandleFunc(adminPath+"/instances/{instance_id}/restore", traced("restore_backup", adminAuth(RoleOperator, RestoreBackup))).Methods("POST")
+	router.HandleFunc(adminPath+"/bindings", traced("list_bindings", adminAuth(RoleViewer, ListAdminBindings))).Methods("GET")
+	router.HandleFunc(adminPath+"/ports", traced("list_ports", adminAuth(RoleViewer, ListPorts))).Methods("GET")
+	router.HandleFunc(adminPath+"/instances/{instance_id}/backups", traced("create_backup", adminAuth(RoleOperator, CreateBackup))).Methods("POST")
+	router.HandleFunc(adminPath+"/instances/{instance_id}/backups", traced("list_backups", adminAuth(RoleViewer, ListBackups))).Methods("GET")
+	router.HandleFunc(adminPath+"/metrics", traced("admin_metrics", adminAuth(RoleViewer, Metrics))).Methods("GET")
+	router.HandleFunc(adminPath+"/backups/rewrap_keys", traced("rewrap_backup_keys", adminAuth(RoleOperator, RewrapBackupKeys))).Methods("POST")
+	router.HandleFunc(adminPath+"/instances/{instance_id}/recovery_window", traced("recovery_window", adminAuth(RoleViewer, GetRecoveryWindow))).Methods("GET")
+	router.HandleFunc(adminPath+"/drift", traced("list_drift", adminAuth(RoleViewer, ListDrift))).Methods("GET")
+	router.HandleFunc(adminPath+"/audit", traced("audit", adminAuth(RoleViewer, ListAudit))).Methods("GET")
+	router.HandleFunc(adminPath+"/drift/{container_name}", traced("resolve_drift", adminAuth(RoleOperator, ResolveDrift))).Methods("DELETE")
+	router.HandleFunc(dashboardPath+"{instance_id}", traced("dashboard", Dashboard)).Methods("GET")
 
 	http.Handle("/", router)
 
-	server := http.Server{
+	server := &http.Server{
 		Addr:      ":" + port,
 		TLSConfig: tlsConfig,
 	}
 
-	log.Println("Server started, listening on port " + port)
-	err := server.ListenAndServeTLS("", "")
-	if err != nil {
-		log.Printf("[FATAL ERROR] %s \n", err)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServeTLS("", "")
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	logging.Info("Server started", "port", port)
+	select {
+	case err := <-served:
+		logging.Error("Server stopped", "error", err)
+	case received := <-signals:
+		logging.Info("Signal received", "signal", received.String())
+		shutdown(server)
 	}
 }
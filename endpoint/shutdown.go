@@ -0,0 +1,167 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+	"github.com/cloudfoundry-community/cf-nosql-broker/state"
+)
+
+const errorInterrupted = "Interrupted by a shutdown of the broker."
+
+var (
+	// tasks counts the background goroutines the shutdown waits for.
+	tasks sync.WaitGroup
+	// draining is set once the shutdown waits for the tasks, which can no
+	// longer be started.
+	draining   bool
+	drainingMu sync.Mutex
+	// stopping is closed when the shutdown starts, waking up the periodic
+	// tasks so they return instead of starting another round.
+	stopping = make(chan struct{})
+)
+
+// startTask runs fn in a goroutine the shutdown waits for. It returns false,
+// without running fn, once the broker is draining.
+func startTask(fn func()) bool {
+	drainingMu.Lock()
+	defer drainingMu.Unlock()
+
+	if draining {
+		return false
+	}
+
+	tasks.Add(1)
+	go func() {
+		defer tasks.Done()
+		fn()
+	}()
+
+	return true
+}
+
+// pause waits for the given duration, returning false early when the broker
+// is shutting down.
+func pause(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-stopping:
+		return false
+	}
+}
+
+// shutdown stops accepting requests, waits for the ones being served and
+// then for the background tasks, up to broker.ShutdownTimeout, and records
+// what was left unfinished so the platform sees a final state.
+func shutdown(server *http.Server) {
+	log := logging.With("operation", "shutdown")
+	log.Info("Shutting down the broker", "timeout", broker.ShutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		broker.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warning("Requests still in progress at the deadline",
+			"error", err)
+	}
+
+	drainingMu.Lock()
+	draining = true
+	close(stopping)
+	drainingMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		tasks.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Info("Background tasks completed")
+	case <-ctx.Done():
+		log.Warning("Background tasks still in progress at the deadline")
+	}
+
+	recordInterrupted(log)
+	failInterruptedProvisions(log)
+	failInterruptedBindings(log)
+
+	if broker.Audit != nil {
+		if err := broker.Audit.Close(); err != nil {
+			log.Warning("Error closing the audit log", "error", err)
+		}
+	}
+
+	log.Info("Broker stopped")
+}
+
+// recordInterrupted adds an operation to the history of the instances whose
+// operation did not complete before the deadline. A container started by an
+// interrupted provision is reported as drift by the reconciler at the next
+// start, and removed by the orphan mitigation of the platform.
+func recordInterrupted(log *logging.Logger) {
+	inFlightMu.Lock()
+	instanceIDs := make([]string, 0, len(inFlight))
+	for instanceID := range inFlight {
+		instanceIDs = append(instanceIDs, instanceID)
+	}
+	inFlightMu.Unlock()
+
+	for _, instanceID := range instanceIDs {
+		if _, ok := broker.Store.Instance(instanceID); !ok {
+			continue
+		}
+
+		log.Warning("Operation interrupted", "instance_id", instanceID)
+		recordOperation(instanceID, "shutdown", errorInterrupted, false)
+	}
+}
+
+// failInterruptedBindings marks as failed the bindings whose database user
+// was still being created when the broker stopped, as nothing is left to
+// complete them.
+func failInterruptedBindings(log *logging.Logger) {
+	for _, instance := range broker.Store.Instances() {
+		for _, binding := range broker.Store.Bindings(instance.ID) {
+			if binding.State != state.OperationInProgress {
+				continue
+			}
+
+			binding.State = state.OperationFailed
+			binding.StateDescription = errorInterrupted
+			if err := broker.Store.PutBinding(binding); err != nil {
+				log.Error("Error saving the binding", "error", err,
+					"binding_id", binding.ID)
+				continue
+			}
+
+			log.Warning("Binding interrupted", "instance_id", instance.ID,
+				"binding_id", binding.ID)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/model"
+	"github.com/cloudfoundry-community/cf-nosql-broker/security"
+)
+
+const (
+	ssoCallbackPath     = dashboardPath + "sso/callback"
+	ssoScope            = "openid cloud_controller_service_permissions.read"
+	ssoNonceCookie      = "cf-nosql-broker-sso"
+	ssoSessionCookie    = "cf-nosql-broker-session"
+	ssoStateSubject     = "sso-state:"
+	ssoSessionSubject   = "sso-session:"
+	ssoStateTTL         = 10 * time.Minute
+	ssoSessionTTL       = time.Hour
+	ssoRequestTimeout   = 30 * time.Second
+	errorSSOState       = "The single sign-on request is not valid or has expired."
+	errorSSOFailed      = "The single sign-on with the platform failed."
+	errorSSOForbidden   = "You are not allowed to access this service instance."
+	errorSSOUnavailable = "unexpected response from "
+)
+
+// SSO configures the dashboard single sign-on with the platform UAA, using
+// the dashboard client advertised in the catalog.
+type SSO struct {
+	ClientID     string
+	ClientSecret string
+	// CloudControllerURL is the API address of the platform. The UAA
+	// endpoints are discovered from its /v2/info resource.
+	CloudControllerURL string
+	// SkipSSLValidation disables the certificate verification of the Cloud
+	// Controller and UAA, for development environments only.
+	SkipSSLValidation bool
+}
+
+// ssoEndpoints are the UAA addresses published by the Cloud Controller.
+type ssoEndpoints struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+var (
+	ssoMutex     sync.Mutex
+	ssoDiscovery *ssoEndpoints
+)
+
+// dashboardClient returns the client advertised in the catalog so the
+// platform registers it in UAA, or nil when single sign-on is disabled.
+func dashboardClient() *model.DashboardClient {
+	if broker.SSO == nil {
+		return nil
+	}
+
+	return &model.DashboardClient{
+		ID:          broker.SSO.ClientID,
+		Secret:      broker.SSO.ClientSecret,
+		RedirectURI: broker.URL + ssoCallbackPath,
+	}
+}
+
+// hasSSOSession checks the session cookie set after a successful sign-on.
+func hasSSOSession(r *http.Request, instanceID string) bool {
+	cookie, err := r.Cookie(ssoSessionCookie)
+	if err != nil {
+		return false
+	}
+
+	return security.VerifyToken(broker.SigningKey, ssoSessionSubject+instanceID,
+		cookie.Value, time.Now()) == nil
+}
+
+// redirectToSSO starts the authorization code flow for an instance
+// dashboard.
+func redirectToSSO(w http.ResponseWriter, r *http.Request, instanceID string) {
+	log := requestLog(r)
+
+	endpoints, err := discoverSSOEndpoints()
+	if err != nil {
+		log.Error("Error discovering the UAA", "error", err)
+		http.Error(w, errorSSOFailed, http.StatusBadGateway)
+		return
+	}
+
+	nonce := make([]byte, 16)
+	if _, err = rand.Read(nonce); err != nil {
+		log.Error("Error generating the sign-on nonce", "error", err)
+		http.Error(w, errorSSOFailed, http.StatusInternalServerError)
+		return
+	}
+
+	// The state ties the callback to the instance and to this browser
+	nonceValue := hex.EncodeToString(nonce)
+	state := instanceID + "." + nonceValue + "." + security.SignToken(
+		broker.SigningKey, ssoStateSubject+instanceID+"."+nonceValue,
+		time.Now().Add(ssoStateTTL))
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoNonceCookie,
+		Value:    nonceValue,
+		Path:     dashboardPath,
+		MaxAge:   int(ssoStateTTL.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+	})
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {broker.SSO.ClientID},
+		"redirect_uri":  {broker.URL + ssoCallbackPath},
+		"scope":         {ssoScope},
+		"state":         {state},
+	}
+
+	log.Info("Redirecting the dashboard sign-on to the UAA")
+	http.Redirect(w, r, strings.TrimSuffix(endpoints.AuthorizationEndpoint,
+		"/")+"/oauth/authorize?"+query.Encode(), http.StatusFound)
+}
+
+// SSOCallback completes the sign-on: it exchanges the authorization code for
+// an access token and asks the Cloud Controller whether the user can manage
+// the instance before opening a dashboard session.
+func SSOCallback(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	log.Info("Completing a dashboard sign-on")
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if broker.SSO == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	instanceID, err := verifySSOState(r)
+	if err != nil {
+		log.Warning("Dashboard sign-on denied", "error", err)
+		http.Error(w, errorSSOState, http.StatusForbidden)
+		return
+	}
+
+	accessToken, err := exchangeSSOCode(r.FormValue("code"))
+	if err != nil {
+		log.Error("Error requesting the access token", "error", err)
+		http.Error(w, errorSSOFailed, http.StatusBadGateway)
+		return
+	}
+
+	allowed, err := canManageInstance(accessToken, instanceID)
+	if err != nil {
+		log.Error("Error reading the instance permissions", "error", err)
+		http.Error(w, errorSSOFailed, http.StatusBadGateway)
+		return
+	}
+
+	if !allowed {
+		log.Warning(errorSSOForbidden)
+		http.Error(w, errorSSOForbidden, http.StatusForbidden)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name: ssoSessionCookie,
+		Value: security.SignToken(broker.SigningKey,
+			ssoSessionSubject+instanceID, time.Now().Add(ssoSessionTTL)),
+		Path:     dashboardPath + instanceID,
+		MaxAge:   int(ssoSessionTTL.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:   ssoNonceCookie,
+		Path:   dashboardPath,
+		MaxAge: -1,
+	})
+
+	log.Info("Dashboard session opened", "instance_id", instanceID)
+	http.Redirect(w, r, dashboardPath+instanceID, http.StatusFound)
+}
+
+// verifySSOState validates the state returned by the UAA against the nonce
+// cookie and returns the instance the sign-on was started for.
+func verifySSOState(r *http.Request) (string, error) {
+	parts := strings.SplitN(r.FormValue("state"), ".", 3)
+	if len(parts) != 3 || !isUUID(parts[0]) {
+		return "", errors.New(errorSSOState)
+	}
+
+	cookie, err := r.Cookie(ssoNonceCookie)
+	if err != nil || cookie.Value != parts[1] {
+		return "", errors.New(errorSSOState)
+	}
+
+	err = security.VerifyToken(broker.SigningKey,
+		ssoStateSubject+parts[0]+"."+parts[1], parts[2], time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	return parts[0], nil
+}
+
+// exchangeSSOCode trades an authorization code for an access token.
+func exchangeSSOCode(code string) (string, error) {
+	endpoints, err := discoverSSOEndpoints()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {broker.URL + ssoCallbackPath},
+	}
+
+	request, err := http.NewRequest("POST", strings.TrimSuffix(
+		endpoints.TokenEndpoint, "/")+"/oauth/token",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.SetBasicAuth(url.QueryEscape(broker.SSO.ClientID),
+		url.QueryEscape(broker.SSO.ClientSecret))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err = doSSORequest(request, &token); err != nil {
+		return "", err
+	}
+
+	if token.AccessToken == "" {
+		return "", errors.New(errorSSOUnavailable + request.URL.Host)
+	}
+
+	return token.AccessToken, nil
+}
+
+// canManageInstance asks the Cloud Controller whether the signed-in user can
+// manage an instance. Users who can only read it, such as space auditors,
+// are not given a dashboard session.
+func canManageInstance(accessToken, instanceID string) (bool, error) {
+	request, err := http.NewRequest("GET", strings.TrimSuffix(
+		broker.SSO.CloudControllerURL, "/")+"/v2/service_instances/"+
+		instanceID+"/permissions", nil)
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Authorization", "bearer "+accessToken)
+	request.Header.Set("Accept", "application/json")
+
+	var permissions struct {
+		Manage bool `json:"manage"`
+	}
+	if err = doSSORequest(request, &permissions); err != nil {
+		return false, err
+	}
+
+	return permissions.Manage, nil
+}
+
+// discoverSSOEndpoints reads the UAA addresses from the Cloud Controller
+// once and caches them.
+func discoverSSOEndpoints() (ssoEndpoints, error) {
+	ssoMutex.Lock()
+	defer ssoMutex.Unlock()
+
+	if ssoDiscovery != nil {
+		return *ssoDiscovery, nil
+	}
+
+	request, err := http.NewRequest("GET", strings.TrimSuffix(
+		broker.SSO.CloudControllerURL, "/")+"/v2/info", nil)
+	if err != nil {
+		return ssoEndpoints{}, err
+	}
+	request.Header.Set("Accept", "application/json")
+
+	var endpoints ssoEndpoints
+	if err = doSSORequest(request, &endpoints); err != nil {
+		return ssoEndpoints{}, err
+	}
+
+	if endpoints.AuthorizationEndpoint == "" || endpoints.TokenEndpoint == "" {
+		return ssoEndpoints{}, errors.New(errorSSOUnavailable +
+			request.URL.Host)
+	}
+
+	ssoDiscovery = &endpoints
+	return endpoints, nil
+}
+
+// doSSORequest sends a request to the Cloud Controller or UAA and decodes
+// its JSON response.
+func doSSORequest(request *http.Request, response interface{}) error {
+	client := http.Client{Timeout: ssoRequestTimeout}
+	if broker.SSO.SkipSSLValidation {
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // nolint: gas
+		}
+	}
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(errorSSOUnavailable + request.URL.Host + ": " +
+			resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(response)
+}
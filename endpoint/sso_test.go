@@ -0,0 +1,203 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newSSOServer starts a fake Cloud Controller and UAA and points the broker
+// at it. The handlers of the test are served next to /v2/info.
+func newSSOServer(t *testing.T, handlers map[string]http.HandlerFunc) (
+	*httptest.Server, *int) {
+
+	discoveries := 0
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+
+	mux.HandleFunc("/v2/info", func(w http.ResponseWriter, r *http.Request) {
+		discoveries++
+		writeJSON(t, w, map[string]string{
+			"authorization_endpoint": server.URL + "/login",
+			"token_endpoint":         server.URL + "/uaa",
+		})
+	})
+	for path, handler := range handlers {
+		mux.HandleFunc(path, handler)
+	}
+
+	broker = Broker{
+		URL: "https://broker.example.com",
+		SSO: &SSO{
+			ClientID:           "dashboard client",
+			ClientSecret:       "s3cret&",
+			CloudControllerURL: server.URL + "/",
+		},
+	}
+	ssoDiscovery = nil
+
+	t.Cleanup(func() {
+		server.Close()
+		broker = Broker{}
+		ssoDiscovery = nil
+	})
+
+	return server, &discoveries
+}
+
+func writeJSON(t *testing.T, w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDiscoverSSOEndpoints(t *testing.T) {
+	server, discoveries := newSSOServer(t, nil)
+
+	for i := 0; i < 2; i++ {
+		endpoints, err := discoverSSOEndpoints()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if endpoints.AuthorizationEndpoint != server.URL+"/login" ||
+			endpoints.TokenEndpoint != server.URL+"/uaa" {
+			t.Errorf("unexpected endpoints %+v", endpoints)
+		}
+	}
+
+	if *discoveries != 1 {
+		t.Errorf("expected the endpoints to be discovered once, got %d",
+			*discoveries)
+	}
+}
+
+func TestDiscoverSSOEndpointsIncomplete(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(t, w, map[string]string{"token_endpoint": "https://uaa"})
+		}))
+	defer server.Close()
+
+	broker = Broker{SSO: &SSO{CloudControllerURL: server.URL}}
+	ssoDiscovery = nil
+	defer func() { broker, ssoDiscovery = Broker{}, nil }()
+
+	if _, err := discoverSSOEndpoints(); err == nil {
+		t.Error("expected an error without an authorization endpoint")
+	}
+	if ssoDiscovery != nil {
+		t.Error("incomplete endpoints must not be cached")
+	}
+}
+
+func TestExchangeSSOCode(t *testing.T) {
+	newSSOServer(t, map[string]http.HandlerFunc{
+		"/uaa/oauth/token": func(w http.ResponseWriter, r *http.Request) {
+			userName, password, ok := r.BasicAuth()
+			if r.Method != "POST" || !ok ||
+				userName != "dashboard+client" || password != "s3cret%26" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			if r.FormValue("grant_type") != "authorization_code" ||
+				r.FormValue("code") != "the-code" ||
+				r.FormValue("redirect_uri") !=
+					"https://broker.example.com"+ssoCallbackPath {
+				http.Error(w, "invalid grant", http.StatusBadRequest)
+				return
+			}
+
+			writeJSON(t, w, map[string]string{"access_token": "the-token"})
+		},
+	})
+
+	token, err := exchangeSSOCode("the-code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "the-token" {
+		t.Errorf("expected the-token, got %q", token)
+	}
+
+	if _, err = exchangeSSOCode("another-code"); err == nil {
+		t.Error("expected an error when the code is rejected")
+	}
+}
+
+func TestExchangeSSOCodeWithoutToken(t *testing.T) {
+	newSSOServer(t, map[string]http.HandlerFunc{
+		"/uaa/oauth/token": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(t, w, map[string]string{"token_type": "bearer"})
+		},
+	})
+
+	if _, err := exchangeSSOCode("the-code"); err == nil {
+		t.Error("expected an error without an access token")
+	}
+}
+
+func TestCanManageInstance(t *testing.T) {
+	const instanceID = "9c5f3b1e-2f4b-4a4e-8a47-1f1e2d3c4b5a"
+
+	tests := []struct {
+		name        string
+		permissions map[string]bool
+		status      int
+		allowed     bool
+		fails       bool
+	}{
+		{"manage", map[string]bool{"manage": true, "read": true},
+			http.StatusOK, true, false},
+		{"read only", map[string]bool{"manage": false, "read": true},
+			http.StatusOK, false, false},
+		{"none", map[string]bool{}, http.StatusOK, false, false},
+		{"unknown instance", nil, http.StatusNotFound, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newSSOServer(t, map[string]http.HandlerFunc{
+				"/v2/service_instances/" + instanceID + "/permissions": func(
+					w http.ResponseWriter, r *http.Request) {
+
+					if r.Header.Get("Authorization") != "bearer the-token" {
+						http.Error(w, "unauthorized", http.StatusUnauthorized)
+						return
+					}
+					if test.status != http.StatusOK {
+						http.Error(w, "error", test.status)
+						return
+					}
+					writeJSON(t, w, test.permissions)
+				},
+			})
+
+			allowed, err := canManageInstance("the-token", instanceID)
+			if (err != nil) != test.fails {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if allowed != test.allowed {
+				t.Errorf("expected %v, got %v", test.allowed, allowed)
+			}
+		})
+	}
+}
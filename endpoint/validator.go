@@ -19,13 +19,16 @@ package endpoint
 import (
 	"errors"
 	"regexp"
+	"time"
 
 	"github.com/cloudfoundry-community/cf-nosql-broker/model"
 )
 
 const (
-	nullError    = "The field is requiered and cannot be null/empty"
-	notValidUUID = "The input provided is not a valid UUID."
+	nullError         = "The field is requiered and cannot be null/empty"
+	notValidUUID      = "The input provided is not a valid UUID."
+	notValidRestore   = "The restore_from parameter requires either a backup_id or an instance_id and a timestamp." // nolint: lll
+	notValidTimestamp = "The timestamp must be formatted as RFC 3339, e.g. 2017-06-01T10:00:00Z."                   // nolint: lll
 )
 
 // validateProvisionInputs validates request fields for create a database.
@@ -44,6 +47,40 @@ func validateProvisionInputs(
 		return errors.New(notValidUUID)
 	}
 
+	if body.Parameters.RestoreFrom != nil {
+		return validateRestoreSource(body.Parameters.RestoreFrom)
+	}
+
+	return nil
+}
+
+// validateRestoreSource validates the backup requested through the
+// restore_from provision parameter.
+func validateRestoreSource(source *model.RestoreSource) error {
+	if !isNull(source.BackupID) {
+		if !isNull(source.InstanceID) || !isNull(source.Timestamp) {
+			return errors.New(notValidRestore)
+		}
+
+		if !isUUID(source.BackupID) {
+			return errors.New(notValidUUID)
+		}
+
+		return nil
+	}
+
+	if isNull(source.InstanceID) || isNull(source.Timestamp) {
+		return errors.New(notValidRestore)
+	}
+
+	if !isUUID(source.InstanceID) {
+		return errors.New(notValidUUID)
+	}
+
+	if _, err := time.Parse(time.RFC3339, source.Timestamp); err != nil {
+		return errors.New(notValidTimestamp)
+	}
+
 	return nil
 }
 
@@ -0,0 +1,177 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package endpoint
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/backup"
+	"github.com/cloudfoundry-community/cf-nosql-broker/container"
+	"github.com/cloudfoundry-community/cf-nosql-broker/database"
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+	"github.com/cloudfoundry-community/cf-nosql-broker/security"
+)
+
+const (
+	// verificationRecency bounds the age of the backups picked for a
+	// verification restore.
+	verificationRecency = 7 * 24 * time.Hour
+	verificationPrefix  = "cf-mongo-verify-"
+)
+
+// verifyBackups periodically restores a random recent backup into a
+// throwaway container to prove the backups can be restored.
+func verifyBackups() {
+	if broker.VerificationInterval <= 0 {
+		return
+	}
+
+	for {
+		if !pause(broker.VerificationInterval) {
+			return
+		}
+
+		candidate, ok := pickVerificationCandidate()
+		if !ok {
+			continue
+		}
+
+		verifyBackup(candidate)
+	}
+}
+
+// pickVerificationCandidate returns one of the latest backups of the
+// instances, taken in the last verificationRecency.
+func pickVerificationCandidate() (backup.Backup, bool) {
+	candidates := []backup.Backup{}
+	for _, instance := range broker.Store.Instances() {
+		backups, err := broker.Backups.List(instance.ID)
+		if err != nil {
+			logging.Warning("Listing the backups failed",
+				"operation", "verify_backup", "instance_id", instance.ID,
+				"error", err)
+			continue
+		}
+
+		if len(backups) > 0 &&
+			time.Since(backups[0].CompletedAt) < verificationRecency {
+			candidates = append(candidates, backups[0])
+		}
+	}
+
+	if len(candidates) == 0 {
+		return backup.Backup{}, false
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(candidates))))
+	if err != nil {
+		return backup.Backup{}, false
+	}
+
+	return candidates[n.Int64()], true
+}
+
+// verifyBackup restores a backup into a throwaway container, counts the
+// documents of the restored collections, compares them with the ones counted
+// when the backup was taken and records the outcome in the backup catalog,
+// the instance operations and the metrics.
+func verifyBackup(source backup.Backup) backup.Verification {
+	verification := backup.Verification{Time: time.Now().UTC()}
+
+	counts, err := restoreForVerification(source)
+	if err == nil {
+		err = source.CheckRestored(counts)
+	}
+	if err == nil {
+		verification.Passed = true
+		verification.Collections = counts
+	} else {
+		verification.Error = err.Error()
+	}
+
+	if _, recordErr := broker.Backups.RecordVerification(source,
+		verification); recordErr != nil {
+		logging.Warning("Recording the verification failed",
+			"operation", "verify_backup", "backup_id", source.ID,
+			"instance_id", source.InstanceID, "error", recordErr)
+	}
+
+	result := "passed"
+	failed := 0.0
+	if !verification.Passed {
+		result = "failed"
+		failed = 1
+	}
+	backupVerifications.Inc(result)
+	backupVerificationFailed.Set(failed, source.InstanceID)
+
+	if verification.Passed {
+		logging.Info("Verification restore passed", "operation",
+			"verify_backup", "backup_id", source.ID, "instance_id",
+			source.InstanceID, "collections", len(counts))
+		recordOperation(source.InstanceID, "verify", "The verification restore "+
+			"of backup "+source.ID+" passed", true)
+	} else {
+		logging.Error("Verification restore failed", "operation",
+			"verify_backup", "backup_id", source.ID, "instance_id",
+			source.InstanceID, "error", verification.Error)
+
+		recordOperation(source.InstanceID, "verify", "The verification restore "+
+			"of backup "+source.ID+" failed", false)
+	}
+
+	return verification
+}
+
+// restoreForVerification runs the restore in a container with no published
+// port, removed once the collections are counted.
+func restoreForVerification(source backup.Backup) (map[string]int64, error) {
+	engine, ok := engines[source.ServiceID]
+	if !ok {
+		return nil, errors.New(errorServiceNotFound)
+	}
+
+	password, err := security.GeneratePassword(adminPasswordLength)
+	if err != nil {
+		return nil, err
+	}
+
+	server := database.Server{
+		ContainerName: verificationPrefix + source.ID,
+		Admin: database.Admin{
+			UserName: adminUserName,
+			Password: password,
+		},
+	}
+
+	opts := engine.RunOptions(server)
+	opts.Ports = nil
+	if err = container.Run(opts); err != nil {
+		return nil, err
+	}
+	defer container.Remove(server.ContainerName) // nolint: errcheck
+
+	err = restoreBackup(server, engine, restoreSource{Backup: source})
+	if err != nil {
+		return nil, err
+	}
+
+	return engine.CollectionCounts(server)
+}
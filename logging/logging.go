@@ -0,0 +1,300 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+// Levels of the log entries, from the most verbose.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+// Formats of the log entries.
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+const redacted = "[REDACTED]"
+
+var levelNames = []string{"debug", "info", "warning", "error"}
+
+var (
+	mu       sync.Mutex
+	output   io.Writer = os.Stderr
+	format             = FormatJSON
+	minLevel           = LevelInfo
+
+	// sensitiveKeys are the parts of the field names whose values are never
+	// written.
+	sensitiveKeys = []string{"password", "secret", "token", "credential",
+		"private_key", "master_key", "authorization", "connection_string"}
+
+	// urlCredentials matches the password of the URLs embedding one, such
+	// as the connection strings of the bindings.
+	urlCredentials = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^:/@\s]*:)[^@\s]+@`)
+
+	root = &Logger{}
+)
+
+// String returns the name of the level.
+func (level Level) String() string {
+	if level < LevelDebug || level > LevelError {
+		return strconv.Itoa(int(level))
+	}
+
+	return levelNames[level]
+}
+
+// ParseLevel returns the level with the given name.
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+
+	return LevelInfo, errors.New("unknown log level " + name +
+		", expected one of " + strings.Join(levelNames, ", "))
+}
+
+// Configure sets where the entries are written, their format, JSON when
+// empty, and the minimum level written.
+func Configure(w io.Writer, formatName string, level Level) error {
+	if formatName == "" {
+		formatName = FormatJSON
+	}
+
+	if formatName != FormatJSON && formatName != FormatLogfmt {
+		return errors.New("unknown log format " + formatName +
+			", expected " + FormatJSON + " or " + FormatLogfmt)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	output = w
+	format = formatName
+	minLevel = level
+
+	return nil
+}
+
+// Logger writes entries carrying a set of fields, such as the request and
+// instance they relate to. Loggers are immutable and safe to share.
+type Logger struct {
+	fields []interface{}
+}
+
+// With returns a logger adding the given key and value pairs to the fields
+// of the root logger.
+func With(keyValues ...interface{}) *Logger {
+	return root.With(keyValues...)
+}
+
+// With returns a logger adding the given key and value pairs to the fields
+// of l.
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyValues))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyValues...)
+
+	return &Logger{fields: fields}
+}
+
+// Debug writes a debug entry.
+func (l *Logger) Debug(msg string, keyValues ...interface{}) {
+	l.write(LevelDebug, msg, keyValues)
+}
+
+// Info writes an informational entry.
+func (l *Logger) Info(msg string, keyValues ...interface{}) {
+	l.write(LevelInfo, msg, keyValues)
+}
+
+// Warning writes an entry about an unexpected but handled condition.
+func (l *Logger) Warning(msg string, keyValues ...interface{}) {
+	l.write(LevelWarning, msg, keyValues)
+}
+
+// Error writes an entry about a failed operation.
+func (l *Logger) Error(msg string, keyValues ...interface{}) {
+	l.write(LevelError, msg, keyValues)
+}
+
+// Debug writes a debug entry with the root logger.
+func Debug(msg string, keyValues ...interface{}) {
+	root.write(LevelDebug, msg, keyValues)
+}
+
+// Info writes an informational entry with the root logger.
+func Info(msg string, keyValues ...interface{}) {
+	root.write(LevelInfo, msg, keyValues)
+}
+
+// Warning writes a warning entry with the root logger.
+func Warning(msg string, keyValues ...interface{}) {
+	root.write(LevelWarning, msg, keyValues)
+}
+
+// Error writes an error entry with the root logger.
+func Error(msg string, keyValues ...interface{}) {
+	root.write(LevelError, msg, keyValues)
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying l.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or the root logger.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return l
+	}
+
+	return root
+}
+
+// write formats an entry and writes it on a single line. A key without value
+// is written with an empty one.
+func (l *Logger) write(level Level, msg string, keyValues []interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if level < minLevel {
+		return
+	}
+
+	fields := append(append([]interface{}{}, l.fields...), keyValues...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "")
+	}
+
+	var entry bytes.Buffer
+	if format == FormatJSON {
+		entry.WriteString("{")
+	}
+
+	writeField(&entry, "time", time.Now().UTC().Format(time.RFC3339Nano), true)
+	writeField(&entry, "level", level.String(), false)
+	writeField(&entry, "msg", redactURLs(msg), false)
+
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		writeField(&entry, key, redact(key, fields[i+1]), false)
+	}
+
+	if format == FormatJSON {
+		entry.WriteString("}")
+	}
+	entry.WriteString("\n")
+
+	output.Write(entry.Bytes()) // nolint: errcheck
+}
+
+// writeField appends a field in the configured format.
+func writeField(entry *bytes.Buffer, key string, value interface{},
+	first bool) {
+
+	if format == FormatJSON {
+		if !first {
+			entry.WriteString(",")
+		}
+		entry.Write(jsonValue(key))
+		entry.WriteString(":")
+		entry.Write(jsonValue(value))
+		return
+	}
+
+	if !first {
+		entry.WriteString(" ")
+	}
+	entry.WriteString(logfmtValue(key))
+	entry.WriteString("=")
+	entry.WriteString(logfmtValue(value))
+}
+
+// redact hides the values of the sensitive fields and the passwords of the
+// URLs.
+func redact(key string, value interface{}) interface{} {
+	lowerKey := strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(lowerKey, sensitive) {
+			return redacted
+		}
+	}
+
+	switch v := value.(type) {
+	case error:
+		return redactURLs(v.Error())
+	case fmt.Stringer:
+		return redactURLs(v.String())
+	case string:
+		return redactURLs(v)
+	}
+
+	return value
+}
+
+// redactURLs hides the passwords of the URLs found in s.
+func redactURLs(s string) string {
+	return urlCredentials.ReplaceAllString(s, "${1}"+redacted+"@")
+}
+
+// jsonValue encodes a value, falling back to its default formatting when
+// it can not be encoded.
+func jsonValue(value interface{}) []byte {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+
+	return encoded
+}
+
+// logfmtValue formats a value, quoting it when it is empty or holds spaces,
+// quotes or equal signs.
+func logfmtValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
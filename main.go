@@ -17,61 +17,271 @@
 package main
 
 import (
-	"crypto/tls"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/cloudfoundry-community/cf-nosql-broker/audit"
+	"github.com/cloudfoundry-community/cf-nosql-broker/backup"
+	"github.com/cloudfoundry-community/cf-nosql-broker/config"
 	server "github.com/cloudfoundry-community/cf-nosql-broker/endpoint"
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
 	"github.com/cloudfoundry-community/cf-nosql-broker/security"
+	"github.com/cloudfoundry-community/cf-nosql-broker/state"
 )
 
 func main() {
-	log.Println("NoSQL Service Broker for the CLOUD FOUNDRY* Platform.")
-	port := os.Getenv("CF_NOSQL_BROKER_PORT")
+	// Without a command, or with flags only, the broker is started
+	serving := len(os.Args) < 2 || os.Args[1] == "serve" ||
+		strings.HasPrefix(os.Args[1], "-") && !isHelp(os.Args[1])
 
-	if port == "" {
-		port = "8080"
-		log.Println("[WARNING] Requires $CF_NOSQL_BROKER_PORT environment " +
-			"variable, defaulting to:" + port)
+	switch {
+	case serving:
+		args := os.Args[1:]
+		if len(args) > 0 && args[0] == "serve" {
+			args = args[1:]
+		}
+		serve(args)
+	case isHelp(os.Args[1]):
+		usage()
+	default:
+		if err := runCommand(os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: "+err.Error()) // nolint: errcheck
+			os.Exit(1)
+		}
 	}
+}
+
+// isHelp reports whether an argument asks for the usage.
+func isHelp(arg string) bool {
+	return arg == "help" || arg == "-h" || arg == "--help"
+}
 
-	// Validate expected key pair files before start their cryptographic validation
-	keyFile := os.Getenv("CF_NOSQL_BROKER_KEY")
-	certFile := os.Getenv("CF_NOSQL_BROKER_CERT")
+// serve starts the service broker configured from the configuration file,
+// the environment and the command line.
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configFlags := config.RegisterFlags(flags)
+	flags.Parse(args) // nolint: errcheck
 
-	if keyFile == "" || certFile == "" {
-		log.Println("[ERROR] Requires $CF_NOSQL_BROKER_KEY and " +
-			"$CF_NOSQL_BROKER_CERT environment variables to start the server.")
+	cfg, err := configFlags.Load()
+	if err != nil {
+		logging.Error("Error loading the configuration", "error", err)
 		return
 	}
 
-	if _, err := os.Stat(keyFile); err != nil {
-		log.Println("[ERROR] The key file " + keyFile +
-			" does not exists in the filesystem.")
+	problems := cfg.Validate()
+	for _, problem := range problems {
+		logging.Error("Invalid configuration", "error", problem)
+	}
+	if len(problems) > 0 {
 		return
 	}
 
-	if _, err := os.Stat(certFile); err != nil {
-		log.Println("[ERROR] The certificate file " + certFile +
-			" does not exists in the filesystem.")
+	// Log entries are JSON unless logfmt is asked for
+	level, _ := logging.ParseLevel(cfg.Logging.Level)
+	logging.Configure(os.Stderr, cfg.Logging.Format, level) // nolint: errcheck
+
+	logging.Info("NoSQL Service Broker for the CLOUD FOUNDRY* Platform.")
+
+	// The options of the plans may be changed by the configuration
+	problems = append(server.ConfigurePlans(cfg.Plans),
+		server.ValidateCatalog()...)
+	for _, problem := range problems {
+		logging.Error("Invalid catalog", "error", problem)
+	}
+	if len(problems) > 0 {
 		return
 	}
 
 	// Generate the certificate chain to enable TLS
 	// Before generation, the public/private key pair will be validated to see if
 	// they meet cryptographic requirements
-	cert, err := security.GetCertificateChain(certFile, keyFile)
+	cipherSuites, _ := security.CipherSuites(cfg.TLS.CipherSuites)
+	keyPair, err := security.LoadKeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile,
+		cipherSuites)
+	if err != nil {
+		logging.Error("Error starting the broker", "error", err)
+		return
+	}
+
+	// The certificate is replaced when its files change or on SIGHUP, the
+	// connections already established keeping the previous one
+	if cfg.TLS.ReloadInterval > 0 {
+		go keyPair.Watch(time.Duration(cfg.TLS.ReloadInterval))
+	}
+	go reloadOnHangup(keyPair)
+
+	// Set TLS configurations, the cipher suites following the key type
+	tlsConfig := keyPair.Config()
+
+	// Open the broker state, where the instances and their sealed root
+	// credentials are kept
+	store, err := state.Open(cfg.State.Dir)
+	if err != nil {
+		logging.Error("Error starting the broker", "error", err)
+		return
+	}
+
+	// Append-only audit log of the actions requested on the instances
+	auditLog, err := audit.Open(cfg.State.AuditLog)
+	if err != nil {
+		logging.Error("Error starting the broker", "error", err)
+		return
+	}
+
+	secretKey, err := security.LoadOrCreateKey(filepath.Join(cfg.State.Dir,
+		"secret.key"))
+	if err != nil {
+		logging.Error("Error starting the broker", "error", err)
+		return
+	}
+
+	// Certificate authority signing the server certificates of the database
+	// instances started with TLS
+	keyType, _ := security.ParseKeyType(cfg.Authority.KeyType)
+	authority, err := security.LoadOrCreateAuthority(
+		filepath.Join(cfg.State.Dir, "ca"), keyType,
+		time.Duration(cfg.Authority.Validity))
 	if err != nil {
-		log.Println("[ERROR] " + err.Error())
+		logging.Error("Error starting the broker", "error", err)
 		return
 	}
 
-	// Set TLS configurations
-	tlsConfig := tls.Config{
-		Certificates: []tls.Certificate{cert},
+	// Dashboard single sign-on through the platform UAA, only enabled when
+	// the client credentials are provided
+	var sso *server.SSO
+	if cfg.Auth.SSO.ClientID != "" {
+		sso = &server.SSO{
+			ClientID:           cfg.Auth.SSO.ClientID,
+			ClientSecret:       cfg.Auth.SSO.ClientSecret,
+			CloudControllerURL: cfg.Auth.SSO.CloudControllerURL,
+			SkipSSLValidation:  cfg.Auth.SSO.SkipSSLValidation,
+		}
+	}
+
+	// Storage keeping the backup archives, a local directory unless an S3
+	// compatible bucket is configured
+	var storage backup.Storage
+	if cfg.Backups.Storage == "s3" {
+		storage, err = newS3Storage(cfg.Backups.S3)
+	} else {
+		storage, err = backup.NewFileStorage(cfg.Backups.Dir)
+	}
+	if err != nil {
+		logging.Error("Error starting the broker", "error", err)
+		return
+	}
+
+	// Master key wrapping the data keys of the encrypted archives, the
+	// previous ones are kept to read the archives not re-wrapped yet
+	var backupKeys *security.KeyRing
+	if cfg.Backups.MasterKey != "" {
+		backupKeys, err = newBackupKeyRing(cfg.Backups.MasterKey,
+			cfg.Backups.PreviousMasterKeys)
+		if err != nil {
+			logging.Error("Error starting the broker", "error", err)
+			return
+		}
+	} else {
+		logging.Warning("No backup master key is configured, the backups " +
+			"are stored unencrypted")
+	}
+
+	// Credentials of the administration API, by role
+	operators := []server.Operator{}
+	for role, credentials := range map[string]config.Credentials{
+		server.RoleOperator: cfg.Auth.Admin,
+		server.RoleViewer:   cfg.Auth.Viewer,
+	} {
+		if credentials.UserName != "" && credentials.Password != "" {
+			operators = append(operators, server.Operator{
+				UserName: credentials.UserName,
+				Password: credentials.Password,
+				Role:     role,
+			})
+		}
 	}
-	security.SetCipherSuites(&tlsConfig)
 
 	// Start the HTTPS server using TLS
-	server.Start(port, &tlsConfig)
+	server.Start(strconv.Itoa(cfg.Listen.Port), tlsConfig, server.Broker{
+		Store:                store,
+		SecretKey:            secretKey,
+		SigningKey:           security.DeriveKey(secretKey, "dashboard-signing"),
+		Hostname:             cfg.Runtime.Hostname,
+		Image:                cfg.Runtime.Image,
+		FirstHostPort:        cfg.Runtime.Ports.First,
+		LastHostPort:         cfg.Runtime.Ports.Last,
+		Authority:            authority,
+		UserName:             cfg.Auth.Broker.UserName,
+		Password:             cfg.Auth.Broker.Password,
+		URL:                  cfg.Listen.URL,
+		DashboardTTL:         time.Duration(cfg.Auth.DashboardTTL),
+		SSO:                  sso,
+		Backups:              backup.NewManager(storage, backupKeys),
+		VerificationInterval: time.Duration(cfg.Backups.VerifyInterval),
+		ReconcileInterval:    time.Duration(cfg.Runtime.ReconcileInterval),
+		HealthInterval:       time.Duration(cfg.Runtime.HealthInterval),
+		Audit:                auditLog,
+		Operators:            operators,
+		ShutdownTimeout:      time.Duration(cfg.Listen.ShutdownTimeout),
+		MetricsUserName:      cfg.Auth.Metrics.UserName,
+		MetricsPassword:      cfg.Auth.Metrics.Password,
+	})
+}
+
+// reloadOnHangup reloads the key pair of the broker on every SIGHUP.
+func reloadOnHangup(keyPair *security.KeyPair) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	for range hangups {
+		keyPair.Reload() // nolint: errcheck
+	}
+}
+
+// newS3Storage configures the backup storage in an S3 compatible bucket.
+func newS3Storage(s3 config.S3) (*backup.S3Storage, error) {
+	return backup.NewS3Storage(backup.S3Config{
+		Endpoint:             s3.Endpoint,
+		Region:               s3.Region,
+		Bucket:               s3.Bucket,
+		AccessKeyID:          s3.AccessKeyID,
+		SecretAccessKey:      s3.SecretAccessKey,
+		Prefix:               s3.Prefix,
+		PathStyle:            s3.PathStyle,
+		ServerSideEncryption: s3.SSE,
+		KMSKeyID:             s3.KMSKeyID,
+		PartSize:             s3.PartSize,
+		IncompleteUploadDays: s3.IncompleteUploadDays,
+	})
+}
+
+// newBackupKeyRing decodes the current and the previous backup master keys.
+func newBackupKeyRing(current string,
+	previous []string) (*security.KeyRing, error) {
+
+	currentKey, err := security.ParseMasterKey(current)
+	if err != nil {
+		return nil, errors.New("backups.master_key: " + err.Error())
+	}
+
+	previousKeys := [][]byte{}
+	for _, value := range previous {
+		key, err := security.ParseMasterKey(value)
+		if err != nil {
+			return nil, errors.New("backups.previous_master_keys: " +
+				err.Error())
+		}
+		previousKeys = append(previousKeys, key)
+	}
+
+	return security.NewKeyRing(currentKey, previousKeys...)
 }
@@ -0,0 +1,319 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package metrics
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+// DefaultBuckets suit the latencies of HTTP requests, in seconds.
+var DefaultBuckets = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      = map[string]*family{}
+)
+
+// family holds the values of a metric, one per set of label values.
+type family struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	labels map[string][]string
+
+	// buckets are the upper bounds of the histogram buckets, and
+	// observations their counts per set of label values.
+	buckets      []float64
+	observations map[string]*observation
+}
+
+// observation holds the samples of a histogram for a set of label values.
+type observation struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Counter is a metric that only goes up.
+type Counter struct {
+	*family
+}
+
+// Gauge is a metric that can be set to any value.
+type Gauge struct {
+	*family
+}
+
+// Histogram is a metric that counts observed values, such as durations, in
+// buckets.
+type Histogram struct {
+	*family
+}
+
+// NewCounter registers a counter with the given label names.
+func NewCounter(name, help string, labelNames ...string) Counter {
+	return Counter{register(name, help, counterType, labelNames)}
+}
+
+// NewGauge registers a gauge with the given label names.
+func NewGauge(name, help string, labelNames ...string) Gauge {
+	return Gauge{register(name, help, gaugeType, labelNames)}
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds,
+// sorted in increasing order, and label names.
+func NewHistogram(name, help string, buckets []float64,
+	labelNames ...string) Histogram {
+
+	f := register(name, help, histogramType, labelNames)
+	f.mu.Lock()
+	if f.buckets == nil {
+		f.buckets = buckets
+		f.observations = map[string]*observation{}
+	}
+	f.mu.Unlock()
+
+	return Histogram{f}
+}
+
+// Inc adds one to the counter with the given label values.
+func (c Counter) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+// Add adds value to the counter with the given label values.
+func (c Counter) Add(value float64, labelValues ...string) {
+	if value > 0 {
+		c.add(value, labelValues)
+	}
+}
+
+// Set sets the gauge with the given label values.
+func (g Gauge) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := g.key(labelValues)
+	g.values[key] = value
+	g.labels[key] = labelValues
+}
+
+// Delete removes the gauge with the given label values, for instance once
+// the resource it describes is gone.
+func (g Gauge) Delete(labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := g.key(labelValues)
+	delete(g.values, key)
+	delete(g.labels, key)
+}
+
+// Reset removes the gauge for every set of label values, before setting the
+// values of the resources that still exist.
+func (g Gauge) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.values = map[string]float64{}
+	g.labels = map[string][]string{}
+}
+
+// Observe adds a value to the histogram with the given label values.
+func (h Histogram) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := h.key(labelValues)
+	o, ok := h.observations[key]
+	if !ok {
+		o = &observation{counts: make([]uint64, len(h.buckets))}
+		h.observations[key] = o
+		h.labels[key] = labelValues
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			o.counts[i]++
+		}
+	}
+	o.sum += value
+	o.count++
+}
+
+// Write writes every registered metric in the Prometheus text format.
+func Write(w io.Writer) error {
+	registryMutex.Lock()
+	families := make([]*family, 0, len(registry))
+	for _, f := range registry {
+		families = append(families, f)
+	}
+	registryMutex.Unlock()
+
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	var text strings.Builder
+	for _, f := range families {
+		f.write(&text)
+	}
+
+	_, err := io.WriteString(w, text.String())
+	return err
+}
+
+// register adds a metric family, returning the existing one when the name
+// is already registered.
+func register(name, help, kind string, labelNames []string) *family {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if f, ok := registry[name]; ok {
+		return f
+	}
+
+	f := &family{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		values:     map[string]float64{},
+		labels:     map[string][]string{},
+	}
+	registry[name] = f
+	return f
+}
+
+func (f *family) add(value float64, labelValues []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := f.key(labelValues)
+	f.values[key] += value
+	f.labels[key] = labelValues
+}
+
+// key identifies a set of label values. Missing values are empty and extra
+// ones are ignored.
+func (f *family) key(labelValues []string) string {
+	values := make([]string, len(f.labelNames))
+	copy(values, labelValues)
+	return strings.Join(values, "\xff")
+}
+
+// write writes the samples of the family sorted by label values.
+func (f *family) write(text *strings.Builder) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	text.WriteString("# HELP " + f.name + " " + escape(f.help, false) + "\n")
+	text.WriteString("# TYPE " + f.name + " " + f.kind + "\n")
+
+	if f.kind == histogramType {
+		f.writeHistogram(text)
+		return
+	}
+
+	keys := make([]string, 0, len(f.values))
+	for key := range f.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		text.WriteString(f.name + f.labelSet(key) + " " +
+			formatValue(f.values[key]) + "\n")
+	}
+}
+
+// writeHistogram writes the cumulative buckets, sum and count of every set
+// of label values. The caller must hold the lock.
+func (f *family) writeHistogram(text *strings.Builder) {
+	keys := make([]string, 0, len(f.observations))
+	for key := range f.observations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		o := f.observations[key]
+		for i, bound := range f.buckets {
+			text.WriteString(f.name + "_bucket" +
+				f.labelSet(key, "le", formatValue(bound)) + " " +
+				strconv.FormatUint(o.counts[i], 10) + "\n")
+		}
+		text.WriteString(f.name + "_bucket" + f.labelSet(key, "le", "+Inf") +
+			" " + strconv.FormatUint(o.count, 10) + "\n")
+		text.WriteString(f.name + "_sum" + f.labelSet(key) + " " +
+			formatValue(o.sum) + "\n")
+		text.WriteString(f.name + "_count" + f.labelSet(key) + " " +
+			strconv.FormatUint(o.count, 10) + "\n")
+	}
+}
+
+// labelSet formats the labels of a sample, followed by the extra name and
+// value pairs given.
+func (f *family) labelSet(key string, extra ...string) string {
+	if len(f.labelNames) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, 0, len(f.labelNames)+len(extra)/2)
+	for i, name := range f.labelNames {
+		pairs = append(pairs, name+`="`+escape(values[i], true)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escape(extra[i+1], true)+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatValue formats a sample value.
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// escape escapes the backslashes and new lines of help texts, and the
+// quotes of label values.
+func escape(value string, quotes bool) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	if quotes {
+		value = strings.Replace(value, `"`, `\"`, -1)
+	}
+
+	return value
+}
@@ -32,7 +32,21 @@ type Service struct {
 	PlanUpdateable  bool          `json:"plan_updateable, omitempty"`
 	Plans           []ServicePlan `json:"plans"`
 	Metadata        interface{}   `json:"metadata, omitempty"`
-	DashboardClient interface{}   `json:"dashboard_client, omitempty"`
+	DashboardClient interface{}   `json:"dashboard_client,omitempty"`
+	// InstancesRetrievable tells the platform it can fetch the instances
+	// through GET /v2/service_instances/{instance_id}.
+	InstancesRetrievable bool `json:"instances_retrievable,omitempty"`
+	// BindingsRetrievable tells the platform it can fetch the bindings,
+	// required to create them asynchronously.
+	BindingsRetrievable bool `json:"bindings_retrievable,omitempty"`
+}
+
+// DashboardClient is the OAuth2 client the platform registers in UAA to let
+// the service dashboard sign users on.
+type DashboardClient struct {
+	ID          string `json:"id"`
+	Secret      string `json:"secret"`
+	RedirectURI string `json:"redirect_uri"`
 }
 
 // ServicePlan represents the different plans available for a database service.
@@ -36,6 +36,13 @@ type BindResponse struct {
 	Credentials interface{} `json:"credentials, omitempty"`
 }
 
+// FetchBindingResponse describes an existing binding: its credentials and
+// the parameters it was created with, the password excepted.
+type FetchBindingResponse struct {
+	Credentials interface{}       `json:"credentials"`
+	Parameters  map[string]string `json:"parameters"`
+}
+
 // Credentials represents the set of information used by an application or
 // a user to utilize the service instance.
 type Credentials struct {
@@ -43,5 +50,9 @@ type Credentials struct {
 	UserName         string `json:"username"`
 	Password         string `json:"password"`
 	Hostname         string `json:"hostname"`
+	Port             string `json:"port"`
 	DatabaseName     string `json:"database_name"`
+	// CACertificate is the PEM encoded authority that signed the server
+	// certificate, only set for TLS enabled instances.
+	CACertificate string `json:"ca_certificate,omitempty"`
 }
@@ -18,10 +18,27 @@ package model
 
 // ProvisionBody represents the expected request body for provisioning.
 type ProvisionBody struct {
-	ServiceID      string `json:"service_id"`
-	PlanID         string `json:"plan_id"`
-	OrganizationID string `json:"organization_guid"`
-	SpaceID        string `json:"space_guid"`
+	ServiceID      string              `json:"service_id"`
+	PlanID         string              `json:"plan_id"`
+	OrganizationID string              `json:"organization_guid"`
+	SpaceID        string              `json:"space_guid"`
+	Parameters     ProvisionParameters `json:"parameters"`
+}
+
+// ProvisionParameters contains the configuration options accepted when
+// creating a database service.
+type ProvisionParameters struct {
+	// RestoreFrom seeds the new database from an existing backup.
+	RestoreFrom *RestoreSource `json:"restore_from,omitempty"`
+}
+
+// RestoreSource names the backup to restore, either by its ID or as the
+// latest backup of an instance completed at or before a timestamp.
+type RestoreSource struct {
+	BackupID   string `json:"backup_id,omitempty"`
+	InstanceID string `json:"instance_id,omitempty"`
+	// Timestamp is formatted as RFC 3339, e.g. 2017-06-01T10:00:00Z.
+	Timestamp string `json:"timestamp,omitempty"`
 }
 
 // ProvisionResponse could be populated with the URL of a web-based portal for
@@ -31,6 +48,15 @@ type ProvisionResponse struct {
 	Operation    string `json:"operation, omitempty"`
 }
 
+// FetchInstanceResponse describes an existing service instance.
+type FetchInstanceResponse struct {
+	ServiceID    string `json:"service_id"`
+	PlanID       string `json:"plan_id"`
+	DashboardURL string `json:"dashboard_url,omitempty"`
+	// Parameters are the provision parameters applied to the instance.
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
 // DeprovisionResponse expected {} but may return an identifier representing
 // the operation.
 type DeprovisionResponse struct {
@@ -40,5 +66,8 @@ type DeprovisionResponse struct {
 // ErrorResponse represents the error response during the provision and
 // deprovision implementation.
 type ErrorResponse struct {
+	// Error is the error code defined by the broker API, such as
+	// ConcurrencyError, when one applies.
+	Error       string `json:"error,omitempty"`
 	Description string `json:"description"`
 }
@@ -0,0 +1,473 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package security
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	authorityCertFile   = "ca.pem"
+	authorityKeyFile    = "ca-key.pem"
+	authorityIssuedFile = "issued.json"
+	authorityName       = "CF NoSQL Broker CA"
+	authorityValidity   = 10 * 365 * 24 * time.Hour
+
+	// DefaultLeafValidity is the lifetime of the certificates issued by the
+	// Authority when none is configured.
+	DefaultLeafValidity = 30 * 24 * time.Hour
+
+	errorAuthorityPEM     = "the certificate authority files are not valid PEM"
+	errorAuthorityKey     = "the certificate authority key must be RSA"
+	errorUnknownKeyType   = "unknown key type, expected rsa or ecdsa"
+	errorUnknownLeaf      = "no certificate was issued for "
+	errorInvalidValidity  = "the certificate validity must be positive"
+	errorAuthorityExpired = "the certificate authority has expired"
+)
+
+// KeyType is the algorithm of the keys generated for the issued certificates.
+type KeyType string
+
+// Key types supported by the Authority.
+const (
+	RSAKey   KeyType = "rsa"
+	ECDSAKey KeyType = "ecdsa"
+)
+
+// ParseKeyType validates the name of a key type.
+func ParseKeyType(name string) (KeyType, error) {
+	switch KeyType(name) {
+	case RSAKey, ECDSAKey:
+		return KeyType(name), nil
+	default:
+		return "", errors.New(errorUnknownKeyType)
+	}
+}
+
+// IssuedCertificate records a certificate signed by the Authority.
+type IssuedCertificate struct {
+	SerialNumber string    `json:"serial_number"`
+	CommonName   string    `json:"common_name"`
+	Hosts        []string  `json:"hosts"`
+	KeyType      KeyType   `json:"key_type"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+}
+
+// Authority is the certificate authority of the broker. It signs short-lived
+// server certificates for the database instances so applications can verify
+// them, and keeps track of every certificate it issued.
+type Authority struct {
+	mu       sync.Mutex
+	dir      string
+	cert     *x509.Certificate
+	key      *rsa.PrivateKey
+	certPEM  []byte
+	keyType  KeyType
+	validity time.Duration
+	issued   []IssuedCertificate
+}
+
+// LoadOrCreateAuthority reads the root certificate and key kept in dir. When
+// they do not exist a new self-signed root is generated and persisted. The
+// leaf certificates will use keys of the given type and be valid for the
+// given duration.
+func LoadOrCreateAuthority(
+	dir string, keyType KeyType, validity time.Duration) (*Authority, error) {
+
+	if _, err := ParseKeyType(string(keyType)); err != nil {
+		return nil, err
+	}
+
+	if validity <= 0 {
+		return nil, errors.New(errorInvalidValidity)
+	}
+
+	a := &Authority{dir: dir, keyType: keyType, validity: validity}
+
+	certPEM, err := ioutil.ReadFile(filepath.Join(dir, authorityCertFile))
+	if os.IsNotExist(err) {
+		err = a.create()
+	} else if err == nil {
+		err = a.load(certPEM)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The root is held to the same requirements as the broker certificate
+	root := tls.Certificate{
+		Certificate: [][]byte{a.cert.Raw},
+		PrivateKey:  a.key,
+	}
+	if err = meetCryptoRequirements(&root); err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(a.cert.NotAfter) {
+		return nil, errors.New(errorAuthorityExpired)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, authorityIssuedFile))
+	if err == nil {
+		err = json.Unmarshal(content, &a.issued)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// load parses the root certificate and its RSA key, either PKCS#1 or PKCS#8
+// encoded so an operator supplied root can be used.
+func (a *Authority) load(certPEM []byte) error {
+	keyPEM, err := ioutil.ReadFile(filepath.Join(a.dir, authorityKeyFile))
+	if err != nil {
+		return err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return errors.New(errorAuthorityPEM)
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return err
+	}
+
+	var key crypto.PrivateKey
+	key, err = x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		key, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return errors.New(errorAuthorityKey)
+	}
+
+	a.cert, a.key, a.certPEM = cert, rsaKey, certPEM
+	return nil
+}
+
+// create generates a self-signed RSA root and writes it to disk.
+func (a *Authority) create() error {
+	key, err := rsa.GenerateKey(rand.Reader, minRSABitModulus)
+	if err != nil {
+		return err
+	}
+
+	serial, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: authorityName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(authorityValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SignatureAlgorithm:    x509.SHA256WithRSA,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+
+	if err = os.MkdirAll(a.dir, 0700); err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(a.dir, authorityKeyFile), keyPEM, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(a.dir, authorityCertFile), certPEM,
+		0644)
+	if err != nil {
+		return err
+	}
+
+	a.cert, a.key, a.certPEM = cert, key, certPEM
+	return nil
+}
+
+// CertificatePEM returns the PEM encoded root certificate, the one clients
+// need to verify the database servers.
+func (a *Authority) CertificatePEM() []byte {
+	return a.certPEM
+}
+
+// Issue signs a new server certificate valid for the given host names and IP
+// addresses. The certificate is checked against the broker cryptographic
+// requirements and recorded before being returned PEM encoded together with
+// its private key.
+func (a *Authority) Issue(
+	commonName string, hosts []string) ([]byte, []byte, error) {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key, keyPEM, err := generateKey(a.keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(a.validity)
+	if notAfter.After(a.cert.NotAfter) {
+		notAfter = a.cert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:       serial,
+		Subject:            pkix.Name{CommonName: commonName},
+		NotBefore:          now.Add(-time.Hour),
+		NotAfter:           notAfter,
+		KeyUsage:           x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		SignatureAlgorithm: x509.SHA256WithRSA,
+	}
+
+	if a.keyType == RSAKey {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert,
+		key.Public(), a.key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	leaf := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	if err = meetCryptoRequirements(&leaf); err != nil {
+		return nil, nil, err
+	}
+
+	a.issued = append(a.issued, IssuedCertificate{
+		SerialNumber: serial.Text(16),
+		CommonName:   commonName,
+		Hosts:        hosts,
+		KeyType:      a.keyType,
+		NotBefore:    template.NotBefore,
+		NotAfter:     template.NotAfter,
+	})
+	if err = a.save(); err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return certPEM, keyPEM, nil
+}
+
+// Renew issues a new certificate for a common name with the hosts of its
+// latest certificate.
+func (a *Authority) Renew(commonName string) ([]byte, []byte, error) {
+	current, ok := a.Current(commonName)
+	if !ok {
+		return nil, nil, errors.New(errorUnknownLeaf + commonName)
+	}
+
+	return a.Issue(commonName, current.Hosts)
+}
+
+// Current returns the latest certificate issued for a common name.
+func (a *Authority) Current(commonName string) (IssuedCertificate, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var current IssuedCertificate
+	found := false
+	for _, issued := range a.issued {
+		if issued.CommonName == commonName &&
+			(!found || issued.NotAfter.After(current.NotAfter)) {
+			current, found = issued, true
+		}
+	}
+
+	return current, found
+}
+
+// NeedsRenewal reports whether the latest certificate of a common name has
+// entered the last third of its lifetime, or was never recorded.
+func (a *Authority) NeedsRenewal(commonName string, now time.Time) bool {
+	current, ok := a.Current(commonName)
+	if !ok {
+		return true
+	}
+
+	lifetime := current.NotAfter.Sub(current.NotBefore)
+	return now.After(current.NotAfter.Add(-lifetime / 3))
+}
+
+// Issued returns the certificates that are still valid sorted by expiry.
+func (a *Authority) Issued() []IssuedCertificate {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	issued := []IssuedCertificate{}
+	for _, certificate := range a.issued {
+		if now.Before(certificate.NotAfter) {
+			issued = append(issued, certificate)
+		}
+	}
+
+	sort.Slice(issued, func(i, j int) bool {
+		return issued[i].NotAfter.Before(issued[j].NotAfter)
+	})
+
+	return issued
+}
+
+// Forget drops the records of a common name, once its instance is deleted.
+func (a *Authority) Forget(commonName string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	kept := a.issued[:0]
+	for _, issued := range a.issued {
+		if issued.CommonName != commonName {
+			kept = append(kept, issued)
+		}
+	}
+	a.issued = kept
+
+	return a.save()
+}
+
+// save persists the records of the certificates that have not expired yet.
+// The caller must hold the lock.
+func (a *Authority) save() error {
+	now := time.Now()
+	kept := a.issued[:0]
+	for _, issued := range a.issued {
+		if issued.NotAfter.After(now) {
+			kept = append(kept, issued)
+		}
+	}
+	a.issued = kept
+
+	content, err := json.MarshalIndent(a.issued, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(a.dir, authorityIssuedFile)
+	if err = ioutil.WriteFile(path+".tmp", content, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// generateKey creates a private key of the given type and returns it with its
+// PEM encoding.
+func generateKey(keyType KeyType) (crypto.Signer, []byte, error) {
+	switch keyType {
+	case RSAKey:
+		key, err := rsa.GenerateKey(rand.Reader, minRSABitModulus)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		keyPEM := pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})
+		return key, keyPEM, nil
+	case ECDSAKey:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		keyPEM := pem.EncodeToMemory(&pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: der,
+		})
+		return key, keyPEM, nil
+	default:
+		return nil, nil, errors.New(errorUnknownKeyType)
+	}
+}
+
+// newSerialNumber returns a random 128 bit certificate serial number.
+func newSerialNumber() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, limit)
+}
@@ -17,17 +17,23 @@
 package security
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
-	"log"
 	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
 )
 
 const (
 	minRSABitModulus          = 2048
-	errorUnsupportedSignature = "unsupported private key signature, only RSA is valid" // nolinter: lll
+	minECDSACurveBits         = 256
+	errorUnsupportedSignature = "unsupported private key signature, only RSA, ECDSA and Ed25519 are valid" // nolinter: lll
 )
 
 // meetCryptoRequirements validates that all the requiered cryptographic
@@ -50,11 +56,12 @@ func meetCryptoRequirements(cert *tls.Certificate) error {
 }
 
 // validateSignatureMethod identify the certificate digital signature for the
-// private key. Only certificates signed with RSA are acceptable.
+// private key. Only certificates signed with RSA, ECDSA or Ed25519 are
+// acceptable.
 func validateSignatureMethod(cert *tls.Certificate) error {
 
 	switch cert.PrivateKey.(type) {
-	case *rsa.PrivateKey:
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
 		return nil
 	default:
 		return errors.New(errorUnsupportedSignature)
@@ -63,20 +70,26 @@ func validateSignatureMethod(cert *tls.Certificate) error {
 }
 
 // validateCertBitLength evaluates the size of the private key according to the
-// signed method. Expected length: 2048 bits or more.
+// signed method. Expected length: 2048 bits or more for RSA and a curve of at
+// least 256 bits for ECDSA, such as P-256 or P-384. Ed25519 keys have a fixed
+// size.
 func validateCertBitLength(cert *tls.Certificate) error {
 
-	var len int
+	var len, min int
 	switch key := cert.PrivateKey.(type) {
 	case *rsa.PrivateKey:
-		len = key.N.BitLen()
+		len, min = key.N.BitLen(), minRSABitModulus
+	case *ecdsa.PrivateKey:
+		len, min = key.Curve.Params().BitSize, minECDSACurveBits
+	case ed25519.PrivateKey:
+		return nil
 	default:
 		return errors.New(errorUnsupportedSignature)
 	}
 
-	if len < minRSABitModulus {
+	if len < min {
 		return errors.New("Validating certificate length, expected " +
-			strconv.Itoa(minRSABitModulus) + " bits but the key is " +
+			strconv.Itoa(min) + " bits but the key is " +
 			strconv.Itoa(len))
 	}
 
@@ -84,7 +97,8 @@ func validateCertBitLength(cert *tls.Certificate) error {
 }
 
 // validateSignatureHashAlgorithm identify the hash function used as signature
-// algorithm. Supported functions: SHA256, SHA384 or SHA512.
+// algorithm. Supported functions: SHA256, SHA384 or SHA512 with RSA or ECDSA,
+// and Ed25519 which has its own.
 func validateSignatureHashAlgorithm(cert *tls.Certificate) error {
 
 	c, err := x509.ParseCertificate(cert.Certificate[0])
@@ -92,29 +106,108 @@ func validateSignatureHashAlgorithm(cert *tls.Certificate) error {
 		return err
 	}
 
-	signature := c.SignatureAlgorithm
-	if signature == x509.SHA256WithRSA || signature == x509.SHA384WithRSA ||
-		signature == x509.SHA512WithRSA {
+	switch c.SignatureAlgorithm {
+	case x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA,
+		x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512,
+		x509.PureEd25519:
 		return nil
 	}
 
+	signature := c.SignatureAlgorithm
+
 	return errors.New("x509: " + signature.String() +
 		" is an unsupported signature hash algorithm")
 
 }
 
+// rsaCipherSuites are accepted with an RSA key when no other suites are
+// configured.
+var rsaCipherSuites = []uint16{
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+}
+
+// ecdsaCipherSuites are accepted with an ECDSA or Ed25519 key, both signing
+// the ECDHE_ECDSA key exchanges, when no other suites are configured.
+var ecdsaCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
 // SetCipherSuites will receive a tls.Config pointer and will set CipherSuites
-// array and PreferServerCipherSuites as true.
-func SetCipherSuites(config *tls.Config) {
-	config.CipherSuites = []uint16{
-		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
-		tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
-		tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-		tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+// to the given suites usable with the private key, or to the broker
+// defaults for its type when none is given. It fails when none of the
+// given suites can be used with the key.
+func SetCipherSuites(config *tls.Config, suites []uint16,
+	key crypto.PrivateKey) error {
+
+	defaults, signer := rsaCipherSuites, "_RSA_"
+	if _, ok := key.(*rsa.PrivateKey); !ok {
+		defaults, signer = ecdsaCipherSuites, "_ECDSA_"
+	}
+
+	// The TLS 1.2 suites name the signature authenticating the server, the
+	// TLS 1.3 ones work with any key
+	usable := []uint16{}
+	for _, suite := range suites {
+		name := tls.CipherSuiteName(suite)
+		if strings.Contains(name, signer) ||
+			!strings.Contains(name, "_RSA_") &&
+				!strings.Contains(name, "_ECDSA_") {
+			usable = append(usable, suite)
+		}
+	}
+
+	switch {
+	case len(suites) == 0:
+		usable = defaults
+	case len(usable) == 0:
+		return errors.New("none of the cipher suites can be used with " +
+			"the " + keyTypeName(key) + " key of the certificate")
 	}
+
+	config.CipherSuites = usable
 	config.PreferServerCipherSuites = true
+	return nil
+}
+
+// CipherSuites returns the IDs of cipher suites named as in the crypto/tls
+// package. The suites with known security issues are rejected.
+func CipherSuites(names []string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	suites := []uint16{}
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, errors.New("unknown or insecure cipher suite " + name)
+		}
+		suites = append(suites, id)
+	}
+
+	return suites, nil
+}
+
+// keyTypeName names the type of a private key in the error messages.
+func keyTypeName(key crypto.PrivateKey) string {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return "RSA"
+	case *ecdsa.PrivateKey:
+		return "ECDSA"
+	case ed25519.PrivateKey:
+		return "Ed25519"
+	default:
+		return "unsupported"
+	}
 }
 
 // GetCertificateChain generates a TLS certificate from a valid and secure pair
@@ -133,8 +226,8 @@ func GetCertificateChain(certFile, keyFile string) (tls.Certificate, error) {
 	if err != nil {
 		return tls.Certificate{}, err
 	}
-	log.Println("[INFO] Security cryptographic requirements for certificates " +
-		"were all PASSED!")
+	logging.Info("The certificate meets the cryptographic requirements",
+		"file", certFile)
 
 	return cert, nil
 }
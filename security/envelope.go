@@ -0,0 +1,297 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package security
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+)
+
+const (
+	// Archives are encrypted in chunks so they can be streamed, each one
+	// sealed with a nonce made of its position and a final chunk flag.
+	// Reordered, dropped or truncated chunks fail to open.
+	streamMagic     = "CFNBAES1"
+	streamChunkSize = 64 * 1024
+	streamFinal     = 1
+
+	errorMasterKey     = "the master key must be 32 bytes encoded in base64"
+	errorUnknownMaster = "the data key was wrapped by an unknown master key "
+	errorStreamHeader  = "the archive is not encrypted by the broker"
+	errorStreamClosed  = "write to a closed encryption stream"
+)
+
+// KeyRing holds the master key wrapping the data keys of new archives and
+// the previous master keys still needed to unwrap older ones. Keys are
+// identified by a fingerprint, so rotating the master key only requires
+// re-wrapping the data keys.
+type KeyRing struct {
+	currentID string
+	keys      map[string][]byte
+}
+
+// ParseMasterKey decodes a base64 encoded 256 bit master key.
+func ParseMasterKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != secretKeyLength {
+		return nil, errors.New(errorMasterKey)
+	}
+
+	return key, nil
+}
+
+// NewKeyRing returns a key ring wrapping with current.
+func NewKeyRing(current []byte, previous ...[]byte) (*KeyRing, error) {
+	ring := &KeyRing{keys: map[string][]byte{}}
+
+	for _, key := range append([][]byte{current}, previous...) {
+		if len(key) != secretKeyLength {
+			return nil, errors.New(errorSecretKey)
+		}
+		ring.keys[keyID(key)] = key
+	}
+	ring.currentID = keyID(current)
+
+	return ring, nil
+}
+
+// CurrentID returns the fingerprint of the master key wrapping new data
+// keys.
+func (r *KeyRing) CurrentID() string {
+	return r.currentID
+}
+
+// NewDataKey generates the random key of one archive and returns it along
+// with its wrapped form and the fingerprint of the master key wrapping it.
+func (r *KeyRing) NewDataKey() ([]byte, string, string, error) {
+	dataKey := make([]byte, secretKeyLength)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", "", err
+	}
+
+	wrapped, err := Seal(r.keys[r.currentID], string(dataKey))
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return dataKey, wrapped, r.currentID, nil
+}
+
+// UnwrapDataKey opens a data key wrapped by the master key masterID.
+func (r *KeyRing) UnwrapDataKey(masterID, wrapped string) ([]byte, error) {
+	key, ok := r.keys[masterID]
+	if !ok {
+		return nil, errors.New(errorUnknownMaster + masterID)
+	}
+
+	dataKey, err := Unseal(key, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(dataKey), nil
+}
+
+// RewrapDataKey wraps a data key again with the current master key. The
+// archive it encrypts is left untouched.
+func (r *KeyRing) RewrapDataKey(masterID, wrapped string) (string, string,
+	error) {
+
+	dataKey, err := r.UnwrapDataKey(masterID, wrapped)
+	if err != nil {
+		return "", "", err
+	}
+
+	rewrapped, err := Seal(r.keys[r.currentID], string(dataKey))
+	if err != nil {
+		return "", "", err
+	}
+
+	return rewrapped, r.currentID, nil
+}
+
+// keyID returns the fingerprint of a master key.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// encryptWriter seals what is written to it chunk by chunk.
+type encryptWriter struct {
+	w       io.Writer
+	gcm     cipher.AEAD
+	buffer  []byte
+	counter uint64
+	closed  bool
+}
+
+// NewEncryptWriter returns a writer encrypting a stream with AES-256-GCM
+// under dataKey. Close must be called to write the final chunk, it does not
+// close w.
+func NewEncryptWriter(w io.Writer, dataKey []byte) (io.WriteCloser, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = io.WriteString(w, streamMagic); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:      w,
+		gcm:    gcm,
+		buffer: make([]byte, 0, streamChunkSize),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New(errorStreamClosed)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data follows, so the last
+		// one is always sealed as final by Close
+		if len(e.buffer) == streamChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(e.buffer[len(e.buffer):streamChunkSize], p)
+		e.buffer = e.buffer[:len(e.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close seals the final chunk.
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+
+	return e.seal(true)
+}
+
+// seal encrypts and writes the buffered chunk.
+func (e *encryptWriter) seal(final bool) error {
+	chunk := e.gcm.Seal(nil, chunkNonce(e.counter, final), e.buffer, nil)
+	e.counter++
+	e.buffer = e.buffer[:0]
+
+	_, err := e.w.Write(chunk)
+	return err
+}
+
+// decryptReader opens the chunks written by encryptWriter.
+type decryptReader struct {
+	r       *bufio.Reader
+	gcm     cipher.AEAD
+	chunk   []byte
+	plain   []byte
+	counter uint64
+	done    bool
+}
+
+// NewDecryptReader returns a reader decrypting a stream written by
+// NewEncryptWriter. A stream cut short returns an error instead of io.EOF.
+func NewDecryptReader(r io.Reader, dataKey []byte) (io.Reader, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, len(streamMagic))
+	if _, err = io.ReadFull(r, magic); err != nil ||
+		string(magic) != streamMagic {
+		return nil, errors.New(errorStreamHeader)
+	}
+
+	return &decryptReader{
+		r:     bufio.NewReaderSize(r, streamChunkSize+gcm.Overhead()+1),
+		gcm:   gcm,
+		chunk: make([]byte, streamChunkSize+gcm.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk. The final chunk is the one
+// followed by the end of the stream.
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+		d.done = true
+	}
+	if err != nil {
+		return err
+	}
+
+	if !d.done {
+		if _, err = d.r.Peek(1); err == io.EOF {
+			d.done = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	d.plain, err = d.gcm.Open(d.chunk[:0], chunkNonce(d.counter, d.done),
+		d.chunk[:n], nil)
+	d.counter++
+	return err
+}
+
+// chunkNonce returns the nonce of a chunk: its position followed by the
+// final chunk flag.
+func chunkNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = streamFinal
+	}
+
+	return nonce
+}
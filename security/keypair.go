@@ -0,0 +1,171 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/cf-nosql-broker/logging"
+)
+
+// KeyPair serves the broker certificate through tls.Config.GetCertificate,
+// so it can be replaced without restarting the listener. A new pair is only
+// swapped in once it meets the cryptographic requirements and can be used
+// with the configured cipher suites.
+type KeyPair struct {
+	certFile string
+	keyFile  string
+	suites   []uint16
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	// seen identifies the versions of the files last loaded or rejected.
+	seen [2]fileVersion
+}
+
+// fileVersion tells a file apart from its next version.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// LoadKeyPair loads a key pair meeting the cryptographic requirements, to be
+// served with the given cipher suites, or with the defaults for its key type
+// when there is none.
+func LoadKeyPair(certFile, keyFile string, suites []uint16) (*KeyPair,
+	error) {
+
+	k := &KeyPair{
+		certFile: certFile,
+		keyFile:  keyFile,
+		suites:   suites,
+		seen:     [2]fileVersion{version(certFile), version(keyFile)},
+	}
+
+	cert, err := k.load()
+	if err != nil {
+		return nil, err
+	}
+	k.cert = &cert
+
+	return k, nil
+}
+
+// load reads the key pair files and checks them.
+func (k *KeyPair) load() (tls.Certificate, error) {
+	cert, err := GetCertificateChain(k.certFile, k.keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	err = SetCipherSuites(&tls.Config{}, k.suites, cert.PrivateKey)
+	return cert, err
+}
+
+// Config returns the TLS configuration of a server presenting the key pair.
+// The cipher suites are chosen for each connection, so they follow the key
+// type of the certificate when it is replaced by one of another type.
+func (k *KeyPair) Config() *tls.Config {
+	base := &tls.Config{
+		GetCertificate: k.GetCertificate,
+	}
+
+	return &tls.Config{
+		GetCertificate: k.GetCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, _ := k.GetCertificate(nil)
+
+			config := base.Clone()
+			err := SetCipherSuites(config, k.suites, cert.PrivateKey)
+			return config, err
+		},
+	}
+}
+
+// GetCertificate returns the current certificate, whatever the client hello.
+func (k *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate,
+	error) {
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.cert, nil
+}
+
+// Reload loads the key pair files again and replaces the current
+// certificate if they meet the cryptographic requirements, keeping the
+// current one otherwise. The outcome is logged.
+func (k *KeyPair) Reload() error {
+	log := logging.With("operation", "reload_certificate", "file", k.certFile)
+
+	versions := [2]fileVersion{version(k.certFile), version(k.keyFile)}
+	cert, err := k.load()
+
+	k.mu.Lock()
+	k.seen = versions
+	if err == nil {
+		k.cert = &cert
+	}
+	k.mu.Unlock()
+
+	if err != nil {
+		log.Error("The new key pair is rejected, the current certificate "+
+			"is kept", "error", err)
+		return err
+	}
+
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		log.Info("Certificate reloaded", "subject", leaf.Subject.String(),
+			"key_type", keyTypeName(cert.PrivateKey),
+			"not_after", leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// Watch reloads the key pair whenever its files change, checking them every
+// interval. It never returns.
+func (k *KeyPair) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		versions := [2]fileVersion{version(k.certFile), version(k.keyFile)}
+
+		k.mu.RLock()
+		changed := versions != k.seen
+		k.mu.RUnlock()
+
+		// A rejected pair is not tried again until one of its files changes,
+		// so a certificate written before its key is picked up with the key
+		if changed {
+			k.Reload() // nolint: errcheck
+		}
+	}
+}
+
+// version returns the version of a file, the zero one when it can not be
+// read.
+func version(file string) fileVersion {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fileVersion{}
+	}
+
+	return fileVersion{info.ModTime(), info.Size()}
+}
@@ -0,0 +1,141 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package security
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+)
+
+const (
+	secretKeyLength   = 32
+	passwordAlphabet  = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789" // nolint: lll
+	errorSecretKey    = "the secret key must be 32 bytes long"
+	errorSealedSecret = "the sealed secret is malformed"
+)
+
+// GeneratePassword returns a random alphanumeric password of the given length
+// using the operating system cryptographic random source.
+func GeneratePassword(length int) (string, error) {
+	max := big.NewInt(int64(len(passwordAlphabet)))
+	password := make([]byte, length)
+
+	for i := range password {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		password[i] = passwordAlphabet[n.Int64()]
+	}
+
+	return string(password), nil
+}
+
+// LoadOrCreateKey reads the AES-256 key used to seal secrets at rest. If the
+// file does not exist a new random key is generated and written with owner
+// only permissions.
+func LoadOrCreateKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(key) != secretKeyLength {
+			return nil, errors.New(errorSecretKey)
+		}
+		return key, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, secretKeyLength)
+	if _, err = rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	if err = ioutil.WriteFile(path, key, 0600); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Seal encrypts a secret with AES-256-GCM and returns it base64 encoded with
+// the nonce prepended, ready to be persisted.
+func Seal(key []byte, secret string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Unseal decrypts a secret previously encrypted by Seal.
+func Unseal(key []byte, sealed string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New(errorSealedSecret)
+	}
+
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	secret, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(secret), nil
+}
+
+// newGCM builds the AES-GCM cipher for a 256 bit key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != secretKeyLength {
+		return nil, errors.New(errorSecretKey)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
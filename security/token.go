@@ -0,0 +1,87 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	errorMalformedToken = "the token is malformed"
+	errorInvalidToken   = "the token signature is not valid"
+	errorExpiredToken   = "the token has expired"
+)
+
+// SignToken returns a URL safe token granting access to subject until the
+// given expiry. The token carries its expiry and an HMAC-SHA256 signature of
+// both values, so it can be verified without keeping any state.
+func SignToken(key []byte, subject string, expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return expiry + "." + tokenSignature(key, subject, expiry)
+}
+
+// VerifyToken checks that a token was signed by SignToken for subject and
+// has not expired.
+func VerifyToken(key []byte, subject, token string, now time.Time) error {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return errors.New(errorMalformedToken)
+	}
+
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return errors.New(errorMalformedToken)
+	}
+
+	expected := tokenSignature(key, subject, parts[0])
+	if !hmac.Equal([]byte(expected), []byte(parts[1])) {
+		return errors.New(errorInvalidToken)
+	}
+
+	if now.After(time.Unix(expiry, 0)) {
+		return errors.New(errorExpiredToken)
+	}
+
+	return nil
+}
+
+// DeriveKey derives a 32 bytes key for a single purpose from a secret with
+// HKDF-SHA256 (RFC 5869), so the same secret is never used directly by two
+// algorithms.
+func DeriveKey(secret []byte, purpose string) []byte {
+	// Extract with an all zero salt, then expand a single block
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(secret) // nolint: errcheck
+
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(purpose)) // nolint: errcheck
+	expand.Write([]byte{1})       // nolint: errcheck
+	return expand.Sum(nil)
+}
+
+// tokenSignature computes the base64 URL encoded signature of a token.
+func tokenSignature(key []byte, subject, expiry string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(subject + "\n" + expiry)) // nolint: errcheck
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
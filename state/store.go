@@ -0,0 +1,509 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	stateFile = "state.json"
+
+	// maxOperations is the number of operations kept per instance.
+	maxOperations = 50
+	// maxHealthEvents is the number of health events kept per instance.
+	maxHealthEvents = 50
+)
+
+// Instance is the broker record of a provisioned database service.
+type Instance struct {
+	ID             string `json:"id"`
+	ServiceID      string `json:"service_id"`
+	PlanID         string `json:"plan_id"`
+	OrganizationID string `json:"organization_guid"`
+	SpaceID        string `json:"space_guid"`
+	ContainerName  string `json:"container_name"`
+	HostPort       string `json:"host_port"`
+	AdminUserName  string `json:"admin_username"`
+	// AdminPassword is sealed with the broker secret key, see security.Seal.
+	AdminPassword string `json:"admin_password"`
+	// TLS is set when the instance only accepts encrypted connections.
+	TLS bool `json:"tls"`
+	// ReplicaSet is set when the instance runs as a replica set whose oplog
+	// is archived for point-in-time recovery.
+	ReplicaSet bool `json:"replica_set,omitempty"`
+	// RestoredFrom is the backup the instance was seeded from, if any.
+	RestoredFrom string `json:"restored_from,omitempty"`
+	// Parameters are the provision parameters as applied, returned when
+	// the platform fetches the instance.
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	// Stopped is set while an operator keeps the container stopped, so the
+	// health monitor does not restart it.
+	Stopped bool `json:"stopped,omitempty"`
+	// State is OperationFailed once the instance is known to be broken, for
+	// example when its container disappeared, and empty otherwise.
+	State            string    `json:"state,omitempty"`
+	StateDescription string    `json:"state_description,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// States of an asynchronous operation, as reported to the platform.
+const (
+	OperationInProgress = "in progress"
+	OperationSucceeded  = "succeeded"
+	OperationFailed     = "failed"
+)
+
+// Binding is the broker record of the database user created for a binding.
+type Binding struct {
+	ID           string `json:"id"`
+	InstanceID   string `json:"instance_id"`
+	ServiceID    string `json:"service_id"`
+	PlanID       string `json:"plan_id"`
+	DatabaseName string `json:"database_name"`
+	UserName     string `json:"username"`
+	// Password is sealed with the broker secret key, so the credentials can
+	// be returned again when the platform fetches the binding.
+	Password string `json:"password,omitempty"`
+	// State is the state of the creation of the database user, empty for
+	// the bindings created before it was recorded, which all succeeded.
+	State            string    `json:"state,omitempty"`
+	StateDescription string    `json:"state_description,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// Ready reports whether the database user of the binding was created.
+func (b Binding) Ready() bool {
+	return b.State == "" || b.State == OperationSucceeded
+}
+
+// Provision is the state of an asynchronous provision until its instance is
+// saved, so the platform polling it gets an answer across broker restarts.
+type Provision struct {
+	InstanceID       string    `json:"instance_id"`
+	State            string    `json:"state"`
+	StateDescription string    `json:"state_description,omitempty"`
+	AcceptedAt       time.Time `json:"accepted_at"`
+}
+
+// Operation records an action performed by the broker on an instance.
+type Operation struct {
+	Type        string    `json:"type"`
+	Description string    `json:"description"`
+	Succeeded   bool      `json:"succeeded"`
+	Time        time.Time `json:"time"`
+}
+
+// HealthEvent records a change of the health of an instance, or a restart
+// of its container by the health monitor.
+type HealthEvent struct {
+	Status      string    `json:"status"`
+	Description string    `json:"description"`
+	Time        time.Time `json:"time"`
+}
+
+// Store keeps the instances and bindings managed by the broker in a JSON file
+// only readable by the broker user.
+type Store struct {
+	mu   sync.Mutex
+	path string
+	data data
+}
+
+type data struct {
+	Instances  map[string]Instance      `json:"instances"`
+	Bindings   map[string]Binding       `json:"bindings"`
+	Operations map[string][]Operation   `json:"operations"`
+	Health     map[string][]HealthEvent `json:"health"`
+	Provisions map[string]Provision     `json:"provisions"`
+}
+
+// Open loads the store persisted in dir, creating an empty one if needed.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		path: filepath.Join(dir, stateFile),
+		data: data{
+			Instances:  map[string]Instance{},
+			Bindings:   map[string]Binding{},
+			Operations: map[string][]Operation{},
+			Health:     map[string][]HealthEvent{},
+			Provisions: map[string]Provision{},
+		},
+	}
+
+	content, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(content, &s.data); err != nil {
+		return nil, err
+	}
+
+	// State files written by older versions have no operations, health nor
+	// provisions
+	if s.data.Operations == nil {
+		s.data.Operations = map[string][]Operation{}
+	}
+	if s.data.Health == nil {
+		s.data.Health = map[string][]HealthEvent{}
+	}
+	if s.data.Provisions == nil {
+		s.data.Provisions = map[string]Provision{}
+	}
+
+	return s, nil
+}
+
+// Instance returns the instance with the given ID.
+func (s *Store) Instance(id string) (Instance, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	instance, ok := s.data.Instances[id]
+	return instance, ok
+}
+
+// Instances returns every instance sorted by creation time.
+func (s *Store) Instances() []Instance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	instances := make([]Instance, 0, len(s.data.Instances))
+	for _, instance := range s.data.Instances {
+		instances = append(instances, instance)
+	}
+
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].CreatedAt.Before(instances[j].CreatedAt)
+	})
+
+	return instances
+}
+
+// PutInstance creates or replaces an instance, completing its asynchronous
+// provision if any.
+func (s *Store) PutInstance(instance Instance) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.data
+	next.Instances = copyInstances(s.data.Instances)
+	next.Instances[instance.ID] = instance
+	if _, ok := s.data.Provisions[instance.ID]; ok {
+		next.Provisions = copyProvisions(s.data.Provisions)
+		delete(next.Provisions, instance.ID)
+	}
+
+	return s.commit(next)
+}
+
+// DeleteInstance removes an instance together with its bindings and its
+// asynchronous provision.
+func (s *Store) DeleteInstance(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := data{
+		Instances:  copyInstances(s.data.Instances),
+		Bindings:   copyBindings(s.data.Bindings),
+		Operations: copyOperations(s.data.Operations),
+		Health:     copyHealth(s.data.Health),
+		Provisions: copyProvisions(s.data.Provisions),
+	}
+	delete(next.Instances, id)
+	delete(next.Operations, id)
+	delete(next.Health, id)
+	delete(next.Provisions, id)
+	for bindingID, binding := range next.Bindings {
+		if binding.InstanceID == id {
+			delete(next.Bindings, bindingID)
+		}
+	}
+
+	return s.commit(next)
+}
+
+// Binding returns the binding with the given ID.
+func (s *Store) Binding(id string) (Binding, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	binding, ok := s.data.Bindings[id]
+	return binding, ok
+}
+
+// Bindings returns the bindings of an instance sorted by creation time.
+func (s *Store) Bindings(instanceID string) []Binding {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bindings := []Binding{}
+	for _, binding := range s.data.Bindings {
+		if binding.InstanceID == instanceID {
+			bindings = append(bindings, binding)
+		}
+	}
+
+	sort.Slice(bindings, func(i, j int) bool {
+		return bindings[i].CreatedAt.Before(bindings[j].CreatedAt)
+	})
+
+	return bindings
+}
+
+// PutBinding creates or replaces a binding.
+func (s *Store) PutBinding(binding Binding) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.data
+	next.Bindings = copyBindings(s.data.Bindings)
+	next.Bindings[binding.ID] = binding
+
+	return s.commit(next)
+}
+
+// DeleteBinding removes a binding.
+func (s *Store) DeleteBinding(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.data
+	next.Bindings = copyBindings(s.data.Bindings)
+	delete(next.Bindings, id)
+
+	return s.commit(next)
+}
+
+// Provision returns the asynchronous provision of an instance without
+// record.
+func (s *Store) Provision(instanceID string) (Provision, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	provision, ok := s.data.Provisions[instanceID]
+	return provision, ok
+}
+
+// Provisions returns the asynchronous provisions sorted by acceptance time.
+func (s *Store) Provisions() []Provision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	provisions := make([]Provision, 0, len(s.data.Provisions))
+	for _, provision := range s.data.Provisions {
+		provisions = append(provisions, provision)
+	}
+
+	sort.Slice(provisions, func(i, j int) bool {
+		return provisions[i].AcceptedAt.Before(provisions[j].AcceptedAt)
+	})
+
+	return provisions
+}
+
+// PutProvision creates or replaces the asynchronous provision of an
+// instance.
+func (s *Store) PutProvision(provision Provision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.data
+	next.Provisions = copyProvisions(s.data.Provisions)
+	next.Provisions[provision.InstanceID] = provision
+
+	return s.commit(next)
+}
+
+// DeleteProvision removes the asynchronous provision of an instance.
+func (s *Store) DeleteProvision(instanceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.data.Provisions[instanceID]; !ok {
+		return nil
+	}
+
+	next := s.data
+	next.Provisions = copyProvisions(s.data.Provisions)
+	delete(next.Provisions, instanceID)
+
+	return s.commit(next)
+}
+
+// Operations returns the most recent operations of an instance, newest first.
+func (s *Store) Operations(instanceID string) []Operation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recorded := s.data.Operations[instanceID]
+	operations := make([]Operation, 0, len(recorded))
+	for i := len(recorded) - 1; i >= 0; i-- {
+		operations = append(operations, recorded[i])
+	}
+
+	return operations
+}
+
+// AddOperation records an operation of an instance, discarding the oldest
+// ones beyond maxOperations.
+func (s *Store) AddOperation(instanceID string, operation Operation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recorded := s.data.Operations[instanceID]
+	operations := make([]Operation, 0, len(recorded)+1)
+	operations = append(append(operations, recorded...), operation)
+	if len(operations) > maxOperations {
+		operations = operations[len(operations)-maxOperations:]
+	}
+
+	next := s.data
+	next.Operations = copyOperations(s.data.Operations)
+	next.Operations[instanceID] = operations
+
+	return s.commit(next)
+}
+
+// HealthEvents returns the most recent health events of an instance, newest
+// first.
+func (s *Store) HealthEvents(instanceID string) []HealthEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recorded := s.data.Health[instanceID]
+	events := make([]HealthEvent, 0, len(recorded))
+	for i := len(recorded) - 1; i >= 0; i-- {
+		events = append(events, recorded[i])
+	}
+
+	return events
+}
+
+// AddHealthEvent records a health event of an instance, discarding the
+// oldest ones beyond maxHealthEvents.
+func (s *Store) AddHealthEvent(instanceID string, event HealthEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recorded := s.data.Health[instanceID]
+	events := make([]HealthEvent, 0, len(recorded)+1)
+	events = append(append(events, recorded...), event)
+	if len(events) > maxHealthEvents {
+		events = events[len(events)-maxHealthEvents:]
+	}
+
+	next := s.data
+	next.Health = copyHealth(s.data.Health)
+	next.Health[instanceID] = events
+
+	return s.commit(next)
+}
+
+// commit persists the next state of the store and only then makes it the
+// current one, so a failed write leaves the store as it was on disk. The
+// caller must hold the lock.
+func (s *Store) commit(next data) error {
+	if err := s.save(next); err != nil {
+		return err
+	}
+
+	s.data = next
+	return nil
+}
+
+// save writes the given state to a temporary file and renames it so a crash
+// never leaves a truncated state file behind.
+func (s *Store) save(d data) error {
+	content, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// copyInstances returns a copy of the instances the next state can modify.
+func copyInstances(instances map[string]Instance) map[string]Instance {
+	copied := make(map[string]Instance, len(instances)+1)
+	for id, instance := range instances {
+		copied[id] = instance
+	}
+
+	return copied
+}
+
+// copyBindings returns a copy of the bindings the next state can modify.
+func copyBindings(bindings map[string]Binding) map[string]Binding {
+	copied := make(map[string]Binding, len(bindings)+1)
+	for id, binding := range bindings {
+		copied[id] = binding
+	}
+
+	return copied
+}
+
+// copyOperations returns a copy of the operation lists the next state can
+// modify. The lists themselves are replaced, never written in place.
+func copyOperations(operations map[string][]Operation) map[string][]Operation {
+	copied := make(map[string][]Operation, len(operations)+1)
+	for id, recorded := range operations {
+		copied[id] = recorded
+	}
+
+	return copied
+}
+
+// copyHealth returns a copy of the health event lists the next state can
+// modify. The lists themselves are replaced, never written in place.
+func copyHealth(health map[string][]HealthEvent) map[string][]HealthEvent {
+	copied := make(map[string][]HealthEvent, len(health)+1)
+	for id, recorded := range health {
+		copied[id] = recorded
+	}
+
+	return copied
+}
+
+// copyProvisions returns a copy of the provisions the next state can modify.
+func copyProvisions(provisions map[string]Provision) map[string]Provision {
+	copied := make(map[string]Provision, len(provisions)+1)
+	for id, provision := range provisions {
+		copied[id] = provision
+	}
+
+	return copied
+}